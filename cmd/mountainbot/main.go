@@ -21,6 +21,7 @@ import (
 
 	"github.com/Krognol/dgofw"
 	"github.com/Krognol/gofycat"
+	"github.com/Krognol/mountainbot/plugins/automod"
 	"github.com/Krognol/mountainbot/plugins/gfycat"
 	"github.com/Krognol/mountainbot/plugins/lastfm"
 	"github.com/Krognol/mountainbot/plugins/malist"
@@ -29,10 +30,16 @@ import (
 	"github.com/Krognol/mountainbot/plugins/opeth"
 	"github.com/Krognol/mountainbot/plugins/owplugin"
 	"github.com/Krognol/mountainbot/plugins/quoteplugin"
+	"github.com/Krognol/mountainbot/plugins/reminders"
+	"github.com/Krognol/mountainbot/plugins/roles"
+	"github.com/Krognol/mountainbot/plugins/scheduler"
 	"github.com/Krognol/mountainbot/plugins/spotifyplugin"
+	"github.com/Krognol/mountainbot/plugins/starboard"
 	"github.com/Krognol/mountainbot/plugins/tags"
 	"github.com/Krognol/mountainbot/plugins/udplugin"
 	"github.com/Krognol/mountainbot/plugins/userinfo"
+	"github.com/Krognol/mountainbot/plugins/warnings"
+	"github.com/Krognol/mountainbot/plugins/welcome"
 	"github.com/Krognol/mountainbot/plugins/wiktionaryplugin"
 	"github.com/Krognol/mountainbot/plugins/wolframplugin"
 )
@@ -62,6 +69,7 @@ type (
 			Discord struct {
 				Token  string `json:"token"`
 				Prefix string `json:"prefix"`
+				Owner  string `json:"owner"`
 			} `json:"discord"`
 			Gfycat IDSecretPair `json:"gfycat"`
 			LastFM struct {
@@ -77,8 +85,13 @@ type (
 			Wolfram struct {
 				AppID string `json:"appid"`
 			} `json:"wolfram"`
-			Spotify IDSecretPair `json:"spotify"`
-			Reddit  IDSecretPair `json:"reddit"`
+			Spotify IDSecretPair       `json:"spotify"`
+			Reddit  IDSecretPair       `json:"reddit"`
+			Music   music.SourceConfig `json:"music"`
+			Quotes  struct {
+				// Exports go to a gist of this account instead of an attachment if set
+				GistToken string `json:"gist_token"`
+			} `json:"quotes"`
 			Logging struct {
 				Log     bool   `json:"log"`
 				Level   int    `json:"level"` // 1-3
@@ -88,7 +101,7 @@ type (
 	}
 )
 
-func setupLogging(discord *dgofw.DiscordClient, level int, ch string) {
+func setupLogging(discord *dgofw.DiscordClient, level int, ch string, welc *welcome.Welcome) {
 	if level >= 1 {
 		discord.WithGuildBanAdd(false, func(ban *dgofw.DiscordGuildBan) {
 			discord.Send(ch, ban.User.Username()+" was banned!")
@@ -98,12 +111,17 @@ func setupLogging(discord *dgofw.DiscordClient, level int, ch string) {
 			discord.Send(ch, ban.User.Username()+" was unbanned!")
 		})
 
-		discord.OnMemberAdd(false, func(mem *dgofw.DiscordMember) {
-			discord.Send(ch, mem.User.Username()+" just joined the server!")
+		// Servers with welcome or farewell messages already get those
+		discord.Session().AddHandler(func(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+			if m.User != nil && !welc.Posts(m.GuildID, false) {
+				discord.Send(ch, m.User.Username+" just joined the server!")
+			}
 		})
 
-		discord.OnMemberRemove(false, func(mem *dgofw.DiscordMember) {
-			discord.Send(ch, mem.User.Username()+" left the server!")
+		discord.Session().AddHandler(func(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+			if m.User != nil && !welc.Posts(m.GuildID, true) {
+				discord.Send(ch, m.User.Username+" left the server!")
+			}
 		})
 	}
 }
@@ -133,19 +151,32 @@ func main() {
 	}
 
 	discord := dgofw.NewDiscordClient(cfg.Modules.Discord.Token)
-
-	if cfg.Modules.Logging.Log && cfg.Modules.Logging.Channel != "" {
-		setupLogging(discord, cfg.Modules.Logging.Level, cfg.Modules.Logging.Channel)
-	}
+	sched := scheduler.NewScheduler("./schedulerstate.json", nil)
 
 	gfyc := gfycat.NewGfyCatPlugin(cfg.Modules.Gfycat.ClientID, cfg.Modules.Gfycat.ClientSecret, gofycat.Client)
 	lfmc := lastfm.NewLastFMClient(cfg.Modules.LastFM.AppID)
 	opeth := opeth.NewOpethPlugin()
 	wap := wolframplugin.NewWolframPlugin(cfg.Modules.Wolfram.AppID)
-	quotes := quoteplugin.NewQuotePlugin()
-	tagsp := tags.NewTags()
+	quotes := quoteplugin.NewQuotePlugin(discord, sched)
+	if cfg.Modules.Quotes.GistToken != "" {
+		quotes.Exporter = quoteplugin.NewGistExporter(cfg.Modules.Quotes.GistToken)
+	}
+	tagsp := tags.NewTags(cfg.Modules.Discord.Owner)
 	sptfy := spotifyplugin.NewSpotifyPlugin(cfg.Modules.Spotify.ClientID, cfg.Modules.Spotify.ClientSecret)
-	musicc := music.NewMusicPlayer(discord)
+	msrc, err := music.NewSource(cfg.Modules.Music)
+	if err != nil {
+		panic(err)
+	}
+	musicc := music.NewMusicPlayer(discord, msrc)
+	warns := warnings.NewWarnings()
+	amod := automod.NewAutoMod(cfg.Modules.Logging.Channel, warns)
+	welc := welcome.NewWelcome()
+	if cfg.Modules.Logging.Log && cfg.Modules.Logging.Channel != "" {
+		setupLogging(discord, cfg.Modules.Logging.Level, cfg.Modules.Logging.Channel, welc)
+	}
+	rolesp := roles.NewRoles()
+	stars := starboard.NewStarboard()
+	remind := reminders.NewReminders(discord, sched)
 	reddit := memes.NewMemer(runtime.GOOS + ":mountainbot:v0.1: (by /u/Krognol)")
 	weebc := malist.NewWeebClient(
 		cfg.Modules.Weebery.Anilist.ClientID,
@@ -154,6 +185,20 @@ func main() {
 		cfg.Modules.Weebery.MAL.Password,
 	)
 
+	discord.Session().AddHandler(amod.OnMessageCreate)
+	discord.Session().AddHandler(amod.OnMemberAdd)
+	discord.Session().AddHandler(welc.OnMemberAdd)
+	discord.Session().AddHandler(welc.OnMemberRemove)
+	discord.Session().AddHandler(rolesp.OnReactionAdd)
+	discord.Session().AddHandler(rolesp.OnReactionRemove)
+	discord.Session().AddHandler(rolesp.OnReady)
+	discord.Session().AddHandler(stars.OnReactionAdd)
+	discord.Session().AddHandler(stars.OnReactionRemove)
+	discord.Session().AddHandler(stars.OnReactionRemoveAll)
+	discord.Session().AddHandler(musicc.OnVoiceStateUpdate)
+	discord.Session().AddHandler(musicc.OnResumed)
+	discord.Session().AddHandler(musicc.OnReady)
+
 	discord.OnReady(true, func(r *discordgo.Ready) {
 		discord.SetStatus(cfg.Modules.Discord.Prefix + "help")
 	})
@@ -182,6 +227,19 @@ func main() {
 	discord.OnMessage(cfg.buildCommand("ow", "battletag", "region"), false, owplugin.OWOnMessage)
 	discord.OnMessage(cfg.buildCommand("tag", "arg1", "arg2", "arg3"), false, tagsp.OnMessage)
 	discord.OnMessage(cfg.buildCommand("spotify", "arg1", "arg2", "arg3"), false, sptfy.OnMessage)
+	discord.OnMessage(cfg.buildCommand("warn", "user", "reason"), false, warns.OnWarn)
+	discord.OnMessage(cfg.buildCommand("warnings", "user"), false, warns.OnWarnings)
+	discord.OnMessage(cfg.buildCommand("pardon", "case"), false, warns.OnPardon)
+	discord.OnMessage(cfg.buildCommand("warnconfig", "arg1", "arg2", "arg3", "arg4"), false, warns.OnConfig)
+	discord.OnMessage(cfg.buildCommand("automod", "arg1", "arg2", "arg3", "arg4"), false, amod.OnMessage)
+	discord.OnMessage(cfg.buildCommand("welcome", "arg1", "arg2"), false, welc.OnWelcome)
+	discord.OnMessage(cfg.buildCommand("farewell", "arg1", "arg2"), false, welc.OnFarewell)
+	discord.OnMessage(cfg.buildCommand("iam", "role"), false, rolesp.OnIAm)
+	discord.OnMessage(cfg.buildCommand("iamnot", "role"), false, rolesp.OnIAmNot)
+	discord.OnMessage(cfg.buildCommand("roles", "arg1", "arg2"), false, rolesp.OnMessage)
+	discord.OnMessage(cfg.buildCommand("stars", "arg1", "arg2"), false, stars.OnMessage)
+	discord.OnMessage(cfg.buildCommand("remind", "target", "when"), false, remind.OnRemind)
+	discord.OnMessage(cfg.buildCommand("reminders", "arg1", "arg2"), false, remind.OnReminders)
 
 	discord.OnMessage(cfg.buildCommand("ping"), false, func(m *dgofw.DiscordMessage) {
 		m.Reply("pong!")
@@ -228,7 +286,7 @@ func main() {
 	discord.OnMessage(cfg.buildCommand("help", "mod"), false, func(m *dgofw.DiscordMessage) {
 		mod := m.Arg("mod")
 		if mod == "" {
-			m.Reply("use `" + cfg.Modules.Discord.Prefix + "help [thing]`\nThings:'gfy', 'fm', 'mal', 'wiki', 'urban',\n'wolfram', 'tags', 'quotes', 'ow', 'userinfo', 'spotify', 'other'")
+			m.Reply("use `" + cfg.Modules.Discord.Prefix + "help [thing]`\nThings:'gfy', 'fm', 'mal', 'wiki', 'urban',\n'wolfram', 'tags', 'quotes', 'ow', 'userinfo', 'spotify', 'warnings', 'automod', 'welcome', 'roles', 'stars', 'remind', 'other'")
 			return
 		}
 		var help string
@@ -257,6 +315,18 @@ func main() {
 			help = strings.Join(spotifyplugin.SpotifyHelp, "\n")
 		case "music":
 			help = strings.Join(music.MusicHelp, "\n")
+		case "warnings", "warn":
+			help = strings.Join(warnings.WarningsHelp, "\n")
+		case "automod":
+			help = strings.Join(automod.AutoModHelp, "\n")
+		case "welcome", "farewell":
+			help = strings.Join(welcome.WelcomeHelp, "\n")
+		case "roles", "iam":
+			help = strings.Join(roles.RolesHelp, "\n")
+		case "stars", "starboard":
+			help = strings.Join(starboard.StarboardHelp, "\n")
+		case "remind", "reminders":
+			help = strings.Join(reminders.ReminderHelp, "\n")
 		case "other":
 			help = "lenny -- Random lenny face\nping -- Pong!\ncowsay [text] -- Moo\nroll [N] -- Rolls a random number between 0..N\nmeme -- dank meme\nwholesomememe -- FeelsOkMan"
 		}
@@ -264,11 +334,19 @@ func main() {
 	})
 
 	discord.Connect()
+	sched.Start()
 
 	close := make(chan os.Signal, 1)
 	signal.Notify(close, os.Interrupt, os.Kill)
 
 	<-close
+	sched.Stop()
+	if err := musicc.Close(); err != nil {
+		fmt.Println(err)
+	}
+	if err := tagsp.Close(); err != nil {
+		fmt.Println(err)
+	}
 	discord.Disconnect()
 	os.Exit(0)
 }
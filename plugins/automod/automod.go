@@ -0,0 +1,697 @@
+package automod
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/Krognol/mountainbot/plugins/warnings"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	RuleSpam     = "spam"
+	RuleMentions = "mentions"
+	RuleInvites  = "invites"
+	RuleWords    = "words"
+	RuleCaps     = "caps"
+	RuleEmoji    = "emoji"
+	RuleRaid     = "raid"
+
+	ActionDelete  = "delete"
+	ActionWarn    = "warn"
+	ActionTimeout = "timeout"
+)
+
+var ruleNames = []string{RuleSpam, RuleMentions, RuleInvites, RuleWords, RuleCaps, RuleEmoji, RuleRaid}
+
+type (
+	// Rule is the configuration of a single filter.
+	//   spam     -- Limit identical messages within Seconds
+	//   mentions -- Limit mentions in a single message
+	//   caps     -- Limit percent uppercase letters in a message
+	//   emoji    -- Limit emojis in a single message
+	//   raid     -- Limit joins of accounts younger than Days within Seconds
+	Rule struct {
+		Enabled bool   `json:"enabled"`
+		Action  string `json:"action"`
+		Limit   int    `json:"limit"`
+		Seconds int    `json:"seconds"`
+		Days    int    `json:"days"`
+		Minutes int    `json:"minutes"`
+	}
+
+	Server struct {
+		ID             string           `json:"id"`
+		LogChannel     string           `json:"log_channel"`
+		Rules          map[string]*Rule `json:"rules"`
+		BlockedWords   []string         `json:"blocked_words"`
+		ExemptRoles    []string         `json:"exempt_roles"`
+		ExemptChannels []string         `json:"exempt_channels"`
+
+		words []*regexp.Regexp
+	}
+
+	event struct {
+		content string
+		time    time.Time
+		// expires is when the event falls out of the rule's window
+		expires time.Time
+	}
+
+	AutoMod struct {
+		sync.RWMutex
+		Servers []*Server `json:"servers"`
+
+		logChannel string
+		warns      *warnings.Warnings
+
+		historyMu sync.Mutex
+		history   map[string][]event
+		joins     map[string][]event
+		pruned    time.Time
+	}
+)
+
+var AutoModHelp = []string{
+	"automod -- Shows the automod rules for the server. All automod commands are mod only.",
+	"automod enable [rule] / automod disable [rule] -- Rules: spam, mentions, invites, words, caps, emoji, raid",
+	"automod action [rule] [delete|warn|timeout] [minutes] -- What to do when a rule is broken",
+	"automod limit [rule] [N] [seconds] -- Sets the limit of a rule, seconds is used by spam and raid",
+	"automod age [days] -- Accounts younger than this count towards the raid rule",
+	"automod word add [regex] / automod word remove [regex] -- Blocked word list",
+	"automod exempt [@role | #channel] / automod unexempt [@role | #channel]",
+	"automod log [#channel] -- Where automod actions are logged, defaults to the bot log channel",
+}
+
+var (
+	inviteRegex = regexp.MustCompile(`(?i)(discord\.(gg|io|me|li)|discord(app)?\.com/invite)/[a-z0-9-]+`)
+	emojiRegex  = regexp.MustCompile(`<a?:\w+:[0-9]+>`)
+)
+
+func defaultRules() map[string]*Rule {
+	return map[string]*Rule{
+		RuleSpam:     {Action: ActionDelete, Limit: 4, Seconds: 10},
+		RuleMentions: {Action: ActionWarn, Limit: 6},
+		RuleInvites:  {Action: ActionDelete},
+		RuleWords:    {Action: ActionDelete},
+		RuleCaps:     {Action: ActionDelete, Limit: 80},
+		RuleEmoji:    {Action: ActionDelete, Limit: 10},
+		RuleRaid:     {Action: ActionTimeout, Limit: 5, Seconds: 30, Days: 7, Minutes: 60},
+	}
+}
+
+// NewAutoMod creates the automod plugin. logChannel is used for the server it
+// belongs to if that server hasn't set its own log channel, and warns may be nil in which case the
+// warn action only deletes the message.
+func NewAutoMod(logChannel string, warns *warnings.Warnings) *AutoMod {
+	plugin := &AutoMod{
+		Servers:    make([]*Server, 0),
+		logChannel: logChannel,
+		warns:      warns,
+		history:    make(map[string][]event),
+		joins:      make(map[string][]event),
+	}
+	err := plugin.Load()
+	if err != nil {
+		fmt.Println(err.Error())
+		plugin.Save()
+	}
+	return plugin
+}
+
+func (s *Server) compileWords() {
+	s.words = make([]*regexp.Regexp, 0, len(s.BlockedWords))
+	for _, word := range s.BlockedWords {
+		if re, err := regexp.Compile("(?i)" + word); err == nil {
+			s.words = append(s.words, re)
+		}
+	}
+}
+
+func (s *Server) exempt(channelID string, roles []string) bool {
+	for _, id := range s.ExemptChannels {
+		if id == channelID {
+			return true
+		}
+	}
+	for _, id := range s.ExemptRoles {
+		for _, role := range roles {
+			if id == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getServer must be called with the lock held.
+func (a *AutoMod) getServer(id string, create bool) *Server {
+	for _, s := range a.Servers {
+		if s.ID == id {
+			return s
+		}
+	}
+	if !create {
+		return nil
+	}
+	s := &Server{
+		ID:             id,
+		Rules:          defaultRules(),
+		BlockedWords:   make([]string, 0),
+		ExemptRoles:    make([]string, 0),
+		ExemptChannels: make([]string, 0),
+	}
+	a.Servers = append(a.Servers, s)
+	return s
+}
+
+// logChannelOf returns where the actions of a server are logged. Has to be
+// called with the lock held.
+func (a *AutoMod) logChannelOf(srv *Server) string {
+	if srv != nil && srv.LogChannel != "" {
+		return srv.LogChannel
+	}
+	return a.logChannel
+}
+
+// logChannelIn returns ch if it belongs to the guild, so the actions of one
+// server never end up in the log of another.
+func logChannelIn(s *discordgo.Session, ch, guildID string) string {
+	if ch == "" || !discordutil.ChannelInGuild(s, ch, guildID) {
+		return ""
+	}
+	return ch
+}
+
+func (a *AutoMod) log(s *discordgo.Session, ch, text string) {
+	if ch != "" {
+		s.ChannelMessageSend(ch, text)
+	}
+}
+
+// pruneEvents drops the events that are out of their window and deletes the
+// keys left without any. Has to be called with historyMu held.
+func pruneEvents(events map[string][]event, now time.Time) {
+	for key, list := range events {
+		var kept []event
+		for _, e := range list {
+			if e.expires.After(now) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(events, key)
+		} else {
+			events[key] = kept
+		}
+	}
+}
+
+// prune forgets old messages and joins at most once a minute, so users that
+// stop talking and servers that stop getting joins don't stay in memory.
+// Has to be called with historyMu held.
+func (a *AutoMod) prune(now time.Time) {
+	if now.Sub(a.pruned) < time.Minute {
+		return
+	}
+	a.pruned = now
+	pruneEvents(a.history, now)
+	pruneEvents(a.joins, now)
+}
+
+// record adds an event to a key and returns the events of the key that are
+// within the last seconds.
+func record(events map[string][]event, key, content string, seconds int, now time.Time) []event {
+	window := time.Duration(seconds) * time.Second
+	kept := []event{}
+	for _, e := range events[key] {
+		if e.time.After(now.Add(-window)) {
+			kept = append(kept, e)
+		}
+	}
+	kept = append(kept, event{content: content, time: now, expires: now.Add(window)})
+	events[key] = kept
+	return kept
+}
+
+// isSpam records the message and reports whether the author has sent more
+// than rule.Limit identical messages within rule.Seconds.
+func (a *AutoMod) isSpam(key, content string, rule *Rule, now time.Time) bool {
+	a.historyMu.Lock()
+	defer a.historyMu.Unlock()
+
+	a.prune(now)
+	events := record(a.history, key, content, rule.Seconds, now)
+
+	var count int
+	for _, e := range events {
+		if strings.EqualFold(e.content, content) {
+			count++
+		}
+	}
+	return count > rule.Limit
+}
+
+func capsPercent(content string) int {
+	var letters, upper int
+	for _, c := range content {
+		if unicode.IsLetter(c) {
+			letters++
+			if unicode.IsUpper(c) {
+				upper++
+			}
+		}
+	}
+	// Short messages like "OK" or "LOL" are fine
+	if letters < 8 {
+		return 0
+	}
+	return upper * 100 / letters
+}
+
+func emojiCount(content string) int {
+	count := len(emojiRegex.FindAllString(content, -1))
+	for _, c := range emojiRegex.ReplaceAllString(content, "") {
+		if unicode.Is(unicode.So, c) {
+			count++
+		}
+	}
+	return count
+}
+
+// check returns the first broken rule and a description of why it was broken.
+func (a *AutoMod) check(srv *Server, m *discordgo.MessageCreate) (string, *Rule, string) {
+	rules := srv.Rules
+	if rule := rules[RuleSpam]; rule != nil && rule.Enabled {
+		if a.isSpam(m.GuildID+m.Author.ID, m.Content, rule, time.Now()) {
+			return RuleSpam, rule, "repeated messages"
+		}
+	}
+	if rule := rules[RuleMentions]; rule != nil && rule.Enabled {
+		mentions := len(m.Mentions) + len(m.MentionRoles)
+		if m.MentionEveryone {
+			mentions++
+		}
+		if mentions > rule.Limit {
+			return RuleMentions, rule, fmt.Sprintf("%d mentions", mentions)
+		}
+	}
+	if rule := rules[RuleInvites]; rule != nil && rule.Enabled {
+		if invite := inviteRegex.FindString(m.Content); invite != "" {
+			return RuleInvites, rule, "invite link " + invite
+		}
+	}
+	if rule := rules[RuleWords]; rule != nil && rule.Enabled {
+		for _, re := range srv.words {
+			if word := re.FindString(m.Content); word != "" {
+				return RuleWords, rule, "blocked word " + word
+			}
+		}
+	}
+	if rule := rules[RuleCaps]; rule != nil && rule.Enabled {
+		if percent := capsPercent(m.Content); percent > rule.Limit {
+			return RuleCaps, rule, fmt.Sprintf("%d%% caps", percent)
+		}
+	}
+	if rule := rules[RuleEmoji]; rule != nil && rule.Enabled {
+		if count := emojiCount(m.Content); count > rule.Limit {
+			return RuleEmoji, rule, fmt.Sprintf("%d emojis", count)
+		}
+	}
+	return "", nil, ""
+}
+
+func (a *AutoMod) punish(s *discordgo.Session, logCh, guildID, userID, action string, minutes int, reason string) {
+	switch action {
+	case ActionWarn:
+		if a.warns == nil {
+			return
+		}
+		if _, _, _, err := a.warns.Warn(s, guildID, userID, s.State.User.ID, "AutoMod: "+reason); err != nil {
+			fmt.Println(err)
+		}
+	case ActionTimeout:
+		until := time.Now().Add(time.Duration(minutes) * time.Minute)
+		if err := s.GuildMemberTimeout(guildID, userID, &until); err != nil {
+			fmt.Println(err)
+			a.log(s, logCh, "Failed to time out <@"+userID+">: "+err.Error())
+		}
+	}
+}
+
+// isMod reports whether a user can moderate the channel, mods are never
+// caught by automod.
+func isMod(s *discordgo.Session, userID, channelID string) bool {
+	perms, err := s.State.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		return false
+	}
+	return perms&(discordgo.PermissionAdministrator|discordgo.PermissionManageMessages) != 0
+}
+
+// OnMessageCreate runs every guild message through the server's rules.
+func (a *AutoMod) OnMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.GuildID == "" || m.Author == nil || m.Author.Bot {
+		return
+	}
+	if isMod(s, m.Author.ID, m.ChannelID) {
+		return
+	}
+
+	var roles []string
+	if m.Member != nil {
+		roles = m.Member.Roles
+	}
+
+	a.RLock()
+	srv := a.getServer(m.GuildID, false)
+	if srv == nil || srv.exempt(m.ChannelID, roles) {
+		a.RUnlock()
+		return
+	}
+	name, rule, reason := a.check(srv, m)
+	var action string
+	var minutes int
+	if rule != nil {
+		action, minutes = rule.Action, rule.Minutes
+	}
+	logCh := a.logChannelOf(srv)
+	a.RUnlock()
+
+	if rule == nil {
+		return
+	}
+	logCh = logChannelIn(s, logCh, m.GuildID)
+
+	// Every action removes the offending message
+	if err := s.ChannelMessageDelete(m.ChannelID, m.ID); err != nil {
+		fmt.Println(err)
+	}
+	a.punish(s, logCh, m.GuildID, m.Author.ID, action, minutes, reason)
+	a.log(s, logCh, fmt.Sprintf("**AutoMod** `%s` -- %s by <@%s> in <#%s> (%s)", name, action, m.Author.ID, m.ChannelID, reason))
+}
+
+// OnMemberAdd watches for bursts of new accounts joining.
+func (a *AutoMod) OnMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	if m.User == nil || m.User.Bot {
+		return
+	}
+
+	a.RLock()
+	srv := a.getServer(m.GuildID, false)
+	var rule Rule
+	if srv != nil && srv.Rules[RuleRaid] != nil {
+		rule = *srv.Rules[RuleRaid]
+	}
+	logCh := a.logChannelOf(srv)
+	a.RUnlock()
+
+	if !rule.Enabled {
+		return
+	}
+	logCh = logChannelIn(s, logCh, m.GuildID)
+
+	created, err := discordgo.SnowflakeTimestamp(m.User.ID)
+	now := time.Now()
+	if err != nil || now.Sub(created) > time.Duration(rule.Days)*24*time.Hour {
+		return
+	}
+
+	a.historyMu.Lock()
+	a.prune(now)
+	joins := record(a.joins, m.GuildID, m.User.ID, rule.Seconds, now)
+	a.historyMu.Unlock()
+
+	if len(joins) <= rule.Limit {
+		return
+	}
+
+	if len(joins) == rule.Limit+1 {
+		// Catch up on everyone that joined as part of the raid
+		a.log(s, logCh, fmt.Sprintf("**AutoMod** `raid` -- %d new accounts joined within %d seconds", len(joins), rule.Seconds))
+		for _, e := range joins[:len(joins)-1] {
+			a.punish(s, logCh, m.GuildID, e.content, rule.Action, rule.Minutes, "join raid")
+		}
+	}
+	a.punish(s, logCh, m.GuildID, m.User.ID, rule.Action, rule.Minutes, "join raid")
+	a.log(s, logCh, fmt.Sprintf("**AutoMod** `raid` -- %s <@%s>", rule.Action, m.User.ID))
+}
+
+func validRule(name string) bool {
+	for _, rule := range ruleNames {
+		if rule == name {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, s string) []string {
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (a *AutoMod) showConfig(m *dgofw.DiscordMessage) {
+	a.RLock()
+	defer a.RUnlock()
+	srv := a.getServer(m.GuildID(), false)
+	if srv == nil {
+		m.Reply("AutoMod isn't set up for this server.")
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, name := range ruleNames {
+		rule := srv.Rules[name]
+		if rule == nil {
+			continue
+		}
+		state := "off"
+		if rule.Enabled {
+			state = "on"
+		}
+		buf.WriteString(fmt.Sprintf("`%s` **%s** -- %s, limit %d", name, state, rule.Action, rule.Limit))
+		if name == RuleSpam || name == RuleRaid {
+			buf.WriteString(fmt.Sprintf(" in %ds", rule.Seconds))
+		}
+		if rule.Action == ActionTimeout {
+			buf.WriteString(fmt.Sprintf(", %d minutes", rule.Minutes))
+		}
+		buf.WriteString("\n")
+	}
+	if len(srv.BlockedWords) > 0 {
+		buf.WriteString("Blocked words: `" + strings.Join(srv.BlockedWords, "`, `") + "`\n")
+	}
+	for _, id := range srv.ExemptRoles {
+		buf.WriteString("Exempt role: <@&" + id + ">\n")
+	}
+	for _, id := range srv.ExemptChannels {
+		buf.WriteString("Exempt channel: <#" + id + ">\n")
+	}
+	if srv.LogChannel != "" {
+		buf.WriteString("Logging to <#" + srv.LogChannel + ">\n")
+	}
+	m.Reply(buf.String())
+}
+
+func (a *AutoMod) OnMessage(m *dgofw.DiscordMessage) {
+	if !m.IsMod() {
+		return
+	}
+
+	arg1, arg2, arg3, arg4 := m.Arg("arg1"), m.Arg("arg2"), m.Arg("arg3"), m.Arg("arg4")
+	switch arg1 {
+	case "enable", "disable":
+		if !validRule(arg2) {
+			m.Reply("Unknown rule, use one of " + strings.Join(ruleNames, ", "))
+			return
+		}
+		a.Lock()
+		srv := a.getServer(m.GuildID(), true)
+		if srv.Rules[arg2] == nil {
+			srv.Rules[arg2] = defaultRules()[arg2]
+		}
+		srv.Rules[arg2].Enabled = arg1 == "enable"
+		a.Unlock()
+		a.Save()
+		m.Reply("Rule `" + arg2 + "` " + arg1 + "d")
+	case "action":
+		if !validRule(arg2) {
+			m.Reply("Unknown rule, use one of " + strings.Join(ruleNames, ", "))
+			return
+		}
+		if arg3 != ActionDelete && arg3 != ActionWarn && arg3 != ActionTimeout {
+			m.Reply("Unknown action, use delete, warn or timeout")
+			return
+		}
+		if arg2 == RuleRaid && arg3 == ActionDelete {
+			m.Reply("There's no message to delete on join, use warn or timeout")
+			return
+		}
+		minutes, _ := strconv.Atoi(arg4)
+		if arg3 == ActionTimeout && minutes <= 0 {
+			m.Reply("Timeouts need a duration in minutes")
+			return
+		}
+		a.Lock()
+		srv := a.getServer(m.GuildID(), true)
+		if srv.Rules[arg2] == nil {
+			srv.Rules[arg2] = defaultRules()[arg2]
+		}
+		srv.Rules[arg2].Action = arg3
+		if minutes > 0 {
+			srv.Rules[arg2].Minutes = minutes
+		}
+		a.Unlock()
+		a.Save()
+		m.Reply("Rule `" + arg2 + "` now uses " + arg3)
+	case "limit":
+		if !validRule(arg2) {
+			m.Reply("Unknown rule, use one of " + strings.Join(ruleNames, ", "))
+			return
+		}
+		limit, err := strconv.Atoi(arg3)
+		if err != nil || limit < 0 {
+			m.Reply("Invalid limit")
+			return
+		}
+		seconds, _ := strconv.Atoi(arg4)
+		a.Lock()
+		srv := a.getServer(m.GuildID(), true)
+		if srv.Rules[arg2] == nil {
+			srv.Rules[arg2] = defaultRules()[arg2]
+		}
+		srv.Rules[arg2].Limit = limit
+		if seconds > 0 {
+			srv.Rules[arg2].Seconds = seconds
+		}
+		a.Unlock()
+		a.Save()
+		m.Reply("Updated the limit of `" + arg2 + "`")
+	case "age":
+		days, err := strconv.Atoi(arg2)
+		if err != nil || days <= 0 {
+			m.Reply("Invalid number of days")
+			return
+		}
+		a.Lock()
+		srv := a.getServer(m.GuildID(), true)
+		if srv.Rules[RuleRaid] == nil {
+			srv.Rules[RuleRaid] = defaultRules()[RuleRaid]
+		}
+		srv.Rules[RuleRaid].Days = days
+		a.Unlock()
+		a.Save()
+		m.Reply(fmt.Sprintf("Accounts younger than %d days now count towards raids", days))
+	case "word":
+		word := strings.TrimSpace(arg3 + " " + arg4)
+		if word == "" {
+			return
+		}
+		switch arg2 {
+		case "add":
+			if _, err := regexp.Compile(word); err != nil {
+				m.Reply("Invalid regex: " + err.Error())
+				return
+			}
+			a.Lock()
+			srv := a.getServer(m.GuildID(), true)
+			srv.BlockedWords = append(remove(srv.BlockedWords, word), word)
+			srv.compileWords()
+			a.Unlock()
+			a.Save()
+			m.Reply("Blocked `" + word + "`")
+		case "remove":
+			a.Lock()
+			srv := a.getServer(m.GuildID(), true)
+			srv.BlockedWords = remove(srv.BlockedWords, word)
+			srv.compileWords()
+			a.Unlock()
+			a.Save()
+			m.Reply("Unblocked `" + word + "`")
+		}
+	case "exempt", "unexempt":
+		id := discordutil.ParseID(arg2)
+		if id == "" {
+			m.Reply("Invalid role or channel")
+			return
+		}
+		a.Lock()
+		srv := a.getServer(m.GuildID(), true)
+		if strings.HasPrefix(arg2, "<#") {
+			srv.ExemptChannels = remove(srv.ExemptChannels, id)
+			if arg1 == "exempt" {
+				srv.ExemptChannels = append(srv.ExemptChannels, id)
+			}
+		} else {
+			srv.ExemptRoles = remove(srv.ExemptRoles, id)
+			if arg1 == "exempt" {
+				srv.ExemptRoles = append(srv.ExemptRoles, id)
+			}
+		}
+		a.Unlock()
+		a.Save()
+		m.Reply("Updated exemptions")
+	case "log":
+		id := discordutil.ParseID(arg2)
+		if id != "" && !discordutil.ChannelInGuild(m.Session(), id, m.GuildID()) {
+			m.Reply("That channel isn't in this server.")
+			return
+		}
+		a.Lock()
+		a.getServer(m.GuildID(), true).LogChannel = id
+		a.Unlock()
+		a.Save()
+		if id == "" {
+			m.Reply("Logging to the default log channel")
+		} else {
+			m.Reply("Logging to <#" + id + ">")
+		}
+	default:
+		a.showConfig(m)
+	}
+}
+
+func (a *AutoMod) Save() (err error) {
+	a.RLock()
+	defer a.RUnlock()
+	var f *os.File
+	if f, err = os.Create("./automodstate.json"); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(a)
+	}
+	return
+}
+
+func (a *AutoMod) Load() (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile("./automodstate.json"); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, a); err != nil {
+		return
+	}
+	for _, s := range a.Servers {
+		if s.Rules == nil {
+			s.Rules = defaultRules()
+		}
+		s.compileWords()
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package discordutil
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// attachmentHosts are the hosts attachments are downloaded from, Discord's
+// own CDN.
+var attachmentHosts = map[string]bool{
+	"cdn.discordapp.com":   true,
+	"media.discordapp.net": true,
+}
+
+// attachmentClient gives up on slow downloads, so a command handler never
+// hangs on one, and doesn't follow redirects away from the CDN.
+var attachmentClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if !isAttachment(req.URL) {
+			return errors.New("redirected away from Discord")
+		}
+		return nil
+	},
+}
+
+func isAttachment(u *url.URL) bool {
+	return u.Scheme == "https" && attachmentHosts[u.Hostname()]
+}
+
+// IsAttachment reports whether link is an https link to Discord's CDN.
+func IsAttachment(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && isAttachment(u)
+}
+
+// GetAttachment downloads a Discord attachment. Links anywhere else are
+// refused, as are responses other than 200 OK. The body has to be read
+// within the client's timeout.
+func GetAttachment(link string) (*http.Response, error) {
+	if !IsAttachment(link) {
+		return nil, errors.New("that isn't a Discord attachment")
+	}
+	res, err := attachmentClient.Get(link)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("couldn't download the file: %s", res.Status)
+	}
+	return res, nil
+}
@@ -0,0 +1,100 @@
+// Package discordutil has the small Discord helpers that several plugins
+// need, so they all check things the same way.
+package discordutil
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	idRegex     = regexp.MustCompile(`^<(@&|#)?([0-9]+)>$|^([0-9]+)$`)
+	userIDRegex = regexp.MustCompile(`^<@!?([0-9]+)>$|^([0-9]+)$`)
+)
+
+// ParseID returns the ID of a role or channel mention, or of a raw ID. It
+// returns an empty string for anything else.
+func ParseID(s string) string {
+	match := idRegex.FindStringSubmatch(s)
+	if match == nil {
+		return ""
+	}
+	if match[2] != "" {
+		return match[2]
+	}
+	return match[3]
+}
+
+// ParseUserID returns the ID of a user mention or a raw ID. It returns an
+// empty string for anything else.
+func ParseUserID(s string) string {
+	match := userIDRegex.FindStringSubmatch(s)
+	if match == nil {
+		return ""
+	}
+	if match[1] != "" {
+		return match[1]
+	}
+	return match[2]
+}
+
+// ChannelInGuild reports whether a channel belongs to a guild. Channels that
+// aren't cached are looked up through the API.
+func ChannelInGuild(s *discordgo.Session, channelID, guildID string) bool {
+	ch, err := s.State.Channel(channelID)
+	if err != nil {
+		if ch, err = s.Channel(channelID); err != nil {
+			return false
+		}
+	}
+	return ch.GuildID == guildID
+}
+
+// ElevatedPermissions are the permissions a role handed out by the bot must
+// not have.
+const ElevatedPermissions = discordgo.PermissionAdministrator |
+	discordgo.PermissionManageGuild |
+	discordgo.PermissionManageRoles |
+	discordgo.PermissionManageChannels |
+	discordgo.PermissionManageMessages |
+	discordgo.PermissionManageWebhooks |
+	discordgo.PermissionKickMembers |
+	discordgo.PermissionBanMembers |
+	discordgo.PermissionModerateMembers |
+	discordgo.PermissionMentionEveryone
+
+// CheckAssignable returns why the bot shouldn't hand out a role, or "" if
+// it can. Roles at or above the bot's highest role can't be given by it, and
+// roles with moderation permissions would let anyone become a mod.
+func CheckAssignable(s *discordgo.Session, guildID string, role *discordgo.Role) string {
+	if role.Managed || role.ID == guildID {
+		return "**" + role.Name + "** can't be assigned."
+	}
+	if role.Permissions&ElevatedPermissions != 0 {
+		return "**" + role.Name + "** has moderation permissions and can't be handed out."
+	}
+	roles, err := s.GuildRoles(guildID)
+	if err != nil {
+		fmt.Println(err)
+		return "Something happened..."
+	}
+	mem, err := s.GuildMember(guildID, s.State.User.ID)
+	if err != nil {
+		fmt.Println(err)
+		return "Something happened..."
+	}
+	var highest int
+	for _, r := range roles {
+		for _, id := range mem.Roles {
+			if id == r.ID && r.Position > highest {
+				highest = r.Position
+			}
+		}
+	}
+	if role.Position >= highest {
+		return "**" + role.Name + "** is at or above my highest role."
+	}
+	return ""
+}
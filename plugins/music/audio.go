@@ -0,0 +1,152 @@
+package music
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Krognol/dgofw"
+)
+
+// options returns how the connection plays a track from pos.
+func (mp *MusicPlayer) options(vc *Connection, pos time.Duration) PlayOptions {
+	vc.Lock()
+	filters := vc.Filters
+	vc.Unlock()
+	return PlayOptions{
+		Filters: filters,
+		Start:   pos,
+		Volume:  mp.settings.get(vc.Guild).Volume,
+	}
+}
+
+// parsePosition parses a time in a track like 83, 1:23 or 1:01:23.
+func parsePosition(s string) (time.Duration, error) {
+	var d time.Duration
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid time %s", s)
+		}
+		d = d*60 + time.Duration(n)*time.Second
+	}
+	return d, nil
+}
+
+// onAudioCommand changes how the current track sounds. Changes apply to the
+// playing track right away by opening it again where it is.
+func (mp *MusicPlayer) onAudioCommand(m *dgofw.DiscordMessage, cmd string, args []string) {
+	vc, ok := mp.connection(m.GuildID())
+	if !ok {
+		m.Reply("I'm not in a voice channel")
+		return
+	}
+
+	switch cmd {
+	case "volume":
+		if len(args) == 0 {
+			m.Reply(fmt.Sprintf("Volume is %d%%", mp.settings.get(m.GuildID()).Volume))
+			return
+		}
+		if !mp.canControl(m) {
+			return
+		}
+		vol, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+		if err != nil || vol < 0 || vol > 200 {
+			m.Reply("Volume goes from 0 to 200")
+			return
+		}
+		mp.settings.update(m.GuildID(), func(gs *GuildSettings) {
+			gs.Volume = vol
+		})
+		m.Reply(fmt.Sprintf("Volume set to %d%%", vol))
+	case "seek":
+		if len(args) != 1 {
+			return
+		}
+		pos, err := parsePosition(args[0])
+		if err != nil {
+			m.Reply("Give a time like 1:23")
+			return
+		}
+		vc.Lock()
+		track := vc.current
+		if track != nil {
+			if track.Duration > 0 && pos >= time.Duration(track.Duration)*time.Second {
+				vc.Unlock()
+				m.Reply("The track isn't that long.")
+				return
+			}
+			vc.seek, vc.seeking = pos, true
+		}
+		vc.Unlock()
+		if track == nil {
+			m.Reply("Nothing is playing.")
+			return
+		}
+		if !vc.send(command{msg: Restart, track: track}) {
+			vc.Lock()
+			if vc.current == track {
+				vc.seeking = false
+			}
+			vc.Unlock()
+			m.Reply("The player is busy, try again.")
+			return
+		}
+		m.Reply("Jumping to " + args[0])
+		return
+	case "filter", "filters":
+		if len(args) == 0 {
+			vc.Lock()
+			filters := vc.Filters
+			vc.Unlock()
+			m.Reply("Filters: " + filters.String())
+			return
+		}
+
+		vc.Lock()
+		f := &vc.Filters
+		switch strings.ToLower(args[0]) {
+		case "bassboost", "bass":
+			f.BassBoost = !f.BassBoost
+		case "nightcore":
+			f.Nightcore = !f.Nightcore
+		case "normalize":
+			f.Normalize = !f.Normalize
+		case "speed":
+			speed := 1.0
+			if len(args) > 1 {
+				speed, _ = strconv.ParseFloat(strings.TrimSuffix(args[1], "x"), 64)
+			}
+			if speed < 0.5 || speed > 2 {
+				vc.Unlock()
+				m.Reply("Speed goes from 0.5 to 2")
+				return
+			}
+			f.Speed = speed
+		case "off", "none":
+			*f = Filters{}
+		default:
+			vc.Unlock()
+			m.Reply("Filters are bassboost, nightcore, normalize and speed")
+			return
+		}
+		filters := *f
+		vc.Unlock()
+		m.Reply("Filters: " + filters.String())
+	default:
+		return
+	}
+
+	vc.Lock()
+	playing := vc.current != nil
+	vc.Unlock()
+	if playing {
+		mp.control(m.GuildID(), "restart")
+	}
+}
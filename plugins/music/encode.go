@@ -0,0 +1,289 @@
+package music
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encoder turns audio in any format ffmpeg understands into Opus frames.
+type Encoder interface {
+	// Encode reads audio from in, which is closed with the stream.
+	Encode(in io.ReadCloser, opts PlayOptions) (Stream, error)
+}
+
+// Filters change how a track sounds.
+type Filters struct {
+	BassBoost bool `json:"bass_boost"`
+	// Nightcore speeds the track up and raises its pitch
+	Nightcore bool `json:"nightcore"`
+	// Normalize evens out the loudness
+	Normalize bool `json:"normalize"`
+	// Speed changes the tempo without changing the pitch, 0 is normal
+	Speed float64 `json:"speed"`
+}
+
+// PlayOptions are how a track is played.
+type PlayOptions struct {
+	Filters
+	// Start is where in the track to start
+	Start time.Duration
+	// Volume in percent, 100 is unchanged
+	Volume int
+}
+
+// Rate is how much faster than normal the track plays.
+func (o PlayOptions) Rate() float64 {
+	rate := 1.0
+	if o.Nightcore {
+		rate *= 1.25
+	}
+	if o.Speed > 0 {
+		rate *= o.Speed
+	}
+	return rate
+}
+
+// audioFilter returns the ffmpeg filter graph of the options.
+func (o PlayOptions) audioFilter() string {
+	var filters []string
+	if o.Volume != 100 {
+		filters = append(filters, fmt.Sprintf("volume=%.2f", float64(o.Volume)/100))
+	}
+	if o.BassBoost {
+		filters = append(filters, "bass=g=10")
+	}
+	if o.Nightcore {
+		filters = append(filters, "aresample=48000", "asetrate=60000", "aresample=48000")
+	}
+	if o.Speed > 0 && o.Speed != 1 {
+		filters = append(filters, fmt.Sprintf("atempo=%.2f", o.Speed))
+	}
+	if o.Normalize {
+		filters = append(filters, "loudnorm")
+	}
+	return strings.Join(filters, ",")
+}
+
+func (f Filters) String() string {
+	var on []string
+	if f.BassBoost {
+		on = append(on, "bass boost")
+	}
+	if f.Nightcore {
+		on = append(on, "nightcore")
+	}
+	if f.Speed > 0 && f.Speed != 1 {
+		on = append(on, fmt.Sprintf("speed %.2fx", f.Speed))
+	}
+	if f.Normalize {
+		on = append(on, "normalize")
+	}
+	if len(on) == 0 {
+		return "none"
+	}
+	return strings.Join(on, ", ")
+}
+
+// FFmpegEncoder has ffmpeg encode Opus into an Ogg container and reads the
+// frames out of the Ogg pages itself, so no other helper is needed.
+type FFmpegEncoder struct {
+	Path string
+}
+
+func (e *FFmpegEncoder) Encode(in io.ReadCloser, opts PlayOptions) (Stream, error) {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if opts.Start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(opts.Start.Seconds(), 'f', 2, 64))
+	}
+	args = append(args, "-i", "pipe:0")
+	if af := opts.audioFilter(); af != "" {
+		args = append(args, "-af", af)
+	}
+	args = append(args,
+		"-vn", "-ar", "48000", "-ac", "2",
+		"-c:a", "libopus", "-b:a", "96k", "-frame_duration", "20", "-application", "audio",
+		"-f", "ogg", "pipe:1")
+	cmd := exec.Command(orDefault(e.Path, "ffmpeg"), args...)
+	p, err := startProcess(cmd, in)
+	if err != nil {
+		return nil, err
+	}
+	p.next = newOggReader(p.out).ReadPacket
+	return p, nil
+}
+
+// DCAEncoder uses the dca tool, which writes each frame prefixed with its
+// length as a little endian int16. dca can't filter, so only the volume and
+// start of the options are used. A volume of 100 is dca's -vol 128.
+type DCAEncoder struct {
+	Path string
+}
+
+func (e *DCAEncoder) Encode(in io.ReadCloser, opts PlayOptions) (Stream, error) {
+	vol := strconv.Itoa(opts.Volume * 128 / 100)
+	cmd := exec.Command(orDefault(e.Path, "./dca"), "-raw", "-vol", vol, "-i", "pipe:0")
+	p, err := startProcess(cmd, in)
+	if err != nil {
+		return nil, err
+	}
+	p.next = func() ([]byte, error) {
+		var opusLen int16
+		if err := binary.Read(p.out, binary.LittleEndian, &opusLen); err != nil {
+			return nil, eof(err)
+		}
+		opus := make([]byte, opusLen)
+		if _, err := io.ReadFull(p.out, opus); err != nil {
+			return nil, eof(err)
+		}
+		return opus, nil
+	}
+
+	// Seek by throwing away the frames before the start
+	for skip := int(opts.Start / frameLength); skip > 0; skip-- {
+		if _, err := p.next(); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// frameLength is how much audio an Opus frame holds.
+const frameLength = 20 * time.Millisecond
+
+func eof(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+// process is a Stream read from the output of a command. Closing it kills
+// the command and closes its input.
+type process struct {
+	cmd  *exec.Cmd
+	in   io.ReadCloser
+	out  *bufio.Reader
+	next func() ([]byte, error)
+
+	once sync.Once
+}
+
+func startProcess(cmd *exec.Cmd, in io.ReadCloser) (*process, error) {
+	cmd.Stdin = in
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		in.Close()
+		return nil, err
+	}
+	return &process{cmd: cmd, in: in, out: bufio.NewReaderSize(out, 16384)}, nil
+}
+
+func (p *process) ReadFrame() ([]byte, error) {
+	return p.next()
+}
+
+func (p *process) Close() error {
+	p.once.Do(func() {
+		p.cmd.Process.Kill()
+		p.in.Close()
+		go p.cmd.Wait()
+	})
+	return nil
+}
+
+// cmdReader is the output of a command, closing it kills the command.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func startReader(cmd *exec.Cmd) (*cmdReader, error) {
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{out, cmd}, nil
+}
+
+func (r *cmdReader) Close() error {
+	r.cmd.Process.Kill()
+	go r.cmd.Wait()
+	return nil
+}
+
+var errOgg = errors.New("invalid ogg stream")
+
+// oggReader reads packets from an Ogg stream, skipping the Opus headers
+// unless raw is set.
+type oggReader struct {
+	r       *bufio.Reader
+	raw     bool
+	packets [][]byte
+	partial []byte
+}
+
+func newOggReader(r *bufio.Reader) *oggReader {
+	return &oggReader{r: r}
+}
+
+func (o *oggReader) ReadPacket() ([]byte, error) {
+	for len(o.packets) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+	return packet, nil
+}
+
+// readPage reads a page and queues the packets that end in it.
+func (o *oggReader) readPage() error {
+	var header [27]byte
+	if _, err := io.ReadFull(o.r, header[:]); err != nil {
+		return eof(err)
+	}
+	if string(header[:4]) != "OggS" {
+		return errOgg
+	}
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, segments); err != nil {
+		return eof(err)
+	}
+
+	for _, size := range segments {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(o.r, data); err != nil {
+			return eof(err)
+		}
+		o.partial = append(o.partial, data...)
+		// A segment shorter than 255 bytes ends the packet
+		if size < 255 {
+			packet := o.partial
+			o.partial = nil
+			isHeader := bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags"))
+			if isHeader && !o.raw {
+				continue
+			}
+			o.packets = append(o.packets, packet)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package music
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Krognol/dgofw"
+)
+
+// LibraryEntry is a file in the library. Path is relative to the library
+// directory and uses forward slashes.
+type LibraryEntry struct {
+	Path     string
+	Title    string
+	Artist   string
+	Album    string
+	Track    int
+	Duration int
+}
+
+// Library is an index of the music files in a directory.
+type Library struct {
+	sync.RWMutex
+	Dir     string
+	entries []*LibraryEntry
+	byPath  map[string]*LibraryEntry
+	indexed time.Time
+}
+
+var libraryExtensions = map[string]bool{".mp3": true, ".flac": true, ".ogg": true, ".opus": true}
+
+func NewLibrary(dir string) *Library {
+	return &Library{Dir: dir, byPath: make(map[string]*LibraryEntry)}
+}
+
+// Index walks the directory and reads the tags of every music file.
+func (l *Library) Index() error {
+	var entries []*LibraryEntry
+	err := filepath.Walk(l.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !libraryExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Dir, path)
+		if err != nil {
+			return nil
+		}
+
+		md, err := readMetadata(path)
+		if err != nil {
+			fmt.Println(path, err)
+		}
+		entry := &LibraryEntry{
+			Path:     filepath.ToSlash(rel),
+			Title:    md.Title,
+			Artist:   md.Artist,
+			Album:    md.Album,
+			Track:    md.Track,
+			Duration: md.Duration,
+		}
+		if entry.Title == "" {
+			entry.Title = trimExt(info.Name())
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Artist != b.Artist {
+			return strings.ToLower(a.Artist) < strings.ToLower(b.Artist)
+		}
+		if a.Album != b.Album {
+			return strings.ToLower(a.Album) < strings.ToLower(b.Album)
+		}
+		if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return a.Path < b.Path
+	})
+	byPath := make(map[string]*LibraryEntry, len(entries))
+	for _, e := range entries {
+		byPath[e.Path] = e
+	}
+
+	l.Lock()
+	l.entries = entries
+	l.byPath = byPath
+	l.indexed = time.Now()
+	l.Unlock()
+	return nil
+}
+
+// Get returns the entry of a file, if it's indexed.
+func (l *Library) Get(path string) *LibraryEntry {
+	l.RLock()
+	defer l.RUnlock()
+	return l.byPath[path]
+}
+
+// Search finds entries matching every word of the query. Words can be
+// limited to a field with artist:, album: or title:, and quotes keep
+// words together, e.g. artist:"iron maiden" trooper.
+func (l *Library) Search(query string) []*LibraryEntry {
+	terms := splitQuery(strings.ToLower(query))
+
+	l.RLock()
+	defer l.RUnlock()
+	var result []*LibraryEntry
+	for _, e := range l.entries {
+		if e.matches(terms) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Stats returns how many tracks, artists and albums are indexed, and when.
+func (l *Library) Stats() (tracks, artists, albums int, indexed time.Time) {
+	l.RLock()
+	defer l.RUnlock()
+	a, b := make(map[string]bool), make(map[string]bool)
+	for _, e := range l.entries {
+		a[strings.ToLower(e.Artist)] = true
+		b[strings.ToLower(e.Artist+"\x00"+e.Album)] = true
+	}
+	return len(l.entries), len(a), len(b), l.indexed
+}
+
+type term struct {
+	field, text string
+}
+
+func splitQuery(query string) []term {
+	var terms []term
+	var field string
+	for len(query) > 0 {
+		query = strings.TrimLeft(query, " ")
+		if query == "" {
+			break
+		}
+		for _, f := range []string{"artist:", "album:", "title:"} {
+			if strings.HasPrefix(query, f) {
+				field, query = strings.TrimSuffix(f, ":"), query[len(f):]
+				break
+			}
+		}
+
+		var text string
+		if strings.HasPrefix(query, `"`) {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				text, query = query[1:], ""
+			} else {
+				text, query = query[1:end+1], query[end+2:]
+			}
+		} else if i := strings.IndexByte(query, ' '); i >= 0 {
+			text, query = query[:i], query[i:]
+		} else {
+			text, query = query, ""
+		}
+		if text != "" {
+			terms = append(terms, term{field, text})
+		}
+		field = ""
+	}
+	return terms
+}
+
+func (e *LibraryEntry) matches(terms []term) bool {
+	for _, t := range terms {
+		var ok bool
+		switch t.field {
+		case "artist":
+			ok = strings.Contains(strings.ToLower(e.Artist), t.text)
+		case "album":
+			ok = strings.Contains(strings.ToLower(e.Album), t.text)
+		case "title":
+			ok = strings.Contains(strings.ToLower(e.Title), t.text)
+		default:
+			ok = strings.Contains(strings.ToLower(e.Artist+" "+e.Album+" "+e.Title+" "+e.Path), t.text)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// track makes a track of the entry, played by the file source.
+func (e *LibraryEntry) track() *Track {
+	title := e.Title
+	if e.Artist != "" {
+		title = e.Artist + " - " + e.Title
+	}
+	track := newTrack(e.Path, title, "file:"+e.Path, e.Duration, "")
+	track.Description = e.Album
+	track.Source = "file"
+	return track
+}
+
+func (e *LibraryEntry) String() string {
+	var buf strings.Builder
+	if e.Artist != "" {
+		buf.WriteString(e.Artist + " - ")
+	}
+	buf.WriteString("**" + e.Title + "**")
+	if e.Album != "" {
+		buf.WriteString(" (" + e.Album + ")")
+	}
+	return buf.String()
+}
+
+func (mp *MusicPlayer) onLibrary(m *dgofw.DiscordMessage, args string) {
+	if mp.library == nil {
+		m.Reply("There is no music library.")
+		return
+	}
+
+	cmd, query := args, ""
+	if i := strings.IndexByte(args, ' '); i >= 0 {
+		cmd, query = args[:i], strings.TrimSpace(args[i+1:])
+	}
+
+	switch cmd {
+	case "":
+		tracks, artists, albums, indexed := mp.library.Stats()
+		if indexed.IsZero() {
+			m.Reply("The library is still being indexed.")
+			return
+		}
+		m.Reply(fmt.Sprintf("The library has %d tracks by %d artists on %d albums, indexed %s.", tracks, artists, albums, indexed.Format("2006-01-02 15:04")))
+	case "search":
+		if query == "" {
+			return
+		}
+		entries := mp.library.Search(query)
+		if len(entries) == 0 {
+			m.Reply("Nothing found.")
+			return
+		}
+
+		var buf strings.Builder
+		buf.WriteString(fmt.Sprintf("Found %d tracks\n", len(entries)))
+		for i, e := range entries {
+			if i == 10 {
+				buf.WriteString(fmt.Sprintf("And %d more", len(entries)-i))
+				break
+			}
+			buf.WriteString(fmt.Sprintf("%s `file:%s`\n", e, e.Path))
+		}
+		m.Reply(buf.String())
+	case "play":
+		if query == "" {
+			return
+		}
+		vc, ok := mp.connection(m.GuildID())
+		if !ok {
+			m.Reply("I'm not in a voice channel")
+			return
+		}
+		entries := mp.library.Search(query)
+		if len(entries) == 0 {
+			m.Reply("Nothing found.")
+			return
+		}
+		tracks := make(Tracks, len(entries))
+		for i, e := range entries {
+			tracks[i] = e.track()
+		}
+		mp.enqueue(vc, m, tracks)
+	case "rescan":
+		if !m.IsMod() {
+			return
+		}
+		m2 := m.Reply("Indexing the library...")
+		if err := mp.library.Index(); err != nil {
+			fmt.Println(err)
+			m2.Edit("Failed to index the library.")
+			return
+		}
+		tracks, _, _, _ := mp.library.Stats()
+		m2.Edit(fmt.Sprintf("Indexed %d tracks.", tracks))
+	}
+}
@@ -0,0 +1,110 @@
+package music
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var audioExtensions = map[string]bool{
+	".mp3": true, ".ogg": true, ".opus": true, ".flac": true, ".wav": true,
+	".m4a": true, ".aac": true, ".webm": true, ".mka": true,
+}
+
+func isAudioURL(s string) bool {
+	u, err := url.Parse(strings.Trim(s, "<>"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return audioExtensions[strings.ToLower(path.Ext(u.Path))]
+}
+
+func trimExt(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// FileSource plays files from a directory. Queries look like
+// "file:artist/album/track.mp3", relative to the directory. Titles come from
+// the library if the file is indexed.
+type FileSource struct {
+	Dir     string
+	Encoder Encoder
+	Library *Library
+}
+
+// path returns the full path of a file, making sure it is inside Dir.
+func (f *FileSource) path(name string) (string, error) {
+	full := filepath.Join(f.Dir, filepath.FromSlash(path.Clean("/"+name)))
+	rel, err := filepath.Rel(f.Dir, full)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("no such file")
+	}
+	return full, nil
+}
+
+func (f *FileSource) Resolve(query string) (Tracks, error) {
+	name := strings.TrimSpace(strings.TrimPrefix(query, "file:"))
+	full, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(full)
+	if err != nil || info.IsDir() {
+		return nil, fmt.Errorf("no such file")
+	}
+	if f.Library != nil {
+		if e := f.Library.Get(path.Clean(name)); e != nil {
+			return Tracks{e.track()}, nil
+		}
+	}
+	return Tracks{newTrack(name, trimExt(info.Name()), "file:"+name, 0, "")}, nil
+}
+
+func (f *FileSource) Open(track *Track, opts PlayOptions) (Stream, error) {
+	full, err := f.path(strings.TrimPrefix(track.URL, "file:"))
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	return f.Encoder.Encode(file, opts)
+}
+
+// HTTPSource plays links straight to audio files.
+type HTTPSource struct {
+	Encoder Encoder
+}
+
+func (h *HTTPSource) Resolve(query string) (Tracks, error) {
+	link := strings.Trim(query, "<>")
+	res, err := http.Head(link)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couldn't get %s: %s", link, res.Status)
+	}
+
+	u, _ := url.Parse(link)
+	name, _ := url.PathUnescape(path.Base(u.Path))
+	return Tracks{newTrack(link, trimExt(name), link, 0, "")}, nil
+}
+
+func (h *HTTPSource) Open(track *Track, opts PlayOptions) (Stream, error) {
+	res, err := http.Get(track.URL)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("couldn't get %s: %s", track.URL, res.Status)
+	}
+	return h.Encoder.Encode(res.Body, opts)
+}
@@ -0,0 +1,276 @@
+package music
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// metadata is what we read from the tags of a file.
+type metadata struct {
+	Title    string
+	Artist   string
+	Album    string
+	Track    int
+	Duration int
+}
+
+// readMetadata reads the tags of an mp3 (ID3v2 or ID3v1), flac or ogg/opus
+// (Vorbis comments) file. Missing tags are left empty.
+func readMetadata(path string) (metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return metadata{}, err
+	}
+	defer f.Close()
+
+	var md metadata
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		if err = readID3v2(f, &md); err != nil || md.Title == "" {
+			err = readID3v1(f, &md)
+		}
+	case ".flac":
+		err = readFLAC(f, &md)
+	case ".ogg", ".opus":
+		err = readOggComments(f, &md)
+	}
+	return md, err
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+func readID3v2(r io.Reader, md *metadata) error {
+	var header [10]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	if string(header[:3]) != "ID3" {
+		return nil
+	}
+	version := header[3]
+	tag := make([]byte, syncsafe(header[6:]))
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return err
+	}
+	// Skip the extended header
+	if header[5]&0x40 != 0 && len(tag) >= 4 {
+		size := int(binary.BigEndian.Uint32(tag))
+		if version == 4 {
+			size = syncsafe(tag)
+		} else {
+			size += 4
+		}
+		if size > len(tag) {
+			return nil
+		}
+		tag = tag[size:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var size int
+		switch version {
+		case 2:
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 4:
+			size = syncsafe(tag[4:8])
+		default:
+			size = int(binary.BigEndian.Uint32(tag[4:8]))
+		}
+		if size < 0 || headerLen+size > len(tag) {
+			break
+		}
+		data := tag[headerLen : headerLen+size]
+		tag = tag[headerLen+size:]
+
+		switch id {
+		case "TIT2", "TT2":
+			md.Title = id3Text(data)
+		case "TPE1", "TP1":
+			md.Artist = id3Text(data)
+		case "TALB", "TAL":
+			md.Album = id3Text(data)
+		case "TRCK", "TRK":
+			md.Track = trackNumber(id3Text(data))
+		}
+	}
+	return nil
+}
+
+func id3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	enc, data := data[0], data[1:]
+	switch enc {
+	case 1, 2:
+		var order binary.ByteOrder = binary.BigEndian
+		if enc == 1 && len(data) >= 2 {
+			if data[0] == 0xff && data[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			data = data[2:]
+		}
+		u := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			c := order.Uint16(data[i:])
+			if c == 0 {
+				break
+			}
+			u = append(u, c)
+		}
+		return strings.TrimSpace(string(utf16.Decode(u)))
+	case 3:
+		return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+	}
+	return strings.TrimSpace(latin1(bytes.TrimRight(data, "\x00")))
+}
+
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+func trackNumber(s string) int {
+	n, _ := strconv.Atoi(strings.SplitN(strings.TrimSpace(s), "/", 2)[0])
+	return n
+}
+
+func readID3v1(f *os.File, md *metadata) error {
+	var tag [128]byte
+	info, err := f.Stat()
+	if err != nil || info.Size() < 128 {
+		return err
+	}
+	if _, err = f.ReadAt(tag[:], info.Size()-128); err != nil {
+		return err
+	}
+	if string(tag[:3]) != "TAG" {
+		return nil
+	}
+	field := func(b []byte) string {
+		return strings.TrimSpace(latin1(bytes.TrimRight(b, "\x00 ")))
+	}
+	md.Title = field(tag[3:33])
+	md.Artist = field(tag[33:63])
+	md.Album = field(tag[63:93])
+	if tag[125] == 0 && tag[126] != 0 {
+		md.Track = int(tag[126])
+	}
+	return nil
+}
+
+func readFLAC(r io.Reader, md *metadata) error {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || string(magic[:]) != "fLaC" {
+		return err
+	}
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		last, kind := header[0]&0x80 != 0, header[0]&0x7f
+		block := make([]byte, int(header[1])<<16|int(header[2])<<8|int(header[3]))
+		if _, err := io.ReadFull(r, block); err != nil {
+			return err
+		}
+
+		switch {
+		case kind == 0 && len(block) >= 18:
+			// Sample rate is 20 bits at byte 10, total samples the low 36
+			// bits of bytes 13 to 17
+			rate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+			samples := int64(block[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(block[14:18]))
+			if rate > 0 {
+				md.Duration = int(samples / int64(rate))
+			}
+		case kind == 4:
+			vorbisComments(block, md)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func readOggComments(r io.Reader, md *metadata) error {
+	ogg := newOggReader(bufio.NewReader(r))
+	ogg.raw = true
+	for i := 0; i < 2; i++ {
+		packet, err := ogg.ReadPacket()
+		if err != nil {
+			return err
+		}
+		switch {
+		case bytes.HasPrefix(packet, []byte("OpusTags")):
+			vorbisComments(packet[8:], md)
+			return nil
+		case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+			vorbisComments(packet[7:], md)
+			return nil
+		}
+	}
+	return nil
+}
+
+// vorbisComments reads a Vorbis comment block, used by flac, ogg and opus.
+func vorbisComments(b []byte, md *metadata) {
+	next := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n < 0 || 4+n > len(b) {
+			return "", false
+		}
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+
+	if _, ok := next(); !ok { // vendor
+		return
+	}
+	if len(b) < 4 {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	for i := 0; i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			return
+		}
+		kv := strings.SplitN(comment, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "TITLE":
+			md.Title = kv[1]
+		case "ARTIST":
+			md.Artist = kv[1]
+		case "ALBUM":
+			md.Album = kv[1]
+		case "TRACKNUMBER":
+			md.Track = trackNumber(kv[1])
+		}
+	}
+}
@@ -1,19 +1,14 @@
 package music
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
 	"net/url"
-	"os/exec"
 	"regexp"
-	"runtime"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -38,303 +33,427 @@ type (
 		LenMinutes  int
 		LenSeconds  int
 		Remaining   int
+		// Source is the name of the source that resolved the track
+		Source string `json:"source"`
 	}
 
 	Connection struct {
 		sync.Mutex
 
-		Guild        string
-		Channel      string
+		Guild   string
+		Channel string
+		// TextChannel is where the bot was summoned from
+		TextChannel  string
 		MaxQueueSize int
-		Queue        Tracks
-
-		close   chan struct{}
-		control chan controlMessage
-		status  controlMessage
+		// Queue is the tracks after the current one
+		Queue   Tracks
+		History Tracks
+		Loop    LoopMode
+		// Fair has users take turns, see Tracks.fair
+		Fair    bool
+		Filters Filters
+
+		// ctx is cancelled when the bot leaves, which stops the player
+		ctx     context.Context
+		cancel  context.CancelFunc
+		control chan command
+		// wake is signalled when tracks are added to an idle player
+		wake chan struct{}
 
 		current *Track
-		conn    *dgofw.DiscordVoiceConnection
+		// stopped is set by music stop, the queue doesn't advance until
+		// it's resumed
+		stopped bool
+		// skipVotes are the users who voted to skip the current track
+		skipVotes map[string]bool
+		// seek is where to restart the current track, if seeking
+		seek    time.Duration
+		seeking bool
+		// elapsed is how far into the current track the player is
+		elapsed time.Duration
+		// resuming is a track to start at resumeAt instead of the start,
+		// after a restart
+		resuming *Track
+		resumeAt time.Duration
+		paused   bool
+		// autoPaused is set when the player paused because everyone left
+		autoPaused bool
+		emptyTimer *time.Timer
+		conn       Voice
+		// redialed is closed when conn is replaced, so a player waiting on
+		// the old connection moves on
+		redialed chan struct{}
+		// dialMu keeps two redials from joining at the same time
+		dialMu sync.Mutex
 	}
 
 	MusicPlayer struct {
 		sync.Mutex
 		discord          *dgofw.DiscordClient
+		source           AudioSource
+		library          *Library
+		playlists        *Playlists
+		settings         *Settings
 		VoiceConnections map[string]*Connection
+		// Dial joins a voice channel. Tests can replace it with one
+		// returning a FakeVoice.
+		Dial func(guild, channel string) Voice
+
+		restore  sync.Once
+		restored bool
+		saveMu   sync.Mutex
+		// stop ends the background saves, it's closed by Close
+		stop      chan struct{}
+		closeOnce sync.Once
 	}
 )
 
-func (t Tracks) Len() int {
-	return len(t)
-}
-
-func (t Tracks) Less(i, j int) bool {
-	rand.Seed(time.Now().UnixNano() + int64((i + 2*2)))
-	return rand.Intn(2) == 1
-}
-
-func (t Tracks) Swap(i, j int) {
-	t[i], t[j] = t[j], t[i]
-}
-
 const (
 	Skip controlMessage = iota
 	Pause
 	Play
 	Resume
 	Stop
+	// Restart opens the current track again, to seek or to apply new
+	// options
+	Restart
 )
 
+// command is a control message for the player. If track is set it only
+// applies while that track is playing.
+type command struct {
+	msg   controlMessage
+	track *Track
+}
+
 var MusicHelp = []string{
-	"music join -- Joins a voice channel",
+	"music join -- Joins your voice channel, or moves there if already in one",
 	"music leave -- Leaves a voice channel",
 
-	"music skip -- Skips a track",
+	"music skip -- Votes to skip a track. Skips it right away if you added it or are a DJ.",
+	"music forceskip -- Skips a track without votes. Mod only.",
+	"music stop -- Stops playing until resumed. DJ and mods only.",
 	"music pause -- Pauses a track",
 	"music resume -- Unpauses a track",
-	"music shuffle -- Shuffles the queue.",
-	"music play [song] -- Plays a track. Has to be in a voice channel. Queues it if a track is already playing.",
+	"music shuffle -- Shuffles the queue. The current track keeps playing.",
+	"music fair [on|off] -- Has everyone's tracks take turns in the queue, so one person can't fill it.",
+	"music remove [n] -- Removes track n of the queue. Only mods can remove other people's tracks.",
+	"music move [a] [b] -- Moves track a of the queue to b.",
+	"music skipto [n] -- Skips to track n of the queue. DJ and mods only.",
+	"music loop [off|track|queue] -- Repeats the current track or the whole queue.",
+	"music history -- Shows the tracks played recently.",
+	"music replay -- Plays the current or last track again.",
+	"music volume [0-200] -- Sets the volume of the server in percent. DJ and mods only.",
+	"music seek [1:23] -- Jumps to a time in the current track.",
+	"music filter [bassboost|nightcore|normalize|off] -- Turns a filter on or off, or all of them off.",
+	"music filter speed [0.5-2] -- Plays faster or slower without changing the pitch.",
+	"music set -- Shows the music settings of the server.",
+	"music set skipvotes [fraction] -- Sets how many listeners have to vote to skip, e.g. 50%. Mod only.",
+	"music set dj [role|off] -- Sets the role that can skip and stop without votes. Mod only.",
+	"music set idle [minutes|off] -- Leaves after nothing was played this long. Mod only.",
+	"music set empty [minutes|off] -- Leaves after nobody was listening this long. Mod only.",
+	"music set resume [off|track|position] -- Rejoins and plays the queue after a restart, the current track from the start or from where it was. Mod only.",
+	"music play [song|link] -- Plays a track, a search, a link to a video or an audio file. Has to be in a voice channel. Queues it if a track is already playing.",
+	"music play file:[path] -- Plays a file from the music library.",
+	"music library -- Shows what's in the music library.",
+	"music library search [query] -- Searches the library, e.g. artist:\"iron maiden\" album:powerslave or just words.",
+	"music library play [query] -- Queues every track in the library matching the query.",
+	"music library rescan -- Indexes the library again. Mod only.",
+	"music playlist list -- Lists your playlists and the ones shared in this server.",
+	"music playlist save [name] -- Saves the queue as a playlist.",
+	"music playlist load [name] -- Queues a playlist, yours or a shared one.",
+	"music playlist show [name] -- Shows the tracks of a playlist.",
+	"music playlist delete [name] -- Deletes your playlist. Mods can delete shared ones.",
+	"music playlist share [name] -- Shares your playlist with the server, or stops sharing it.",
+	"music playlist import [name] [link] -- Saves a YouTube playlist, or an attached .m3u or .pls file, as a playlist.",
 }
 
-func NewMusicPlayer(client *dgofw.DiscordClient) *MusicPlayer {
-	return &MusicPlayer{
+func NewMusicPlayer(client *dgofw.DiscordClient, source AudioSource) *MusicPlayer {
+	mp := &MusicPlayer{
 		discord:          client,
+		source:           source,
 		VoiceConnections: make(map[string]*Connection),
+		playlists:        NewPlaylists(),
+		settings:         NewSettings(),
+		stop:             make(chan struct{}),
+	}
+	mp.Dial = func(guild, channel string) Voice {
+		return discordVoice{client.NewVoiceConnection(guild, channel)}
+	}
+	rand.Seed(time.Now().UnixNano())
+	if lib, ok := source.(interface{ Library() *Library }); ok {
+		mp.library = lib.Library()
 	}
+	return mp
 }
 
-func (mp *MusicPlayer) play(vc *Connection, track *Track) {
-	var ytdl *exec.Cmd
-
-	// Had to do this because of where it was hosted
-	if runtime.GOOS == "windows" {
-		ytdl = exec.Command("./youtube-dl", "-v", "-f", "bestaudio", "-o", "-", track.URL)
-	} else if runtime.GOOS == "linux" {
-		ytdl = exec.Command("python3", "youtube-dl", "-v", "-f", "bestaudio", "-o", "-", track.URL)
+func newTrack(id, title, url string, duration int, thumbnail string) *Track {
+	return &Track{
+		ID:         id,
+		Title:      title,
+		FullTitle:  title,
+		URL:        url,
+		Thumbnail:  thumbnail,
+		Duration:   duration,
+		LenMinutes: duration / 60,
+		LenSeconds: duration % 60,
+		Remaining:  duration,
 	}
+}
 
-	ytdlout, err := ytdl.StdoutPipe()
-	if err != nil {
-		fmt.Println("Failed ytdlout\n", err)
-		return
+// newConnection joins a voice channel and starts the player of the
+// connection. The player goroutine is the only one that reads the control
+// channel and streams audio, it runs until the connection's context is
+// cancelled.
+func (mp *MusicPlayer) newConnection(guild, channel, text string) *Connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	vc := &Connection{
+		Guild:        guild,
+		Channel:      channel,
+		TextChannel:  text,
+		MaxQueueSize: 32,
+		Queue:        make([]*Track, 0),
+		ctx:          ctx,
+		cancel:       cancel,
+		control:      make(chan command, 8),
+		wake:         make(chan struct{}, 1),
+		conn:         mp.Dial(guild, channel),
+		redialed:     make(chan struct{}),
 	}
+	go mp.start(vc)
+	return vc
+}
 
-	ytdlbuf := bufio.NewReaderSize(ytdlout, 16384)
-
-	dca := exec.Command("./dca", "-raw", "-vol", "128", "-i", "pipe:0")
-	dca.Stdin = ytdlbuf
-
-	dcaout, err := dca.StdoutPipe()
-	if err != nil {
-		fmt.Println("Failed dcaout\n", err)
-		return
+// send passes a command to the player without blocking. It returns false
+// if the connection is closed, or the player is busy and already has a full
+// backlog of commands, in which case the command is dropped.
+func (vc *Connection) send(c command) bool {
+	select {
+	case <-vc.ctx.Done():
+		return false
+	default:
 	}
-
-	dcabuf := bufio.NewReaderSize(dcaout, 16384)
-
-	err = ytdl.Start()
-	if err != nil {
-		fmt.Println("Failed ytdl.Start\n", err)
-		return
+	select {
+	case vc.control <- c:
+		return true
+	default:
+		return false
 	}
+}
 
-	defer func() {
-		go ytdl.Wait()
-	}()
+// play streams a track until it ends, and returns why it ended.
+func (mp *MusicPlayer) play(vc *Connection, track *Track) trackEnd {
+	var pos time.Duration
+	vc.Lock()
+	if vc.resuming == track {
+		pos, vc.resuming = vc.resumeAt, nil
+	}
+	vc.Unlock()
 
-	err = dca.Start()
-	if err != nil {
-		fmt.Println("Failed dca.Start\n", err)
-		return
+	var rate float64
+	var stream Stream
+	open := func() bool {
+		if stream != nil {
+			stream.Close()
+		}
+		opts := mp.options(vc, pos)
+		var err error
+		if stream, err = mp.source.Open(track, opts); err != nil {
+			fmt.Println("Failed to open", track.URL, err)
+			return false
+		}
+		rate = opts.Rate()
+		return true
+	}
+	if !open() {
+		return endFailed
 	}
+	defer func() { stream.Close() }()
 
+	// The voice connection changes if the bot moves or reconnects
+	var conn Voice
 	defer func() {
-		go dca.Wait()
+		if conn != nil {
+			conn.Speaking(false)
+		}
 	}()
 
-	var opusLen int16
-
-	vc.conn.Speaking(true)
-	defer vc.conn.Speaking(false)
-
-	start := time.Now()
 	for {
 		select {
-		case <-vc.close:
-			fmt.Println("Voice connection closed")
-			return
-		case ctrl := <-vc.control:
-			switch ctrl {
+		case <-vc.ctx.Done():
+			return endClosed
+		case c := <-vc.control:
+			if c.track != nil && c.track != track {
+				// Meant for a track that already ended
+				continue
+			}
+			switch c.msg {
 			case Stop:
-				vc.control <- Pause
-				return
+				return endStopped
 			case Skip:
-				return
+				return endSkipped
 			case Pause:
-				done := false
-				for {
-					ctl, ok := <-vc.control
-					if !ok {
-						return
-					}
-
-					switch ctl {
-					case Skip:
-						return
-					case Resume:
-						done = true
-					}
-					if done {
-						break
-					}
+				end, resumed, restart := mp.paused(vc, track)
+				if !resumed {
+					return end
+				}
+				if !restart {
+					break
+				}
+				fallthrough
+			case Restart:
+				vc.Lock()
+				if vc.seeking {
+					pos, vc.seeking = vc.seek, false
+				}
+				vc.Unlock()
+				if !open() {
+					return endFailed
 				}
 			}
 		default:
 		}
 
-		err = binary.Read(dcabuf, binary.LittleEndian, &opusLen)
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			fmt.Println("dcabuf, &opusLen: EOF")
-			return
+		opus, err := stream.ReadFrame()
+		if err == io.EOF {
+			return endFinished
 		}
 
 		if err != nil {
 			fmt.Println(err)
-			return
+			return endFailed
 		}
 
-		opus := make([]byte, opusLen)
-		err = binary.Read(dcabuf, binary.LittleEndian, &opus)
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			fmt.Println("dcabuf, &opus: EOF")
-			return
+		vc.Lock()
+		if vc.conn != conn {
+			conn = vc.conn
+			conn.Speaking(true)
 		}
-
-		if err != nil {
-			fmt.Println(err)
-			return
+		redialed := vc.redialed
+		vc.Unlock()
+		select {
+		case conn.Frames() <- opus:
+		case <-redialed:
+			// The frame is dropped, the next one goes to the new connection
+		case <-vc.ctx.Done():
+			return endClosed
 		}
+		pos += time.Duration(float64(frameLength) * rate)
+		vc.Lock()
+		track.Remaining = track.Duration - int(pos.Seconds())
+		vc.elapsed = pos
+		vc.Unlock()
+	}
+}
 
-		vc.conn.Send <- opus
-		if vc.current != nil {
-			vc.Lock()
-			vc.current.Remaining = (vc.current.Duration - int(time.Since(start).Seconds()))
-			vc.Unlock()
+// paused waits for a paused track to be resumed. If the track is skipped or
+// stopped instead it returns why. restart tells if the track has to be
+// opened again when it's resumed.
+func (mp *MusicPlayer) paused(vc *Connection, track *Track) (end trackEnd, resumed, restart bool) {
+	for {
+		select {
+		case <-vc.ctx.Done():
+			return endClosed, false, false
+		case c := <-vc.control:
+			if c.track != nil && c.track != track {
+				continue
+			}
+			switch c.msg {
+			case Resume, Play:
+				return endFinished, true, restart
+			case Skip:
+				return endSkipped, false, false
+			case Stop:
+				return endStopped, false, false
+			case Restart:
+				restart = true
+			}
 		}
 	}
 }
 
+// start runs the queue of a connection until the connection is closed. The
+// queue advances each time a track ends, and while there's nothing to play
+// it waits for tracks to be added or for a stopped queue to be resumed. If
+// it waits longer than the server's idle timeout it leaves.
 func (mp *MusicPlayer) start(vc *Connection) {
-	var i int
 	var track *Track
-
+	var end trackEnd
 	for {
-		select {
-		case <-vc.close:
-			return
-		default:
-		}
-
-		if len(vc.Queue) == 0 {
-			<-time.Tick(time.Second)
-			continue
-		}
-
-		vc.Lock()
-		if len(vc.Queue)-1 >= i {
-			track = vc.Queue[i]
-		} else {
-			i = 0
-			vc.Unlock()
+		if track = vc.advance(track, end); track != nil {
+			if end = mp.play(vc, track); end == endClosed {
+				return
+			}
 			continue
 		}
-		vc.Unlock()
-
-		vc.current = track
-		mp.play(vc, track)
-		vc.current = nil
 
-		vc.Lock()
-		if len(vc.Queue) > 0 {
-			vc.Queue = vc.Queue[1:]
+		timeout, stop := mp.idleTimeout(vc)
+		select {
+		case <-vc.ctx.Done():
+			stop()
+			return
+		case c := <-vc.control:
+			if c.msg == Resume || c.msg == Play {
+				vc.Lock()
+				vc.stopped = false
+				vc.Unlock()
+			}
+		case <-vc.wake:
+		case <-timeout:
+			mp.notify(vc, "Left the voice channel, nothing was played for a while.")
+			mp.leave(vc)
+			return
 		}
-		vc.Unlock()
+		stop()
 	}
 }
 
-func (mp *MusicPlayer) gostart(m *dgofw.DiscordMessage) {
-	vc, ok := mp.VoiceConnections[m.GuildID()]
-	vc.Lock()
-	defer vc.Unlock()
-
-	if !ok || vc.close != nil || vc.control != nil {
-		return
-	}
-	vc.close = make(chan struct{}, 1)
-	vc.control = make(chan controlMessage)
-
-	go mp.start(vc)
-}
-
-func (mp *MusicPlayer) queue(link string, m *dgofw.DiscordMessage) (err error) {
-	vc, ok := mp.VoiceConnections[m.GuildID()]
+func (mp *MusicPlayer) queue(query string, m *dgofw.DiscordMessage) (err error) {
+	vc, ok := mp.connection(m.GuildID())
 	if !ok {
 		return fmt.Errorf("Not in a voice channel")
 	}
 
-	if len(vc.Queue) >= vc.MaxQueueSize {
+	vc.Lock()
+	full := len(vc.Queue) >= vc.MaxQueueSize
+	vc.Unlock()
+	if full {
 		m.Reply("Can't queue any more tracks right now")
 		return
 	}
-	var cmd *exec.Cmd
-
-	// Had to do this because of where it was hosted
-	if runtime.GOOS == "linux" {
-		cmd = exec.Command("python3", "youtube-dl", "-i", "-j", "--youtube-skip-dash-manifest", link)
-	} else if runtime.GOOS == "windows" {
-		cmd = exec.Command("./youtube-dl", "-i", "-j", "--youtube-skip-dash-manifest", link)
-	}
-
-	output, err := cmd.StdoutPipe()
-	if err != nil {
-		fmt.Println(err)
-		m.Reply("Failed to add song to playlist")
-		return
-	}
 
-	err = cmd.Start()
+	tracks, err := mp.source.Resolve(query)
 	if err != nil {
 		fmt.Println(err)
 		m.Reply("Failed to add song to playlist")
-		return
+		return nil
 	}
-	defer func() {
-		go cmd.Wait()
-	}()
-
-	scanner := bufio.NewScanner(output)
-
-	s := &Track{}
-	for scanner.Scan() {
-		err = json.Unmarshal(scanner.Bytes(), &s)
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
+	mp.enqueue(vc, m, tracks)
+	return
+}
 
-		if s.URL == "" {
-			s.URL = "https://youtube.com/watch?v=" + s.ID
+// enqueue adds tracks to the queue, as many as fit.
+func (mp *MusicPlayer) enqueue(vc *Connection, m *dgofw.DiscordMessage, tracks Tracks) {
+	vc.Lock()
+	for _, s := range tracks {
+		if len(vc.Queue) >= vc.MaxQueueSize {
+			break
 		}
-
 		s.AddedBy = m.Author
-		s.LenMinutes = int(math.Floor(float64(s.Duration) / 60))
-		s.LenSeconds = s.Duration - s.LenMinutes*60
-
-		vc.Lock()
 		vc.Queue = append(vc.Queue, s)
-		vc.Unlock()
 	}
-	m.Reply(fmt.Sprintf("Added **%s** to the queue.", s.Title))
-	return
+	if vc.Fair {
+		vc.Queue = vc.Queue.fair(vc.current)
+	}
+	vc.stopped = false
+	vc.Unlock()
+	vc.wakeUp()
+
+	if len(tracks) == 1 {
+		m.Reply(fmt.Sprintf("Added **%s** to the queue.", tracks[0].Title))
+	} else {
+		m.Reply(fmt.Sprintf("Added %d tracks to the queue.", len(tracks)))
+	}
 }
 
 var urlRegex = regexp.MustCompile(`^<?(https?:\/\/)?((www\.)?youtube\.com|youtu\.?be)\/.+>?$`)
@@ -349,25 +468,26 @@ func (mp *MusicPlayer) OnMessage(m *dgofw.DiscordMessage) {
 
 	switch arg1 {
 	case "join":
-		if _, ok := mp.VoiceConnections[m.GuildID()]; ok {
-			m.Reply("I'm already in a voice channel!")
-			return
-		}
-
 		for _, presence := range presences {
 			if presence.UserID == m.Author.ID() {
-				vc := mp.discord.NewVoiceConnection(presence.GuildID, presence.ChannelID)
-				conn := &Connection{
-					Guild:        presence.GuildID,
-					Channel:      presence.ChannelID,
-					MaxQueueSize: 32,
-					Queue:        make([]*Track, 0),
-					current:      nil,
-					conn:         vc,
+				if conn, ok := mp.connection(m.GuildID()); ok {
+					// Move to the author's channel
+					conn.Lock()
+					if conn.Channel == presence.ChannelID {
+						conn.Unlock()
+						m.Reply("I'm already in your voice channel!")
+						return
+					}
+					conn.TextChannel = m.ChannelID()
+					conn.Unlock()
+					mp.redial(conn, presence.ChannelID)
+					return
 				}
 
 				mp.Lock()
-				mp.VoiceConnections[presence.GuildID] = conn
+				if _, ok := mp.VoiceConnections[presence.GuildID]; !ok {
+					mp.VoiceConnections[presence.GuildID] = mp.newConnection(presence.GuildID, presence.ChannelID, m.ChannelID())
+				}
 				mp.Unlock()
 				return
 			}
@@ -375,17 +495,11 @@ func (mp *MusicPlayer) OnMessage(m *dgofw.DiscordMessage) {
 
 		m.Reply("You're not in a voice channel")
 	case "leave":
-		vc, ok := mp.VoiceConnections[m.GuildID()]
+		vc, ok := mp.connection(m.GuildID())
 		if ok && m.IsMod() {
-			vc.conn.Leave()
-			mp.Lock()
-			close(vc.close)
-			close(vc.control)
-			delete(mp.VoiceConnections, vc.Guild)
-			mp.Unlock()
+			mp.leave(vc)
 		}
 	case "play":
-		mp.gostart(m)
 		urls := m.Arg("arg2")
 		if urlRegex.MatchString(urls) {
 			if urls[0] == '<' {
@@ -404,85 +518,152 @@ func (mp *MusicPlayer) OnMessage(m *dgofw.DiscordMessage) {
 				return
 			}
 		} else {
-			err := mp.queue("ytsearch:"+urls, m)
+			err := mp.queue(urls, m)
 			if err != nil {
 				fmt.Println(err)
 				m.Reply("Something happened...")
 				return
 			}
 		}
-	case "pause", "resume", "skip", "stop":
+	case "pause", "resume":
 		mp.control(m.GuildID(), arg1)
+	case "skip":
+		mp.voteSkip(m)
+	case "forceskip":
+		if m.IsMod() {
+			mp.control(m.GuildID(), "skip")
+		}
+	case "stop":
+		if mp.canControl(m) {
+			mp.control(m.GuildID(), "stop")
+		}
+	case "volume", "seek", "filter", "filters":
+		mp.onAudioCommand(m, arg1, strings.Fields(m.Arg("arg2")))
+	case "set", "settings":
+		mp.onSettings(m, strings.Fields(m.Arg("arg2")))
 	case "np", "current":
-		if vc, ok := mp.VoiceConnections[m.GuildID()]; ok {
-			if vc.current != nil {
-				minutes := int(math.Floor(float64(vc.current.Remaining) / 60))
-				seconds := vc.current.Remaining - minutes*60
+		if vc, ok := mp.connection(m.GuildID()); ok {
+			vc.Lock()
+			var current Track
+			playing := vc.current != nil
+			if playing {
+				current = *vc.current
+			}
+			vc.Unlock()
+			if playing {
+				minutes := int(math.Floor(float64(current.Remaining) / 60))
+				seconds := current.Remaining - minutes*60
 				m.ReplyEmbed(&discordgo.MessageEmbed{
 					Author: &discordgo.MessageEmbedAuthor{
-						Name:    "Added by " + vc.current.AddedBy.Username(),
-						IconURL: vc.current.AddedBy.Avatar(),
+						Name:    "Added by " + current.AddedBy.Username(),
+						IconURL: current.AddedBy.Avatar(),
 					},
-					Title: vc.current.Title,
-					URL:   vc.current.URL,
-					Color: m.Session().State.UserColor(vc.current.AddedBy.ID(), m.ChannelID()),
+					Title: current.Title,
+					URL:   current.URL,
+					Color: m.Session().State.UserColor(current.AddedBy.ID(), m.ChannelID()),
 					Image: &discordgo.MessageEmbedImage{
-						URL: vc.current.Thumbnail,
+						URL: current.Thumbnail,
 					},
 					Footer: &discordgo.MessageEmbedFooter{
-						Text: fmt.Sprintf("Play time: %d:%d / %d:%d", minutes, seconds, vc.current.LenMinutes, vc.current.LenSeconds),
+						Text: fmt.Sprintf("Play time: %d:%d / %d:%d", minutes, seconds, current.LenMinutes, current.LenSeconds),
 					},
 				})
 			}
 		}
 	case "queue", "list":
-		if vc, ok := mp.VoiceConnections[m.GuildID()]; ok {
-			if len(vc.Queue) > 0 {
-				var buf bytes.Buffer
-				buf.WriteString(fmt.Sprintf("`Now playing`  **%s** added by **%s**\n\n", vc.Queue[0].Title, vc.Queue[0].AddedBy.Username()))
-				for i, track := range vc.Queue[1:] {
-					if i == 9 {
-						l := len(vc.Queue) - 10
-						buf.WriteString(fmt.Sprintf("`10`  **%s** added by **%s**\nAnd %d more", track.Title, track.AddedBy.Username(), l))
-						break
-					}
-					buf.WriteString(fmt.Sprintf("`%d`    **%s** added by **%s**\n", i+1, track.Title, track.AddedBy.Username()))
-				}
-				m.Reply(buf.String())
-			} else {
+		if vc, ok := mp.connection(m.GuildID()); ok {
+			vc.Lock()
+			if vc.current == nil && len(vc.Queue) == 0 {
+				vc.Unlock()
 				m.Reply("Nothing in the queue!")
+				return
+			}
+
+			var buf bytes.Buffer
+			if vc.current != nil {
+				buf.WriteString(fmt.Sprintf("`Now playing`  **%s** added by **%s**\n\n", vc.current.Title, vc.current.AddedBy.Username()))
+			}
+			for i, track := range vc.Queue {
+				if i == 10 {
+					buf.WriteString(fmt.Sprintf("And %d more\n", len(vc.Queue)-i))
+					break
+				}
+				buf.WriteString(fmt.Sprintf("`%d`    **%s** added by **%s**\n", i+1, track.Title, track.AddedBy.Username()))
+			}
+			if vc.Loop != LoopOff {
+				buf.WriteString("Looping " + vc.Loop.String())
 			}
+			vc.Unlock()
+			m.Reply(buf.String())
 		}
 	case "clear":
 		if m.IsMod() {
-			if vc, ok := mp.VoiceConnections[m.GuildID()]; ok {
+			if vc, ok := mp.connection(m.GuildID()); ok {
 				vc.Lock()
 				vc.Queue = []*Track{}
 				vc.Unlock()
 				m.Reply("Cleared the queue")
 			}
 		}
+	case "library":
+		mp.onLibrary(m, m.Arg("arg2"))
+	case "remove", "move", "skipto", "loop", "history", "replay", "fair":
+		mp.onQueueCommand(m, arg1, strings.Fields(m.Arg("arg2")))
+	case "playlist", "playlists":
+		mp.onPlaylist(m, m.Arg("arg2"))
 	case "shuffle":
-		if vc, ok := mp.VoiceConnections[m.GuildID()]; ok {
-			m2 := m.Reply("Shuffling...")
-			time.Sleep(time.Second)
-			sort.Sort(vc.Queue)
-			m2.Edit("Shuffled!")
+		if vc, ok := mp.connection(m.GuildID()); ok {
+			vc.Lock()
+			vc.Queue.shuffle()
+			if vc.Fair {
+				vc.Queue = vc.Queue.fair(vc.current)
+			}
+			vc.Unlock()
+			m.Reply("Shuffled!")
 		}
 	}
 }
 
 func (mp *MusicPlayer) control(guild, ctrl string) {
-	if vc, ok := mp.VoiceConnections[guild]; ok {
-		switch ctrl {
-		case "pause":
-			vc.control <- Pause
-		case "resume":
-			vc.control <- Resume
-		case "skip":
-			vc.control <- Skip
-		case "stop":
-			vc.control <- Stop
+	vc, ok := mp.connection(guild)
+	if !ok {
+		return
+	}
+
+	// Commands for the playing track name it, so one that arrives after the
+	// track ended doesn't act on whatever plays next
+	vc.Lock()
+	track := vc.current
+	vc.Unlock()
+
+	switch ctrl {
+	case "pause", "resume":
+		if track == nil {
+			// Nothing to pause, but resuming starts a stopped queue again
+			if ctrl == "resume" {
+				vc.send(command{msg: Resume})
+			}
+			return
+		}
+		msg := Pause
+		if ctrl == "resume" {
+			msg = Resume
+		}
+		if vc.send(command{msg: msg, track: track}) {
+			vc.Lock()
+			vc.paused = ctrl == "pause"
+			vc.autoPaused = false
+			vc.Unlock()
+		}
+	case "skip":
+		if track != nil {
+			vc.send(command{msg: Skip, track: track})
+		}
+	case "stop":
+		vc.send(command{msg: Stop})
+	case "restart":
+		if track != nil {
+			vc.send(command{msg: Restart, track: track})
 		}
 	}
 }
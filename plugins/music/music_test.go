@@ -0,0 +1,313 @@
+package music
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testPlayer struct {
+	*MusicPlayer
+	source *FakeSource
+
+	mu     sync.Mutex
+	voices []Voice
+}
+
+func newTestPlayer(frames int, dial func() Voice) *testPlayer {
+	tp := &testPlayer{source: &FakeSource{Frames: frames}}
+	tp.MusicPlayer = &MusicPlayer{
+		source:           tp.source,
+		settings:         &Settings{},
+		VoiceConnections: make(map[string]*Connection),
+	}
+	tp.Dial = func(guild, channel string) Voice {
+		v := dial()
+		tp.mu.Lock()
+		tp.voices = append(tp.voices, v)
+		tp.mu.Unlock()
+		return v
+	}
+	return tp
+}
+
+func (tp *testPlayer) join(guild string) *Connection {
+	tp.Lock()
+	defer tp.Unlock()
+	vc := tp.newConnection(guild, "voice", "")
+	tp.VoiceConnections[guild] = vc
+	return vc
+}
+
+// add queues n tracks like music play does.
+func (tp *testPlayer) add(vc *Connection, n int) {
+	for i := 0; i < n; i++ {
+		tracks, _ := tp.source.Resolve(fmt.Sprint("track ", rand.Int()))
+		vc.Lock()
+		if len(vc.Queue) < vc.MaxQueueSize {
+			vc.Queue = append(vc.Queue, tracks...)
+		}
+		vc.stopped = false
+		vc.Unlock()
+		vc.wakeUp()
+	}
+}
+
+// within fails the test if f doesn't return in time, which means something
+// is blocked or deadlocked.
+func within(t *testing.T, d time.Duration, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatal("timed out, something is blocked")
+	}
+}
+
+func TestConcurrentControl(t *testing.T) {
+	tp := newTestPlayer(200, func() Voice { return NewFakeVoice() })
+	vc := tp.join("guild")
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				f(i)
+				time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			}
+		}()
+	}
+	run(func(int) { tp.add(vc, 1) })
+	for _, ctrl := range []string{"pause", "resume", "skip", "stop", "restart"} {
+		ctrl := ctrl
+		run(func(int) { tp.control("guild", ctrl) })
+	}
+	run(func(int) {
+		vc.Lock()
+		current := vc.current
+		vc.Unlock()
+		if current != nil {
+			vc.send(command{msg: Skip, track: current})
+		}
+	})
+	run(func(i int) {
+		if i%20 == 0 {
+			tp.redial(vc, fmt.Sprint("voice ", i))
+		}
+	})
+	run(func(int) {
+		vc.Lock()
+		_ = fmt.Sprint(len(vc.Queue), len(vc.History), vc.paused, vc.elapsed)
+		vc.Unlock()
+	})
+
+	within(t, 20*time.Second, func() {
+		time.Sleep(20 * time.Millisecond)
+		tp.leave(vc)
+		wg.Wait()
+	})
+
+	if _, ok := tp.connection("guild"); ok {
+		t.Error("still connected after leaving")
+	}
+	select {
+	case <-vc.ctx.Done():
+	default:
+		t.Error("the player wasn't stopped")
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.voices) < 2 {
+		t.Fatalf("dialed %d times, want a redial", len(tp.voices))
+	}
+	for i, v := range tp.voices {
+		fv := v.(*FakeVoice)
+		fv.Lock()
+		if !fv.Left {
+			t.Errorf("voice connection %d was never left", i)
+		}
+		fv.Unlock()
+	}
+}
+
+func TestPlaysThroughTheQueue(t *testing.T) {
+	tp := newTestPlayer(10, func() Voice { return NewFakeVoice() })
+	vc := tp.join("guild")
+	tp.add(vc, 3)
+
+	within(t, 5*time.Second, func() {
+		for {
+			vc.Lock()
+			played := len(vc.History)
+			vc.Unlock()
+			if played == 3 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	tp.leave(vc)
+
+	v := tp.voices[0].(*FakeVoice)
+	v.Lock()
+	defer v.Unlock()
+	if v.Sent < 20 {
+		t.Errorf("sent %d frames, want the 30 of the queue", v.Sent)
+	}
+}
+
+// stuckVoice never takes a frame, like a connection that stopped sending.
+type stuckVoice struct {
+	frames chan []byte
+}
+
+func (v *stuckVoice) Frames() chan<- []byte { return v.frames }
+func (v *stuckVoice) Speaking(bool)         {}
+func (v *stuckVoice) Leave()                {}
+
+func TestControlDoesNotBlock(t *testing.T) {
+	tp := newTestPlayer(100, func() Voice { return &stuckVoice{frames: make(chan []byte)} })
+	vc := tp.join("guild")
+	tp.add(vc, 1)
+
+	// The player is stuck sending the first frame, so nothing reads the
+	// control channel
+	within(t, 5*time.Second, func() {
+		for {
+			vc.Lock()
+			playing := vc.current != nil
+			vc.Unlock()
+			if playing {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	within(t, time.Second, func() {
+		for i := 0; i < 50; i++ {
+			tp.control("guild", "skip")
+			tp.control("guild", "pause")
+		}
+	})
+	within(t, time.Second, func() { tp.leave(vc) })
+	within(t, time.Second, func() { tp.control("guild", "skip") })
+}
+
+func TestSkipOnlySkipsTheCurrentTrack(t *testing.T) {
+	v := &stuckVoice{frames: make(chan []byte)}
+	tp := newTestPlayer(1000, func() Voice { return v })
+	vc := tp.join("guild")
+	defer tp.leave(vc)
+	tp.add(vc, 3)
+
+	var first *Track
+	within(t, 5*time.Second, func() {
+		for first == nil {
+			vc.Lock()
+			first = vc.current
+			vc.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	})
+	vc.Lock()
+	second := vc.Queue[0]
+	vc.Unlock()
+
+	// Both skips are sent while the first track plays, the second one must
+	// not skip the track after it
+	tp.control("guild", "skip")
+	tp.control("guild", "skip")
+	within(t, 5*time.Second, func() {
+		for i := 0; i < 10; i++ {
+			<-v.frames
+		}
+	})
+	vc.Lock()
+	current := vc.current
+	vc.Unlock()
+	if current != second {
+		t.Errorf("playing %v, want the second track %v", current, second)
+	}
+}
+
+func TestSeekIsForgottenWhenTheTrackChanges(t *testing.T) {
+	first, second := &Track{Title: "first"}, &Track{Title: "second"}
+	vc := &Connection{Queue: Tracks{second}, current: first}
+	vc.seek, vc.seeking = time.Minute, true
+
+	if next := vc.advance(first, endSkipped); next != second {
+		t.Fatalf("advanced to %v, want the second track", next)
+	}
+	if vc.seeking {
+		t.Error("the second track would start where the first was seeked to")
+	}
+}
+
+func TestPauseWithNothingPlaying(t *testing.T) {
+	tp := newTestPlayer(10, func() Voice { return NewFakeVoice() })
+	vc := tp.join("guild")
+	defer tp.leave(vc)
+
+	tp.control("guild", "pause")
+	vc.Lock()
+	paused := vc.paused
+	vc.Unlock()
+	if paused {
+		t.Error("paused with nothing playing")
+	}
+}
+
+func TestResumeAfterStop(t *testing.T) {
+	tp := newTestPlayer(100000, func() Voice { return NewFakeVoice() })
+	vc := tp.join("guild")
+	defer tp.leave(vc)
+	tp.add(vc, 2)
+
+	playing := func(want bool) func() {
+		return func() {
+			for {
+				vc.Lock()
+				current := vc.current != nil
+				vc.Unlock()
+				if current == want {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	within(t, 5*time.Second, playing(true))
+	tp.control("guild", "stop")
+	within(t, 5*time.Second, playing(false))
+	tp.control("guild", "resume")
+	within(t, 5*time.Second, playing(true))
+}
+
+func TestRedialLeavesTheOldConnection(t *testing.T) {
+	tp := newTestPlayer(10, func() Voice { return NewFakeVoice() })
+	vc := tp.join("guild")
+	defer tp.leave(vc)
+
+	tp.redial(vc, "other")
+	old := tp.voices[0].(*FakeVoice)
+	old.Lock()
+	left := old.Left
+	old.Unlock()
+	if !left {
+		t.Error("the old voice connection is still open")
+	}
+	vc.Lock()
+	defer vc.Unlock()
+	if vc.Channel != "other" || vc.conn != tp.voices[1] {
+		t.Error("not connected to the new channel")
+	}
+}
@@ -0,0 +1,192 @@
+package music
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"github.com/Krognol/dgofw"
+)
+
+// Resume modes, what happens to a server's queue when the bot restarts.
+const (
+	// ResumeOff forgets the queue
+	ResumeOff = "off"
+	// ResumeTrack rejoins and plays the current track from the start
+	ResumeTrack = "track"
+	// ResumePosition rejoins and plays the current track from where it was
+	ResumePosition = "position"
+)
+
+const (
+	// queuesPath is where the queues are kept between restarts
+	queuesPath = "./musicqueues.json"
+	// saveInterval is how often the queues are saved, so a crash loses little
+	saveInterval = 10 * time.Second
+)
+
+// SavedConnection is the state of a connection kept between restarts.
+type SavedConnection struct {
+	Guild       string        `json:"guild"`
+	Channel     string        `json:"channel"`
+	TextChannel string        `json:"text_channel"`
+	Current     *SavedTrack   `json:"current,omitempty"`
+	Elapsed     int           `json:"elapsed"`
+	Queue       []*SavedTrack `json:"queue"`
+	Loop        LoopMode      `json:"loop"`
+	Fair        bool          `json:"fair"`
+	Filters     Filters       `json:"filters"`
+}
+
+func savedQueueTrack(t *Track) *SavedTrack {
+	s := savedTrack(t)
+	if t.AddedBy != nil {
+		s.AddedBy = t.AddedBy.ID()
+	}
+	return s
+}
+
+// SaveQueues writes the state of every connection. It does nothing until
+// the saved queues have been restored, so they aren't overwritten before
+// that.
+func (mp *MusicPlayer) SaveQueues() (err error) {
+	mp.Lock()
+	if !mp.restored {
+		mp.Unlock()
+		return nil
+	}
+	saved := make([]*SavedConnection, 0, len(mp.VoiceConnections))
+	for _, vc := range mp.VoiceConnections {
+		vc.Lock()
+		sc := &SavedConnection{
+			Guild:       vc.Guild,
+			Channel:     vc.Channel,
+			TextChannel: vc.TextChannel,
+			Loop:        vc.Loop,
+			Fair:        vc.Fair,
+			Filters:     vc.Filters,
+		}
+		if vc.current != nil {
+			sc.Current = savedQueueTrack(vc.current)
+			sc.Elapsed = int(vc.elapsed.Seconds())
+		}
+		for _, t := range vc.Queue {
+			sc.Queue = append(sc.Queue, savedQueueTrack(t))
+		}
+		vc.Unlock()
+		saved = append(saved, sc)
+	}
+	mp.Unlock()
+
+	mp.saveMu.Lock()
+	defer mp.saveMu.Unlock()
+	var f *os.File
+	if f, err = os.Create(queuesPath); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(saved)
+	}
+	return
+}
+
+// OnReady rejoins the voice channels of the servers that resume their
+// queues, then saves the queues every few seconds so a crash loses little.
+func (mp *MusicPlayer) OnReady(s *discordgo.Session, r *discordgo.Ready) {
+	mp.restore.Do(func() {
+		if err := mp.restoreQueues(s); err != nil {
+			fmt.Println(err)
+		}
+		mp.Lock()
+		mp.restored = true
+		mp.Unlock()
+
+		go mp.saveLoop()
+	})
+}
+
+// saveLoop saves the queues every few seconds until Close.
+func (mp *MusicPlayer) saveLoop() {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := mp.SaveQueues(); err != nil {
+				fmt.Println(err)
+			}
+		case <-mp.stop:
+			return
+		}
+	}
+}
+
+// Close stops saving the queues in the background and saves them one last
+// time.
+func (mp *MusicPlayer) Close() error {
+	mp.closeOnce.Do(func() { close(mp.stop) })
+	return mp.SaveQueues()
+}
+
+func (mp *MusicPlayer) restoreQueues(s *discordgo.Session) error {
+	b, err := ioutil.ReadFile(queuesPath)
+	if err != nil {
+		return err
+	}
+	var saved []*SavedConnection
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	users := make(map[string]*dgofw.DiscordUser)
+	user := func(id string) *dgofw.DiscordUser {
+		if u, ok := users[id]; ok {
+			return u
+		}
+		u, err := s.User(id)
+		if err != nil {
+			u = s.State.User
+		}
+		users[id] = dgofw.NewDiscordUser(s, u)
+		return users[id]
+	}
+	track := func(st *SavedTrack) *Track {
+		t := st.track()
+		t.AddedBy = user(st.AddedBy)
+		return t
+	}
+
+	for _, sc := range saved {
+		mode := mp.settings.get(sc.Guild).Resume
+		if mode == ResumeOff || (sc.Current == nil && len(sc.Queue) == 0) {
+			continue
+		}
+
+		mp.Lock()
+		if _, ok := mp.VoiceConnections[sc.Guild]; ok {
+			mp.Unlock()
+			continue
+		}
+		vc := mp.newConnection(sc.Guild, sc.Channel, sc.TextChannel)
+		mp.VoiceConnections[sc.Guild] = vc
+		mp.Unlock()
+
+		vc.Lock()
+		vc.Loop, vc.Fair, vc.Filters = sc.Loop, sc.Fair, sc.Filters
+		for _, st := range sc.Queue {
+			vc.Queue = append(vc.Queue, track(st))
+		}
+		if sc.Current != nil {
+			current := track(sc.Current)
+			vc.Queue = append(Tracks{current}, vc.Queue...)
+			if mode == ResumePosition {
+				vc.resuming, vc.resumeAt = current, time.Duration(sc.Elapsed)*time.Second
+			}
+		}
+		vc.Unlock()
+		vc.wakeUp()
+	}
+	return nil
+}
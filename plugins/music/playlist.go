@@ -0,0 +1,519 @@
+package music
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Krognol/dgofw"
+)
+
+// maxPlaylistSize is the most tracks a saved playlist can have.
+const maxPlaylistSize = 500
+
+type (
+	// SavedTrack is what's kept of a track in a playlist, enough to play it
+	// again without resolving it.
+	SavedTrack struct {
+		ID        string `json:"id"`
+		Title     string `json:"title"`
+		URL       string `json:"url"`
+		Source    string `json:"source"`
+		Duration  int    `json:"duration"`
+		Thumbnail string `json:"thumbnail"`
+		// AddedBy is the ID of the user who queued the track, only kept
+		// for saved queues
+		AddedBy string `json:"added_by,omitempty"`
+	}
+
+	// Playlist belongs to the user who saved it. Shared playlists can be
+	// loaded by anyone in the server it was saved in.
+	Playlist struct {
+		Name      string        `json:"name"`
+		OwnerID   string        `json:"owner_id"`
+		OwnerName string        `json:"owner_name"`
+		GuildID   string        `json:"guild_id"`
+		Shared    bool          `json:"shared"`
+		Tracks    []*SavedTrack `json:"tracks"`
+	}
+
+	Playlists struct {
+		sync.RWMutex
+		Lists []*Playlist `json:"playlists"`
+	}
+)
+
+func NewPlaylists() *Playlists {
+	p := &Playlists{}
+	if err := p.Load(); err != nil {
+		fmt.Println(err)
+		p.Save()
+	}
+	return p
+}
+
+func savedTrack(t *Track) *SavedTrack {
+	return &SavedTrack{
+		ID:        t.ID,
+		Title:     t.Title,
+		URL:       t.URL,
+		Source:    t.Source,
+		Duration:  t.Duration,
+		Thumbnail: t.Thumbnail,
+	}
+}
+
+func (s *SavedTrack) track() *Track {
+	track := newTrack(s.ID, s.Title, s.URL, s.Duration, s.Thumbnail)
+	track.Source = s.Source
+	return track
+}
+
+// find returns a playlist of the user by name, or else one shared in the
+// guild. Has to be called with the lock held.
+func (p *Playlists) find(userID, guildID, name string) *Playlist {
+	var shared *Playlist
+	for _, pl := range p.Lists {
+		if !strings.EqualFold(pl.Name, name) {
+			continue
+		}
+		if pl.OwnerID == userID {
+			return pl
+		}
+		if pl.Shared && pl.GuildID == guildID && shared == nil {
+			shared = pl
+		}
+	}
+	return shared
+}
+
+// own returns a playlist owned by the user. Has to be called with the lock
+// held.
+func (p *Playlists) own(userID, name string) *Playlist {
+	for _, pl := range p.Lists {
+		if pl.OwnerID == userID && strings.EqualFold(pl.Name, name) {
+			return pl
+		}
+	}
+	return nil
+}
+
+// put saves tracks as the user's playlist, replacing one with the same name.
+func (p *Playlists) put(m *dgofw.DiscordMessage, name string, tracks Tracks) {
+	saved := make([]*SavedTrack, len(tracks))
+	for i, t := range tracks {
+		saved[i] = savedTrack(t)
+	}
+
+	p.Lock()
+	if pl := p.own(m.Author.ID(), name); pl != nil {
+		pl.Tracks = saved
+	} else {
+		p.Lists = append(p.Lists, &Playlist{
+			Name:      name,
+			OwnerID:   m.Author.ID(),
+			OwnerName: m.Author.Username(),
+			GuildID:   m.GuildID(),
+			Tracks:    saved,
+		})
+	}
+	p.Unlock()
+	p.Save()
+}
+
+func (mp *MusicPlayer) onPlaylist(m *dgofw.DiscordMessage, args string) {
+	cmd, name := args, ""
+	if i := strings.IndexByte(args, ' '); i >= 0 {
+		cmd, name = args[:i], strings.TrimSpace(args[i+1:])
+	}
+
+	switch cmd {
+	case "", "list":
+		mp.listPlaylists(m)
+	case "save":
+		if name == "" {
+			m.Reply("Give the playlist a name.")
+			return
+		}
+		vc, ok := mp.connection(m.GuildID())
+		if !ok {
+			m.Reply("I'm not in a voice channel")
+			return
+		}
+		vc.Lock()
+		var tracks Tracks
+		if vc.current != nil {
+			tracks = append(tracks, vc.current)
+		}
+		tracks = append(tracks, vc.Queue...)
+		vc.Unlock()
+		if len(tracks) == 0 {
+			m.Reply("Nothing in the queue!")
+			return
+		}
+		if len(tracks) > maxPlaylistSize {
+			tracks = tracks[:maxPlaylistSize]
+		}
+		mp.playlists.put(m, name, tracks)
+		m.Reply(fmt.Sprintf("Saved %d tracks as **%s**.", len(tracks), name))
+	case "load":
+		vc, ok := mp.connection(m.GuildID())
+		if !ok {
+			m.Reply("I'm not in a voice channel")
+			return
+		}
+		mp.playlists.RLock()
+		pl := mp.playlists.find(m.Author.ID(), m.GuildID(), name)
+		var tracks Tracks
+		if pl != nil {
+			for _, s := range pl.Tracks {
+				tracks = append(tracks, s.track())
+			}
+		}
+		mp.playlists.RUnlock()
+		if pl == nil {
+			m.Reply("No playlist called " + name)
+			return
+		}
+
+		vc.Lock()
+		room := vc.MaxQueueSize - len(vc.Queue)
+		vc.Unlock()
+		if room <= 0 {
+			m.Reply("Can't queue any more tracks right now")
+			return
+		}
+		if len(tracks) > room {
+			m.Reply(fmt.Sprintf("Only %d of the %d tracks fit in the queue.", room, len(tracks)))
+			tracks = tracks[:room]
+		}
+		mp.enqueue(vc, m, tracks)
+	case "show":
+		mp.playlists.RLock()
+		defer mp.playlists.RUnlock()
+		pl := mp.playlists.find(m.Author.ID(), m.GuildID(), name)
+		if pl == nil {
+			m.Reply("No playlist called " + name)
+			return
+		}
+		var buf strings.Builder
+		buf.WriteString(fmt.Sprintf("**%s** by **%s**, %d tracks\n", pl.Name, pl.OwnerName, len(pl.Tracks)))
+		for i, t := range pl.Tracks {
+			if i == 10 {
+				buf.WriteString(fmt.Sprintf("And %d more", len(pl.Tracks)-i))
+				break
+			}
+			buf.WriteString(fmt.Sprintf("`%d`  %s\n", i+1, t.Title))
+		}
+		m.Reply(buf.String())
+	case "delete":
+		mp.playlists.Lock()
+		var deleted bool
+		for i, pl := range mp.playlists.Lists {
+			if !strings.EqualFold(pl.Name, name) {
+				continue
+			}
+			if pl.OwnerID == m.Author.ID() || (pl.Shared && pl.GuildID == m.GuildID() && m.IsMod()) {
+				mp.playlists.Lists = append(mp.playlists.Lists[:i], mp.playlists.Lists[i+1:]...)
+				deleted = true
+				break
+			}
+		}
+		mp.playlists.Unlock()
+		if !deleted {
+			m.Reply("You don't have a playlist called " + name)
+			return
+		}
+		mp.playlists.Save()
+		m.Reply("Deleted " + name)
+	case "share":
+		mp.playlists.Lock()
+		pl := mp.playlists.own(m.Author.ID(), name)
+		if pl != nil {
+			pl.Shared = !pl.Shared
+			pl.GuildID = m.GuildID()
+		}
+		mp.playlists.Unlock()
+		if pl == nil {
+			m.Reply("You don't have a playlist called " + name)
+			return
+		}
+		mp.playlists.Save()
+		if pl.Shared {
+			m.Reply(fmt.Sprintf("Shared **%s** with the server.", pl.Name))
+		} else {
+			m.Reply(fmt.Sprintf("**%s** isn't shared anymore.", pl.Name))
+		}
+	case "import":
+		mp.importPlaylist(m, name)
+	}
+}
+
+func (mp *MusicPlayer) listPlaylists(m *dgofw.DiscordMessage) {
+	mp.playlists.RLock()
+	defer mp.playlists.RUnlock()
+
+	var buf strings.Builder
+	for _, pl := range mp.playlists.Lists {
+		switch {
+		case pl.OwnerID == m.Author.ID():
+			shared := ""
+			if pl.Shared {
+				shared = ", shared"
+			}
+			buf.WriteString(fmt.Sprintf("**%s** (%d tracks%s)\n", pl.Name, len(pl.Tracks), shared))
+		case pl.Shared && pl.GuildID == m.GuildID():
+			buf.WriteString(fmt.Sprintf("**%s** by %s (%d tracks)\n", pl.Name, pl.OwnerName, len(pl.Tracks)))
+		}
+	}
+	if buf.Len() == 0 {
+		m.Reply("There are no playlists.")
+		return
+	}
+	m.Reply(buf.String())
+}
+
+// importPlaylist saves a playlist from a link the backend can resolve, like
+// a YouTube playlist, or from an attached .m3u or .pls file.
+func (mp *MusicPlayer) importPlaylist(m *dgofw.DiscordMessage, args string) {
+	name, link := args, ""
+	if i := strings.IndexByte(args, ' '); i >= 0 {
+		name, link = args[:i], strings.Trim(strings.TrimSpace(args[i+1:]), "<>")
+	}
+	if name == "" {
+		m.Reply("Give the playlist a name.")
+		return
+	}
+
+	var entries []playlistEntry
+	if link == "" {
+		msg, err := m.Session().ChannelMessage(m.ChannelID(), m.ID())
+		if err != nil || len(msg.Attachments) == 0 || playlistFormat(msg.Attachments[0].Filename) == "" {
+			m.Reply("Give a link to a playlist or attach a .m3u or .pls file.")
+			return
+		}
+		file := msg.Attachments[0]
+		res, err := http.Get(file.URL)
+		if err != nil {
+			m.Reply("Couldn't download the file: " + err.Error())
+			return
+		}
+		defer res.Body.Close()
+		if entries, err = parsePlaylist(playlistFormat(file.Filename), io.LimitReader(res.Body, 1<<20)); err != nil || len(entries) == 0 {
+			m.Reply("Couldn't read the playlist.")
+			return
+		}
+	}
+
+	progress := m.Reply("Importing...")
+	var tracks Tracks
+	var failed int
+	last := time.Now()
+	report := func(done, total int) {
+		if time.Since(last) < 3*time.Second {
+			return
+		}
+		last = time.Now()
+		if total > 0 {
+			progress.Edit(fmt.Sprintf("Importing... %d of %d", done, total))
+		} else {
+			progress.Edit(fmt.Sprintf("Importing... %d tracks so far", done))
+		}
+	}
+
+	if link != "" {
+		err := mp.resolveEach(link, func(track *Track) {
+			if len(tracks) < maxPlaylistSize {
+				tracks = append(tracks, track)
+				report(len(tracks), 0)
+			}
+		})
+		if err != nil && len(tracks) == 0 {
+			fmt.Println(err)
+			progress.Edit("Couldn't import that playlist.")
+			return
+		}
+	} else {
+		if len(entries) > maxPlaylistSize {
+			entries = entries[:maxPlaylistSize]
+		}
+		for i, e := range entries {
+			resolved, err := mp.source.Resolve(e.query())
+			if err != nil || len(resolved) == 0 {
+				failed++
+				continue
+			}
+			track := resolved[0]
+			if e.Title != "" && track.Source != "backend" {
+				track.Title = e.Title
+			}
+			if track.Duration == 0 && e.Duration > 0 {
+				track.Duration = e.Duration
+			}
+			tracks = append(tracks, track)
+			report(i+1, len(entries))
+		}
+	}
+
+	if len(tracks) == 0 {
+		progress.Edit("None of the tracks could be found.")
+		return
+	}
+	mp.playlists.put(m, name, tracks)
+	msg := fmt.Sprintf("Imported %d tracks as **%s**.", len(tracks), name)
+	if failed > 0 {
+		msg += fmt.Sprintf(" %d couldn't be found.", failed)
+	}
+	progress.Edit(msg)
+}
+
+// resolveEach resolves a query, calling each with the tracks as they come in
+// if the source can do that.
+func (mp *MusicPlayer) resolveEach(query string, each func(*Track)) error {
+	if s, ok := mp.source.(interface {
+		ResolveEach(string, func(*Track)) error
+	}); ok {
+		return s.ResolveEach(query, each)
+	}
+	tracks, err := mp.source.Resolve(query)
+	for _, track := range tracks {
+		each(track)
+	}
+	return err
+}
+
+// playlistEntry is an entry of an m3u or pls file.
+type playlistEntry struct {
+	Location string
+	Title    string
+	Duration int
+}
+
+// query turns the location into a query. Paths are taken to be in the
+// music library.
+func (e playlistEntry) query() string {
+	if strings.HasPrefix(e.Location, "http://") || strings.HasPrefix(e.Location, "https://") {
+		return e.Location
+	}
+	return "file:" + path.Clean(strings.ReplaceAll(strings.TrimPrefix(e.Location, "file://"), "\\", "/"))
+}
+
+func playlistFormat(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".m3u", ".m3u8":
+		return "m3u"
+	case ".pls":
+		return "pls"
+	}
+	return ""
+}
+
+func parsePlaylist(format string, r io.Reader) ([]playlistEntry, error) {
+	if format == "pls" {
+		return parsePLS(r)
+	}
+	return parseM3U(r)
+}
+
+// parseM3U reads an m3u file, using the titles and durations of extended
+// m3u #EXTINF lines.
+func parseM3U(r io.Reader) ([]playlistEntry, error) {
+	var entries []playlistEntry
+	var next playlistEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.SplitN(line[len("#EXTINF:"):], ",", 2)
+			next.Duration, _ = strconv.Atoi(strings.Fields(info[0] + " ")[0])
+			if len(info) == 2 {
+				next.Title = strings.TrimSpace(info[1])
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			next.Location = line
+			entries = append(entries, next)
+			next = playlistEntry{}
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// parsePLS reads a pls file, where entries are numbered FileN, TitleN and
+// LengthN keys.
+func parsePLS(r io.Reader) ([]playlistEntry, error) {
+	byNum := make(map[int]*playlistEntry)
+	var order []int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(kv[0])
+		var field string
+		for _, f := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, f) {
+				field = f
+				break
+			}
+		}
+		n, err := strconv.Atoi(key[len(field):])
+		if field == "" || err != nil {
+			continue
+		}
+		e, ok := byNum[n]
+		if !ok {
+			e = &playlistEntry{}
+			byNum[n] = e
+			order = append(order, n)
+		}
+		switch field {
+		case "file":
+			e.Location = strings.TrimSpace(kv[1])
+		case "title":
+			e.Title = strings.TrimSpace(kv[1])
+		case "length":
+			e.Duration, _ = strconv.Atoi(strings.TrimSpace(kv[1]))
+		}
+	}
+	sort.Ints(order)
+	var entries []playlistEntry
+	for _, n := range order {
+		if e := byNum[n]; e.Location != "" {
+			entries = append(entries, *e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (p *Playlists) Save() (err error) {
+	p.RLock()
+	defer p.RUnlock()
+	var f *os.File
+	if f, err = os.Create("./playlistsstate.json"); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(p)
+	}
+	return
+}
+
+func (p *Playlists) Load() (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile("./playlistsstate.json"); err != nil {
+		return
+	}
+	return json.Unmarshal(b, p)
+}
@@ -0,0 +1,307 @@
+package music
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/Krognol/dgofw"
+)
+
+// LoopMode is what happens to a track when it ends.
+type LoopMode int
+
+const (
+	// LoopOff drops tracks once they're played
+	LoopOff LoopMode = iota
+	// LoopTrack plays the same track until it's skipped
+	LoopTrack
+	// LoopQueue puts played tracks back at the end of the queue
+	LoopQueue
+)
+
+var loopModes = map[string]LoopMode{"off": LoopOff, "track": LoopTrack, "queue": LoopQueue}
+
+func (l LoopMode) String() string {
+	for name, mode := range loopModes {
+		if mode == l {
+			return name
+		}
+	}
+	return "off"
+}
+
+// trackEnd is why a track stopped playing.
+type trackEnd int
+
+const (
+	endFinished trackEnd = iota
+	endSkipped
+	endStopped
+	endClosed
+	endFailed
+)
+
+// maxHistory is how many played tracks a connection remembers.
+const maxHistory = 20
+
+// advance moves the queue past a track that ended and returns the track to
+// play next, or nil if there's nothing to play. finished is nil if nothing
+// was playing.
+func (vc *Connection) advance(finished *Track, end trackEnd) *Track {
+	vc.Lock()
+	defer vc.Unlock()
+
+	if finished != nil {
+		if end != endFailed {
+			vc.History = append(vc.History, finished)
+			if len(vc.History) > maxHistory {
+				vc.History = vc.History[len(vc.History)-maxHistory:]
+			}
+		}
+		switch {
+		case end == endStopped:
+			vc.stopped = true
+		case vc.Loop == LoopTrack && end == endFinished:
+			vc.Queue = append(Tracks{finished}, vc.Queue...)
+		case vc.Loop == LoopQueue && end != endFailed && !vc.Queue.has(finished):
+			// replay and skipto already put it back where it loops to
+			vc.Queue = append(vc.Queue, finished)
+		}
+	}
+
+	vc.current = nil
+	vc.elapsed = 0
+	vc.skipVotes = nil
+	vc.paused, vc.autoPaused = false, false
+	vc.seeking = false
+	if vc.stopped || len(vc.Queue) == 0 {
+		return nil
+	}
+	next := vc.Queue[0]
+	vc.Queue = vc.Queue[1:]
+	next.Remaining = next.Duration
+	vc.current = next
+	return next
+}
+
+// has reports whether the track itself is in the queue.
+func (t Tracks) has(track *Track) bool {
+	for _, queued := range t {
+		if queued == track {
+			return true
+		}
+	}
+	return false
+}
+
+// skipTo drops the upcoming tracks before i. When the queue loops, they go
+// to the end of it after the current track, in the order they would have
+// played. Has to be called with the lock held.
+func (vc *Connection) skipTo(i int) {
+	skipped := vc.Queue[:i:i]
+	vc.Queue = vc.Queue[i:]
+	if vc.Loop == LoopQueue {
+		if vc.current != nil {
+			skipped = append(Tracks{vc.current}, skipped...)
+		}
+		vc.Queue = append(vc.Queue, skipped...)
+	}
+}
+
+// shuffle puts the tracks in a random order, with every order as likely.
+func (t Tracks) shuffle() {
+	for i := len(t) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		t[i], t[j] = t[j], t[i]
+	}
+}
+
+func addedBy(t *Track) string {
+	if t.AddedBy == nil {
+		return ""
+	}
+	return t.AddedBy.ID()
+}
+
+// fair orders the tracks so the users who added them take turns, in the
+// order they first appear. Each user's tracks keep their order. The user who
+// added the current track goes last.
+func (t Tracks) fair(current *Track) Tracks {
+	var users []string
+	byUser := make(map[string]Tracks)
+	for _, track := range t {
+		id := addedBy(track)
+		if _, ok := byUser[id]; !ok {
+			users = append(users, id)
+		}
+		byUser[id] = append(byUser[id], track)
+	}
+	if current != nil {
+		for i, id := range users {
+			if id == addedBy(current) {
+				users = append(users[i+1:], users[:i+1]...)
+				break
+			}
+		}
+	}
+
+	result := make(Tracks, 0, len(t))
+	for len(result) < len(t) {
+		for _, id := range users {
+			if tracks := byUser[id]; len(tracks) > 0 {
+				result = append(result, tracks[0])
+				byUser[id] = tracks[1:]
+			}
+		}
+	}
+	return result
+}
+
+// upcoming parses a position in the queue as shown by music queue, starting
+// at 1, and returns its index. Has to be called with the lock held.
+func (vc *Connection) upcoming(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > len(vc.Queue) {
+		return 0, fmt.Errorf("There's no track %s in the queue", s)
+	}
+	return n - 1, nil
+}
+
+func (mp *MusicPlayer) onQueueCommand(m *dgofw.DiscordMessage, cmd string, args []string) {
+	vc, ok := mp.connection(m.GuildID())
+	if !ok {
+		m.Reply("I'm not in a voice channel")
+		return
+	}
+
+	switch cmd {
+	case "remove":
+		if len(args) != 1 {
+			return
+		}
+		vc.Lock()
+		i, err := vc.upcoming(args[0])
+		if err != nil {
+			vc.Unlock()
+			m.Reply(err.Error())
+			return
+		}
+		track := vc.Queue[i]
+		if !m.IsMod() && (track.AddedBy == nil || track.AddedBy.ID() != m.Author.ID()) {
+			vc.Unlock()
+			m.Reply("You can only remove tracks you added.")
+			return
+		}
+		vc.Queue = append(vc.Queue[:i], vc.Queue[i+1:]...)
+		vc.Unlock()
+		m.Reply(fmt.Sprintf("Removed **%s** from the queue.", track.Title))
+	case "move":
+		if len(args) != 2 {
+			return
+		}
+		vc.Lock()
+		from, err := vc.upcoming(args[0])
+		if err == nil {
+			var to int
+			if to, err = vc.upcoming(args[1]); err == nil {
+				track := vc.Queue[from]
+				vc.Queue = append(vc.Queue[:from], vc.Queue[from+1:]...)
+				vc.Queue = append(vc.Queue[:to], append(Tracks{track}, vc.Queue[to:]...)...)
+				vc.Unlock()
+				m.Reply(fmt.Sprintf("Moved **%s** to %d.", track.Title, to+1))
+				return
+			}
+		}
+		vc.Unlock()
+		m.Reply(err.Error())
+	case "skipto":
+		if len(args) != 1 || !mp.canControl(m) {
+			return
+		}
+		vc.Lock()
+		i, err := vc.upcoming(args[0])
+		if err != nil {
+			vc.Unlock()
+			m.Reply(err.Error())
+			return
+		}
+		vc.skipTo(i)
+		current := vc.current
+		vc.Unlock()
+		if current != nil {
+			vc.send(command{msg: Skip, track: current})
+		}
+	case "loop":
+		if len(args) == 0 {
+			vc.Lock()
+			mode := vc.Loop
+			vc.Unlock()
+			m.Reply("Looping is " + mode.String())
+			return
+		}
+		mode, ok := loopModes[strings.ToLower(args[0])]
+		if !ok {
+			m.Reply("Loop can be off, track or queue")
+			return
+		}
+		vc.Lock()
+		vc.Loop = mode
+		vc.Unlock()
+		m.Reply("Looping is " + mode.String())
+	case "fair":
+		vc.Lock()
+		if len(args) > 0 {
+			switch strings.ToLower(args[0]) {
+			case "on":
+				vc.Fair = true
+				vc.Queue = vc.Queue.fair(vc.current)
+			case "off":
+				vc.Fair = false
+			}
+		}
+		fair := vc.Fair
+		vc.Unlock()
+		if fair {
+			m.Reply("Fair queue is on, everyone's tracks take turns.")
+		} else {
+			m.Reply("Fair queue is off, tracks play in the order they're added.")
+		}
+	case "history":
+		vc.Lock()
+		if len(vc.History) == 0 {
+			vc.Unlock()
+			m.Reply("Nothing has been played yet.")
+			return
+		}
+		var buf strings.Builder
+		buf.WriteString("Recently played\n")
+		for i := len(vc.History) - 1; i >= 0 && i >= len(vc.History)-10; i-- {
+			buf.WriteString(fmt.Sprintf("`%d`  **%s**\n", len(vc.History)-i, vc.History[i].Title))
+		}
+		vc.Unlock()
+		m.Reply(buf.String())
+	case "replay":
+		vc.Lock()
+		current := vc.current
+		track := current
+		if track == nil && len(vc.History) > 0 {
+			track = vc.History[len(vc.History)-1]
+		}
+		if track == nil {
+			vc.Unlock()
+			m.Reply("Nothing has been played yet.")
+			return
+		}
+		vc.Queue = append(Tracks{track}, vc.Queue...)
+		vc.stopped = false
+		vc.Unlock()
+		if current != nil {
+			vc.send(command{msg: Skip, track: current})
+		} else {
+			vc.wakeUp()
+		}
+		m.Reply(fmt.Sprintf("Playing **%s** again.", track.Title))
+	}
+}
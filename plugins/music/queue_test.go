@@ -0,0 +1,208 @@
+package music
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Krognol/dgofw"
+	"github.com/bwmarrin/discordgo"
+)
+
+// titles lists the tracks by title, to compare queues in tests.
+func titles(tracks Tracks) string {
+	var names []string
+	for _, t := range tracks {
+		names = append(names, t.Title)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestAdvance(t *testing.T) {
+	tests := []struct {
+		name    string
+		loop    LoopMode
+		end     trackEnd
+		next    string
+		queue   string
+		history string
+		stopped bool
+	}{
+		{"off finished", LoopOff, endFinished, "a", "b", "x", false},
+		{"off skipped", LoopOff, endSkipped, "a", "b", "x", false},
+		{"off stopped", LoopOff, endStopped, "", "a b", "x", true},
+		{"off failed", LoopOff, endFailed, "a", "b", "", false},
+		{"track finished", LoopTrack, endFinished, "x", "a b", "x", false},
+		{"track skipped", LoopTrack, endSkipped, "a", "b", "x", false},
+		{"track stopped", LoopTrack, endStopped, "", "a b", "x", true},
+		{"track failed", LoopTrack, endFailed, "a", "b", "", false},
+		{"queue finished", LoopQueue, endFinished, "a", "b x", "x", false},
+		{"queue skipped", LoopQueue, endSkipped, "a", "b x", "x", false},
+		{"queue stopped", LoopQueue, endStopped, "", "a b", "x", true},
+		{"queue failed", LoopQueue, endFailed, "a", "b", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &Track{Title: "x"}
+			vc := &Connection{
+				Queue:   Tracks{{Title: "a"}, {Title: "b"}},
+				Loop:    tt.loop,
+				current: x,
+				paused:  true,
+			}
+
+			var next string
+			if track := vc.advance(x, tt.end); track != nil {
+				next = track.Title
+				if vc.current != track {
+					t.Error("the next track isn't the current one")
+				}
+			}
+			if next != tt.next {
+				t.Errorf("next is %q, want %q", next, tt.next)
+			}
+			if got := titles(vc.Queue); got != tt.queue {
+				t.Errorf("queue is %q, want %q", got, tt.queue)
+			}
+			if got := titles(vc.History); got != tt.history {
+				t.Errorf("history is %q, want %q", got, tt.history)
+			}
+			if vc.stopped != tt.stopped {
+				t.Errorf("stopped is %t, want %t", vc.stopped, tt.stopped)
+			}
+			if vc.paused {
+				t.Error("still paused")
+			}
+		})
+	}
+}
+
+func TestAdvanceWithNothingPlaying(t *testing.T) {
+	vc := &Connection{Queue: Tracks{{Title: "a"}}, Loop: LoopQueue}
+	if next := vc.advance(nil, endFinished); next == nil || next.Title != "a" {
+		t.Fatalf("advanced to %v, want a", next)
+	}
+	if len(vc.Queue) != 0 || len(vc.History) != 0 {
+		t.Errorf("queue %q and history %q, want both empty", titles(vc.Queue), titles(vc.History))
+	}
+}
+
+func TestSkipTo(t *testing.T) {
+	tests := []struct {
+		name  string
+		loop  LoopMode
+		to    int
+		next  string
+		queue string
+	}{
+		{"off", LoopOff, 2, "c", "d"},
+		{"off next", LoopOff, 0, "a", "b c d"},
+		{"track", LoopTrack, 2, "c", "d"},
+		{"queue", LoopQueue, 2, "c", "d x a b"},
+		{"queue next", LoopQueue, 0, "a", "b c d x"},
+		{"queue last", LoopQueue, 3, "d", "x a b c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &Track{Title: "x"}
+			vc := &Connection{
+				Queue:   Tracks{{Title: "a"}, {Title: "b"}, {Title: "c"}, {Title: "d"}},
+				Loop:    tt.loop,
+				current: x,
+			}
+
+			// Like music skipto, which then skips the current track
+			vc.skipTo(tt.to)
+			next := vc.advance(x, endSkipped)
+			if next == nil || next.Title != tt.next {
+				t.Fatalf("advanced to %v, want %s", next, tt.next)
+			}
+			if got := titles(vc.Queue); got != tt.queue {
+				t.Errorf("queue is %q, want %q", got, tt.queue)
+			}
+		})
+	}
+}
+
+func TestReplayLoopedQueue(t *testing.T) {
+	x := &Track{Title: "x"}
+	vc := &Connection{Queue: Tracks{{Title: "a"}}, Loop: LoopQueue, current: x}
+
+	// Like music replay, which queues the current track first and skips it
+	for i := 0; i < 3; i++ {
+		vc.Queue = append(Tracks{x}, vc.Queue...)
+		if next := vc.advance(x, endSkipped); next != x {
+			t.Fatalf("advanced to %v, want x again", next)
+		}
+	}
+	if got := titles(vc.Queue); got != "a" {
+		t.Errorf("queue is %q, want %q", got, "a")
+	}
+	vc.advance(x, endFinished)
+	if got := titles(vc.Queue); got != "x" {
+		t.Errorf("queue is %q, want %q", got, "x")
+	}
+}
+
+// byUsers makes a track for each name, added by the user named by its first
+// letter.
+func byUsers(names ...string) Tracks {
+	users := make(map[string]*dgofw.DiscordUser)
+	var tracks Tracks
+	for _, name := range names {
+		id := name[:1]
+		if users[id] == nil {
+			users[id] = dgofw.NewDiscordUser(nil, &discordgo.User{ID: id})
+		}
+		tracks = append(tracks, &Track{Title: name, AddedBy: users[id]})
+	}
+	return tracks
+}
+
+func TestFair(t *testing.T) {
+	tests := []struct {
+		name    string
+		queue   Tracks
+		current string
+		want    string
+	}{
+		{"nothing playing", byUsers("a1", "a2", "a3", "b1", "c1", "c2"), "", "a1 b1 c1 a2 c2 a3"},
+		{"first user playing", byUsers("a1", "a2", "a3", "b1", "c1", "c2"), "a0", "b1 c1 a1 c2 a2 a3"},
+		{"middle user playing", byUsers("a1", "a2", "a3", "b1", "c1", "c2"), "b0", "c1 a1 b1 c2 a2 a3"},
+		{"last user playing", byUsers("a1", "a2", "a3", "b1", "c1", "c2"), "c0", "a1 b1 c1 a2 c2 a3"},
+		{"other user playing", byUsers("a1", "a2", "b1"), "d0", "a1 b1 a2"},
+		{"one user", byUsers("a1", "a2", "a3"), "a0", "a1 a2 a3"},
+		{"interleaved", byUsers("b1", "a1", "b2", "b3", "a2"), "", "b1 a1 b2 a2 b3"},
+		{"no one added them", Tracks{{Title: "x"}, {Title: "y"}}, "", "x y"},
+		{"empty", nil, "a0", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var current *Track
+			if tt.current != "" {
+				current = byUsers(tt.current)[0]
+			}
+			if got := titles(tt.queue.fair(current)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	// Every order of three tracks should come up about as often
+	counts := make(map[string]int)
+	const runs = 6000
+	for i := 0; i < runs; i++ {
+		tracks := Tracks{{Title: "a"}, {Title: "b"}, {Title: "c"}}
+		tracks.shuffle()
+		counts[titles(tracks)]++
+	}
+	if len(counts) != 6 {
+		t.Fatalf("got the orders %v, want all 6", counts)
+	}
+	for order, n := range counts {
+		if n < runs/6*8/10 || n > runs/6*12/10 {
+			t.Errorf("%s came up %d times out of %d", order, n, runs)
+		}
+	}
+}
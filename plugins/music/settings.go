@@ -0,0 +1,227 @@
+package music
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Krognol/dgofw"
+)
+
+// defaultSkipVotes is the fraction of listeners that have to vote to skip a
+// track if the server hasn't set one.
+const defaultSkipVotes = 0.5
+
+type (
+	// GuildSettings are the music settings of a server.
+	GuildSettings struct {
+		ID string `json:"id"`
+		// SkipVotes is the fraction of listeners that have to vote to skip
+		SkipVotes float64 `json:"skip_votes"`
+		// DJRole is the ID of the role that can skip and stop without votes
+		DJRole string `json:"dj_role"`
+		// Volume in percent, from 0 to 200
+		Volume int `json:"volume"`
+		// IdleMinutes is how long the bot stays in voice with nothing to
+		// play, 0 is forever
+		IdleMinutes int `json:"idle_minutes"`
+		// EmptyMinutes is how long the bot stays in voice with nobody
+		// listening, 0 is forever
+		EmptyMinutes int `json:"empty_minutes"`
+		// Resume is what happens to the queue after a restart, one of the
+		// Resume modes
+		Resume string `json:"resume"`
+	}
+
+	Settings struct {
+		sync.RWMutex
+		Servers []*GuildSettings `json:"servers"`
+	}
+)
+
+func defaultSettings(guildID string) GuildSettings {
+	return GuildSettings{ID: guildID, SkipVotes: defaultSkipVotes, Volume: 100, IdleMinutes: 10, EmptyMinutes: 2, Resume: ResumeOff}
+}
+
+// UnmarshalJSON fills in the defaults of settings saved before they existed.
+func (gs *GuildSettings) UnmarshalJSON(b []byte) error {
+	type plain GuildSettings
+	p := plain(defaultSettings(""))
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*gs = GuildSettings(p)
+	return nil
+}
+
+func NewSettings() *Settings {
+	s := &Settings{}
+	if err := s.Load(); err != nil {
+		fmt.Println(err)
+		s.Save()
+	}
+	return s
+}
+
+// get returns the settings of a guild, the defaults if it has none.
+func (s *Settings) get(guildID string) GuildSettings {
+	s.RLock()
+	defer s.RUnlock()
+	for _, gs := range s.Servers {
+		if gs.ID == guildID {
+			return *gs
+		}
+	}
+	return defaultSettings(guildID)
+}
+
+// update changes the settings of a guild and saves them.
+func (s *Settings) update(guildID string, f func(*GuildSettings)) {
+	s.Lock()
+	var gs *GuildSettings
+	for _, g := range s.Servers {
+		if g.ID == guildID {
+			gs = g
+			break
+		}
+	}
+	if gs == nil {
+		def := defaultSettings(guildID)
+		gs = &def
+		s.Servers = append(s.Servers, gs)
+	}
+	f(gs)
+	s.Unlock()
+	s.Save()
+}
+
+var roleRegex = regexp.MustCompile(`^(?:<@&([0-9]+)>|([0-9]+))$`)
+
+// findRole returns the ID of a role given as a mention, an ID or a name.
+func findRole(m *dgofw.DiscordMessage, s string) string {
+	if match := roleRegex.FindStringSubmatch(s); match != nil {
+		return match[1] + match[2]
+	}
+	guild, err := m.Session().State.Guild(m.GuildID())
+	if err != nil {
+		return ""
+	}
+	for _, role := range guild.Roles {
+		if strings.EqualFold(role.Name, s) {
+			return role.ID
+		}
+	}
+	return ""
+}
+
+func (mp *MusicPlayer) onSettings(m *dgofw.DiscordMessage, args []string) {
+	if len(args) == 0 {
+		gs := mp.settings.get(m.GuildID())
+		dj := "none"
+		if gs.DJRole != "" {
+			dj = "<@&" + gs.DJRole + ">"
+		}
+		m.Reply(fmt.Sprintf("Skipping takes votes from %.0f%% of listeners. DJ role: %s. Volume: %d%%\nIdle timeout: %s. Empty channel timeout: %s. Resume after restart: %s",
+			gs.SkipVotes*100, dj, gs.Volume, minutes(gs.IdleMinutes), minutes(gs.EmptyMinutes), gs.Resume))
+		return
+	}
+	if !m.IsMod() {
+		return
+	}
+
+	value := strings.Join(args[1:], " ")
+	switch args[0] {
+	case "skipvotes":
+		percent := strings.HasSuffix(value, "%")
+		frac, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if percent || frac > 1 {
+			frac /= 100
+		}
+		if err != nil || frac <= 0 || frac > 1 {
+			m.Reply("Give a fraction of listeners like 0.5 or 50%")
+			return
+		}
+		mp.settings.update(m.GuildID(), func(gs *GuildSettings) {
+			gs.SkipVotes = frac
+		})
+		m.Reply(fmt.Sprintf("Skipping now takes votes from %.0f%% of listeners.", frac*100))
+	case "idle", "empty":
+		var n int
+		if value != "off" && value != "never" {
+			var err error
+			if n, err = strconv.Atoi(value); err != nil || n <= 0 {
+				m.Reply("Give a number of minutes, or off")
+				return
+			}
+		}
+		mp.settings.update(m.GuildID(), func(gs *GuildSettings) {
+			if args[0] == "idle" {
+				gs.IdleMinutes = n
+			} else {
+				gs.EmptyMinutes = n
+			}
+		})
+		m.Reply("Updated the timeout.")
+	case "resume":
+		switch value {
+		case ResumeOff, ResumeTrack, ResumePosition:
+		default:
+			m.Reply("Resume can be off, track or position")
+			return
+		}
+		mp.settings.update(m.GuildID(), func(gs *GuildSettings) {
+			gs.Resume = value
+		})
+		m.Reply("Resume after restart: " + value)
+	case "dj":
+		var role string
+		if value != "off" && value != "none" {
+			if role = findRole(m, value); role == "" {
+				m.Reply("No such role")
+				return
+			}
+		}
+		mp.settings.update(m.GuildID(), func(gs *GuildSettings) {
+			gs.DJRole = role
+		})
+		if role == "" {
+			m.Reply("Removed the DJ role.")
+		} else {
+			m.Reply("Set the DJ role.")
+		}
+	}
+}
+
+func minutes(n int) string {
+	if n <= 0 {
+		return "never"
+	}
+	if n == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", n)
+}
+
+func (s *Settings) Save() (err error) {
+	s.RLock()
+	defer s.RUnlock()
+	var f *os.File
+	if f, err = os.Create("./musicstate.json"); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(s)
+	}
+	return
+}
+
+func (s *Settings) Load() (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile("./musicstate.json"); err != nil {
+		return
+	}
+	return json.Unmarshal(b, s)
+}
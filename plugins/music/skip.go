@@ -0,0 +1,104 @@
+package music
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/Krognol/dgofw"
+)
+
+// listeners returns the IDs of the users listening in the bot's voice
+// channel. Deafened users and the bot don't count.
+func (mp *MusicPlayer) listeners(m *dgofw.DiscordMessage, vc *Connection) []string {
+	var self string
+	if u := m.Session().State.User; u != nil {
+		self = u.ID
+	}
+	var ids []string
+	for _, vs := range m.Guild().VoiceStates() {
+		if vs.ChannelID == vc.Channel && vs.UserID != self && !vs.Deaf && !vs.SelfDeaf {
+			ids = append(ids, vs.UserID)
+		}
+	}
+	return ids
+}
+
+// isDJ tells if the author of a message has the DJ role of the server.
+func (mp *MusicPlayer) isDJ(m *dgofw.DiscordMessage) bool {
+	role := mp.settings.get(m.GuildID()).DJRole
+	if role == "" {
+		return false
+	}
+	mem := m.Guild().Member(m.Author.ID())
+	if mem == nil {
+		return false
+	}
+	for _, r := range mem.Roles {
+		if r.ID == role {
+			return true
+		}
+	}
+	return false
+}
+
+// canControl tells if the author can skip and stop without votes.
+func (mp *MusicPlayer) canControl(m *dgofw.DiscordMessage) bool {
+	return m.IsMod() || mp.isDJ(m)
+}
+
+// voteSkip skips the current track right away for its requester, the DJ
+// and mods, and otherwise once enough listeners voted for it.
+func (mp *MusicPlayer) voteSkip(m *dgofw.DiscordMessage) {
+	vc, ok := mp.connection(m.GuildID())
+	if !ok {
+		return
+	}
+
+	vc.Lock()
+	track := vc.current
+	if track == nil {
+		vc.Unlock()
+		m.Reply("Nothing is playing.")
+		return
+	}
+	if (track.AddedBy != nil && track.AddedBy.ID() == m.Author.ID()) || mp.canControl(m) {
+		vc.Unlock()
+		vc.send(command{msg: Skip, track: track})
+		m.Reply(fmt.Sprintf("Skipped **%s**.", track.Title))
+		return
+	}
+
+	listeners := mp.listeners(m, vc)
+	listening := make(map[string]bool, len(listeners))
+	for _, id := range listeners {
+		listening[id] = true
+	}
+	if !listening[m.Author.ID()] {
+		vc.Unlock()
+		m.Reply("You have to be listening to vote.")
+		return
+	}
+
+	if vc.skipVotes == nil {
+		vc.skipVotes = make(map[string]bool)
+	}
+	vc.skipVotes[m.Author.ID()] = true
+	var votes int
+	for id := range vc.skipVotes {
+		if listening[id] {
+			votes++
+		}
+	}
+	needed := int(math.Ceil(mp.settings.get(m.GuildID()).SkipVotes * float64(len(listeners))))
+	if needed < 1 {
+		needed = 1
+	}
+	vc.Unlock()
+
+	if votes < needed {
+		m.Reply(fmt.Sprintf("Voted to skip **%s**, %d/%d votes.", track.Title, votes, needed))
+		return
+	}
+	vc.send(command{msg: Skip, track: track})
+	m.Reply(fmt.Sprintf("Skipped **%s**, %d/%d votes.", track.Title, votes, needed))
+}
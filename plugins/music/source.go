@@ -0,0 +1,215 @@
+package music
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// AudioSource finds tracks and streams their audio. The player only talks
+// to sources, it doesn't know how the audio is fetched or encoded.
+type AudioSource interface {
+	// Resolve returns the tracks a query refers to. Searches give one track,
+	// playlists can give many.
+	Resolve(query string) (Tracks, error)
+	// Open starts streaming a track resolved by the same source.
+	Open(track *Track, opts PlayOptions) (Stream, error)
+}
+
+// Stream is a stream of 20ms Opus frames, 48kHz stereo.
+type Stream interface {
+	// ReadFrame returns the next frame, or io.EOF at the end of the track.
+	ReadFrame() ([]byte, error)
+	Close() error
+}
+
+// SourceConfig picks the sources the player uses.
+type SourceConfig struct {
+	// Backend resolves everything that isn't a file or a direct audio link,
+	// "ytdlp" (default), "youtube-dl" or "none"
+	Backend string `json:"backend"`
+	// Binary is the path of the backend, defaults to its name
+	Binary string `json:"binary"`
+	// Encoder turns audio into Opus frames, "ffmpeg" (default) or "dca"
+	Encoder string `json:"encoder"`
+	// FFmpeg is the path of ffmpeg, defaults to "ffmpeg"
+	FFmpeg string `json:"ffmpeg"`
+	// Files is the directory local files are played from, empty turns
+	// local files off
+	Files string `json:"files"`
+}
+
+// NewSource creates the audio source described by cfg. The source picks
+// local files for "file:" queries, the HTTP source for links to audio files
+// and the backend for everything else.
+func NewSource(cfg SourceConfig) (AudioSource, error) {
+	var enc Encoder
+	switch cfg.Encoder {
+	case "", "ffmpeg":
+		enc = &FFmpegEncoder{Path: cfg.FFmpeg}
+	case "dca":
+		enc = &DCAEncoder{Path: "./dca"}
+	default:
+		return nil, fmt.Errorf("unknown encoder %q", cfg.Encoder)
+	}
+
+	router := &Router{HTTP: &HTTPSource{Encoder: enc}}
+	switch cfg.Backend {
+	case "", "ytdlp", "yt-dlp":
+		router.Backend = &YTDLSource{Path: orDefault(cfg.Binary, "yt-dlp"), Encoder: enc}
+	case "youtube-dl":
+		router.Backend = &YTDLSource{Path: orDefault(cfg.Binary, "youtube-dl"), Encoder: enc}
+	case "none":
+	default:
+		return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+	if cfg.Files != "" {
+		router.library = NewLibrary(cfg.Files)
+		router.Files = &FileSource{Dir: cfg.Files, Encoder: enc, Library: router.library}
+		go func() {
+			if err := router.library.Index(); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+	return router, nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// Router sends each query to the source that can handle it, and remembers
+// which source resolved a track so it can open it again.
+type Router struct {
+	Backend AudioSource
+	HTTP    AudioSource
+	Files   AudioSource
+
+	library *Library
+}
+
+// Library returns the index of the local files, or nil if they are off.
+func (r *Router) Library() *Library {
+	return r.library
+}
+
+func (r *Router) pick(query string) (AudioSource, string, error) {
+	switch {
+	case strings.HasPrefix(query, "file:"):
+		if r.Files == nil {
+			return nil, "", fmt.Errorf("local files are turned off")
+		}
+		return r.Files, "file", nil
+	case r.HTTP != nil && isAudioURL(query):
+		return r.HTTP, "http", nil
+	case r.Backend != nil:
+		return r.Backend, "backend", nil
+	}
+	return nil, "", fmt.Errorf("can't play that")
+}
+
+func (r *Router) source(name string) AudioSource {
+	switch name {
+	case "file":
+		return r.Files
+	case "http":
+		return r.HTTP
+	}
+	return r.Backend
+}
+
+func (r *Router) Resolve(query string) (Tracks, error) {
+	src, name, err := r.pick(query)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := src.Resolve(query)
+	for _, track := range tracks {
+		track.Source = name
+	}
+	return tracks, err
+}
+
+// ResolveEach is Resolve calling each with every track as it's resolved, for
+// sources that can do that.
+func (r *Router) ResolveEach(query string, each func(*Track)) error {
+	src, name, err := r.pick(query)
+	if err != nil {
+		return err
+	}
+	if s, ok := src.(interface {
+		ResolveEach(string, func(*Track)) error
+	}); ok {
+		return s.ResolveEach(query, func(track *Track) {
+			track.Source = name
+			each(track)
+		})
+	}
+
+	tracks, err := src.Resolve(query)
+	for _, track := range tracks {
+		track.Source = name
+		each(track)
+	}
+	return err
+}
+
+func (r *Router) Open(track *Track, opts PlayOptions) (Stream, error) {
+	src := r.source(track.Source)
+	if src == nil {
+		return nil, fmt.Errorf("can't play %s anymore", track.Title)
+	}
+	return src.Open(track, opts)
+}
+
+// FakeSource resolves every query to a track of Frames silent frames. It is
+// meant for tests, and for trying the player without any binaries.
+type FakeSource struct {
+	sync.Mutex
+	Frames int
+	// Opened counts the streams opened so far
+	Opened int
+}
+
+// silence is an Opus frame of silence
+var silence = []byte{0xf8, 0xff, 0xfe}
+
+func (f *FakeSource) Resolve(query string) (Tracks, error) {
+	f.Lock()
+	defer f.Unlock()
+	return Tracks{{
+		ID:       query,
+		Title:    query,
+		URL:      query,
+		Duration: f.Frames / 50,
+	}}, nil
+}
+
+func (f *FakeSource) Open(track *Track, opts PlayOptions) (Stream, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.Opened++
+	return &fakeStream{left: f.Frames - int(opts.Start/frameLength)}, nil
+}
+
+type fakeStream struct {
+	left int
+}
+
+func (s *fakeStream) ReadFrame() ([]byte, error) {
+	if s.left <= 0 {
+		return nil, io.EOF
+	}
+	s.left--
+	return silence, nil
+}
+
+func (s *fakeStream) Close() error {
+	s.left = 0
+	return nil
+}
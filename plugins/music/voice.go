@@ -0,0 +1,239 @@
+package music
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"github.com/Krognol/dgofw"
+)
+
+// Voice is a connection to a voice channel.
+type Voice interface {
+	// Frames takes the Opus frames to send
+	Frames() chan<- []byte
+	Speaking(speaking bool)
+	Leave()
+}
+
+type discordVoice struct {
+	*dgofw.DiscordVoiceConnection
+}
+
+func (v discordVoice) Frames() chan<- []byte {
+	return v.Send
+}
+
+// FakeVoice is a Voice that counts the frames sent to it instead of sending
+// them anywhere, for tests.
+type FakeVoice struct {
+	sync.Mutex
+	Sent       int
+	IsSpeaking bool
+	Left       bool
+
+	frames chan []byte
+}
+
+func NewFakeVoice() *FakeVoice {
+	v := &FakeVoice{frames: make(chan []byte)}
+	go func() {
+		for range v.frames {
+			v.Lock()
+			v.Sent++
+			v.Unlock()
+		}
+	}()
+	return v
+}
+
+func (v *FakeVoice) Frames() chan<- []byte {
+	return v.frames
+}
+
+func (v *FakeVoice) Speaking(speaking bool) {
+	v.Lock()
+	v.IsSpeaking = speaking
+	v.Unlock()
+}
+
+func (v *FakeVoice) Leave() {
+	v.Lock()
+	v.Left = true
+	v.Unlock()
+}
+
+// connection returns the voice connection of a guild.
+func (mp *MusicPlayer) connection(guildID string) (*Connection, bool) {
+	mp.Lock()
+	defer mp.Unlock()
+	vc, ok := mp.VoiceConnections[guildID]
+	return vc, ok
+}
+
+// leave disconnects from a voice channel and stops the player of the
+// connection.
+func (mp *MusicPlayer) leave(vc *Connection) {
+	mp.Lock()
+	if mp.VoiceConnections[vc.Guild] != vc {
+		mp.Unlock()
+		return
+	}
+	delete(mp.VoiceConnections, vc.Guild)
+	mp.Unlock()
+
+	// Cancelled first so a redial that's still dialing leaves again
+	vc.cancel()
+	vc.Lock()
+	if vc.emptyTimer != nil {
+		vc.emptyTimer.Stop()
+	}
+	conn := vc.conn
+	vc.Unlock()
+	conn.Leave()
+	if err := mp.SaveQueues(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// redial leaves the voice connection of vc and joins channel instead. The old
+// connection is closed first, Discord only allows one per guild.
+func (mp *MusicPlayer) redial(vc *Connection, channel string) {
+	vc.dialMu.Lock()
+	defer vc.dialMu.Unlock()
+	if vc.ctx.Err() != nil {
+		return
+	}
+
+	vc.Lock()
+	old := vc.conn
+	vc.Unlock()
+	old.Leave()
+
+	conn := mp.Dial(vc.Guild, channel)
+	vc.Lock()
+	if vc.ctx.Err() != nil {
+		// Left while dialing
+		vc.Unlock()
+		conn.Leave()
+		return
+	}
+	vc.conn = conn
+	vc.Channel = channel
+	close(vc.redialed)
+	vc.redialed = make(chan struct{})
+	vc.Unlock()
+}
+
+// notify posts a message in the channel the bot was summoned from.
+func (mp *MusicPlayer) notify(vc *Connection, text string) {
+	if vc.TextChannel != "" {
+		mp.discord.Send(vc.TextChannel, text)
+	}
+}
+
+// wakeUp tells a waiting player there may be something to play.
+func (vc *Connection) wakeUp() {
+	select {
+	case vc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// idleTimeout returns a channel that fires once the player has been idle
+// for as long as the server allows, or nil if it can idle forever.
+func (mp *MusicPlayer) idleTimeout(vc *Connection) (<-chan time.Time, func()) {
+	minutes := mp.settings.get(vc.Guild).IdleMinutes
+	if minutes <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTimer(time.Duration(minutes) * time.Minute)
+	return t.C, func() { t.Stop() }
+}
+
+// OnVoiceStateUpdate pauses the player when everyone leaves its channel and
+// leaves after a while if nobody comes back. It also follows the bot when
+// it's moved to another channel.
+func (mp *MusicPlayer) OnVoiceStateUpdate(s *discordgo.Session, e *discordgo.VoiceStateUpdate) {
+	vc, ok := mp.connection(e.GuildID)
+	if !ok {
+		return
+	}
+
+	if s.State.User != nil && e.UserID == s.State.User.ID {
+		if e.ChannelID == "" {
+			mp.leave(vc)
+			return
+		}
+		vc.Lock()
+		vc.Channel = e.ChannelID
+		vc.Unlock()
+	}
+
+	guild, err := s.State.Guild(e.GuildID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	vc.Lock()
+	var listeners int
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID == vc.Channel && (s.State.User == nil || vs.UserID != s.State.User.ID) {
+			listeners++
+		}
+	}
+
+	var pause, resume bool
+	track := vc.current
+	if listeners == 0 {
+		pause = vc.current != nil && !vc.paused
+		vc.autoPaused = vc.autoPaused || pause
+		if minutes := mp.settings.get(vc.Guild).EmptyMinutes; minutes > 0 && vc.emptyTimer == nil {
+			vc.emptyTimer = time.AfterFunc(time.Duration(minutes)*time.Minute, func() {
+				mp.notify(vc, "Left the voice channel, nobody was listening.")
+				mp.leave(vc)
+			})
+		}
+	} else {
+		resume = vc.autoPaused
+		vc.autoPaused = false
+		if vc.emptyTimer != nil {
+			vc.emptyTimer.Stop()
+			vc.emptyTimer = nil
+		}
+	}
+	vc.Unlock()
+
+	// Sent to the player directly, mp.control would take these for a user
+	// pausing
+	switch {
+	case pause:
+		if !vc.send(command{msg: Pause, track: track}) {
+			vc.Lock()
+			vc.autoPaused = false
+			vc.Unlock()
+		}
+	case resume:
+		vc.send(command{msg: Resume, track: track})
+	}
+}
+
+// OnResumed joins the voice channels again after the gateway connection is
+// resumed, since voice connections don't survive losing it.
+func (mp *MusicPlayer) OnResumed(s *discordgo.Session, e *discordgo.Resumed) {
+	mp.Lock()
+	conns := make([]*Connection, 0, len(mp.VoiceConnections))
+	for _, vc := range mp.VoiceConnections {
+		conns = append(conns, vc)
+	}
+	mp.Unlock()
+
+	for _, vc := range conns {
+		vc.Lock()
+		channel := vc.Channel
+		vc.Unlock()
+		mp.redial(vc, channel)
+	}
+}
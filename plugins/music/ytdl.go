@@ -0,0 +1,98 @@
+package music
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// YTDLSource resolves and downloads tracks with yt-dlp, or youtube-dl which
+// takes the same arguments.
+type YTDLSource struct {
+	Path    string
+	Encoder Encoder
+}
+
+// ytdlInfo is the part of the --dump-json output we use. yt-dlp gives the
+// duration as a float.
+type ytdlInfo struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Description string  `json:"description"`
+	FullTitle   string  `json:"fulltitle"`
+	Thumbnail   string  `json:"thumbnail"`
+	WebpageURL  string  `json:"webpage_url"`
+	URL         string  `json:"url"`
+	Duration    float64 `json:"duration"`
+}
+
+func isPlaylist(query string) bool {
+	return strings.Contains(query, "list=") || strings.Contains(query, "/playlist")
+}
+
+func (y *YTDLSource) Resolve(query string) (Tracks, error) {
+	var tracks Tracks
+	err := y.ResolveEach(query, func(track *Track) {
+		tracks = append(tracks, track)
+	})
+	return tracks, err
+}
+
+// ResolveEach calls each with every track as soon as it's resolved, which
+// can take a while for long playlists. Playlists are resolved without
+// fetching every video, so their tracks have less information.
+func (y *YTDLSource) ResolveEach(query string, each func(*Track)) error {
+	args := []string{"-i", "-j", "--no-warnings"}
+	if !strings.HasPrefix(query, "http://") && !strings.HasPrefix(query, "https://") {
+		query = "ytsearch:" + query
+	} else if isPlaylist(query) {
+		args = append(args, "--flat-playlist")
+	}
+	cmd := exec.Command(y.Path, append(args, query)...)
+	out, err := startReader(cmd)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var found bool
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var info ytdlInfo
+		if err = json.Unmarshal(scanner.Bytes(), &info); err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		url := info.WebpageURL
+		if url == "" && strings.HasPrefix(info.URL, "http") {
+			url = info.URL
+		}
+		if url == "" {
+			url = "https://youtube.com/watch?v=" + info.ID
+		}
+		track := newTrack(info.ID, info.Title, url, int(info.Duration), info.Thumbnail)
+		track.Description = info.Description
+		if info.FullTitle != "" {
+			track.FullTitle = info.FullTitle
+		}
+		found = true
+		each(track)
+	}
+	if !found {
+		return fmt.Errorf("nothing found")
+	}
+	return nil
+}
+
+func (y *YTDLSource) Open(track *Track, opts PlayOptions) (Stream, error) {
+	cmd := exec.Command(y.Path, "-q", "-f", "bestaudio", "-o", "-", track.URL)
+	out, err := startReader(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return y.Encoder.Encode(out, opts)
+}
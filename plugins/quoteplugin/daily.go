@@ -0,0 +1,262 @@
+package quoteplugin
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/Krognol/mountainbot/plugins/scheduler"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Daily posts a quote to a channel every day at the same time. The posts
+// are cron jobs of the scheduler, days the bot was offline are skipped.
+type Daily struct {
+	Channel string `json:"channel"`
+	Hour    int    `json:"hour"`
+	Minute  int    `json:"minute"`
+	Zone    string `json:"zone"`
+
+	// Recent are the ids of the latest daily quotes, newest last
+	Recent []int `json:"recent"`
+}
+
+// dailyJob is the data of the scheduler job posting a guild's daily quote.
+type dailyJob struct {
+	GuildID string `json:"guild_id"`
+}
+
+const (
+	dailyKind = "dailyquote"
+	maxRecent = 30
+)
+
+var channelRegex = regexp.MustCompile(`^<#([0-9]+)>$|^([0-9]+)$`)
+
+func parseChannel(s string) string {
+	match := channelRegex.FindStringSubmatch(s)
+	if match == nil {
+		return ""
+	}
+	if match[1] != "" {
+		return match[1]
+	}
+	return match[2]
+}
+
+func (d *Daily) cron() string {
+	return fmt.Sprintf("%d %d * * *", d.Minute, d.Hour)
+}
+
+// pick chooses a random quote that wasn't posted recently. It must be called
+// with the lock held.
+func (d *Daily) pick(quotes []*Quote) *Quote {
+	if len(quotes) == 0 {
+		return nil
+	}
+
+	// Never rule out more than half the quotes, or small servers run dry
+	recent := d.Recent
+	if limit := len(quotes) / 2; len(recent) > limit {
+		recent = recent[len(recent)-limit:]
+	}
+	skip := make(map[int]bool)
+	for _, id := range recent {
+		skip[id] = true
+	}
+
+	var candidates []*Quote
+	for _, quote := range quotes {
+		if !skip[quote.ID] {
+			candidates = append(candidates, quote)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = quotes
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// dailyJobs returns the daily quote jobs by guild.
+func (q *Quotes) dailyJobs() map[string]scheduler.Job {
+	jobs := make(map[string]scheduler.Job)
+	for _, job := range q.sched.Jobs(dailyKind) {
+		var data dailyJob
+		if err := job.Decode(&data); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		jobs[data.GuildID] = job
+	}
+	return jobs
+}
+
+// schedule replaces the daily quote job of a guild, a nil d only removes it.
+func (q *Quotes) schedule(guildID string, d *Daily) error {
+	if job, ok := q.dailyJobs()[guildID]; ok {
+		q.sched.Cancel(job.ID)
+	}
+	if d == nil {
+		return nil
+	}
+	_, err := q.sched.Cron(dailyKind, d.cron(), d.Zone, scheduler.Skip, dailyJob{guildID})
+	return err
+}
+
+// syncDaily makes sure every server with a daily quote has a job with its
+// time and no other server does. Servers set up before the daily quotes
+// were scheduled get their job here.
+func (q *Quotes) syncDaily() {
+	q.Lock()
+	defer q.Unlock()
+	jobs := q.dailyJobs()
+	for _, srv := range q.Servers {
+		d := srv.Daily
+		if d != nil && d.Channel == "" {
+			d = nil
+		}
+		job, ok := jobs[srv.ID]
+		delete(jobs, srv.ID)
+		if ok && d != nil && job.Cron == d.cron() && job.Zone == d.Zone {
+			continue
+		}
+		if !ok && d == nil {
+			continue
+		}
+		if err := q.schedule(srv.ID, d); err != nil {
+			fmt.Println(err)
+		}
+	}
+	for _, job := range jobs {
+		q.sched.Cancel(job.ID)
+	}
+}
+
+// postDaily posts the daily quote of the guild of a job.
+func (q *Quotes) postDaily(job scheduler.Job) {
+	var data dailyJob
+	if err := job.Decode(&data); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	q.Lock()
+	srv := q.getServer(data.GuildID)
+	if srv == nil || srv.Daily == nil || srv.Daily.Channel == "" {
+		q.Unlock()
+		return
+	}
+	d := srv.Daily
+	quote := d.pick(srv.Quotes)
+	if quote == nil {
+		q.Unlock()
+		return
+	}
+	d.Recent = append(d.Recent, quote.ID)
+	if len(d.Recent) > maxRecent {
+		d.Recent = d.Recent[len(d.Recent)-maxRecent:]
+	}
+	c, channel := *quote, d.Channel
+	q.Unlock()
+
+	q.Save()
+	_, err := q.discord.Session().ChannelMessageSendComplex(channel, &discordgo.MessageSend{
+		Content: "**Quote of the day**",
+		Embeds:  []*discordgo.MessageEmbed{quoteEmbed(&c)},
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (q *Quotes) daily(m *dgofw.DiscordMessage, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		q.RLock()
+		var reply string
+		if s := q.getServer(m.GuildID()); s != nil && s.Daily != nil {
+			reply = fmt.Sprintf("Posting a quote to <#%s> every day at %02d:%02d %s", s.Daily.Channel, s.Daily.Hour, s.Daily.Minute, s.Daily.Zone)
+		} else {
+			reply = "The quote of the day is off."
+		}
+		q.RUnlock()
+		m.Reply(reply)
+		return
+	}
+	if !m.IsMod() {
+		return
+	}
+
+	switch fields[0] {
+	case "off":
+		q.Lock()
+		if s := q.getServer(m.GuildID()); s != nil {
+			s.Daily = nil
+		}
+		err := q.schedule(m.GuildID(), nil)
+		q.Unlock()
+		if err != nil {
+			fmt.Println(err)
+		}
+		q.Save()
+		m.Reply("Turned off the quote of the day")
+	case "set":
+		if len(fields) < 3 {
+			m.Reply("Use 'quote daily set #channel 09:00 Europe/Stockholm'")
+			return
+		}
+		channel := parseChannel(fields[1])
+		if channel == "" {
+			m.Reply("Invalid channel")
+			return
+		}
+		if !discordutil.ChannelInGuild(m.Session(), channel, m.GuildID()) {
+			m.Reply("That channel isn't in this server.")
+			return
+		}
+		t, err := time.Parse("15:04", fields[2])
+		if err != nil {
+			m.Reply("Times look like 09:00")
+			return
+		}
+		zone := "UTC"
+		if len(fields) > 3 {
+			zone = fields[3]
+		}
+		if _, err = time.LoadLocation(zone); err != nil {
+			m.Reply("Unknown timezone " + zone + ", use names like Europe/Stockholm")
+			return
+		}
+
+		d := &Daily{
+			Channel: channel,
+			Hour:    t.Hour(),
+			Minute:  t.Minute(),
+			Zone:    zone,
+		}
+
+		q.Lock()
+		if err = q.schedule(m.GuildID(), d); err != nil {
+			q.Unlock()
+			fmt.Println(err)
+			m.Reply("Couldn't schedule the quote of the day: " + err.Error())
+			return
+		}
+		s := q.getServer(m.GuildID())
+		if s == nil {
+			s = &Server{ID: m.GuildID(), NextID: 1, Quotes: make([]*Quote, 0)}
+			q.Servers = append(q.Servers, s)
+		}
+		if s.Daily != nil {
+			d.Recent = s.Daily.Recent
+		}
+		s.Daily = d
+		q.Unlock()
+		q.Save()
+		m.Reply(fmt.Sprintf("Posting a quote to <#%s> every day at %02d:%02d %s", channel, d.Hour, d.Minute, zone))
+	}
+}
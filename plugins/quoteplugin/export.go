@@ -0,0 +1,317 @@
+package quoteplugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/google/go-github/github"
+)
+
+// Exporter publishes an export of a server's quotes. The default sends it
+// as an attachment, the gist exporter uploads it to GitHub instead.
+type Exporter interface {
+	Export(m *dgofw.DiscordMessage, name string, data []byte) error
+}
+
+type attachmentExporter struct{}
+
+func (attachmentExporter) Export(m *dgofw.DiscordMessage, name string, data []byte) error {
+	m.ReplyFile(name, bytes.NewReader(data))
+	return nil
+}
+
+// GistExporter uploads exports as secret gists of the token's account.
+type GistExporter struct {
+	client *github.Client
+}
+
+type tokenTransport string
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "token "+string(t))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func NewGistExporter(token string) *GistExporter {
+	return &GistExporter{client: github.NewClient(&http.Client{Transport: tokenTransport(token)})}
+}
+
+func (g *GistExporter) Export(m *dgofw.DiscordMessage, name string, data []byte) error {
+	content := string(data)
+	pub := false
+	files := make(map[github.GistFilename]github.GistFile)
+	files[github.GistFilename(name)] = github.GistFile{
+		Content: &content,
+	}
+	gist, _, err := g.client.Gists.Create(context.Background(), &github.Gist{
+		Public: &pub,
+		Files:  files,
+	})
+	if err != nil {
+		return err
+	}
+	m.Reply(*gist.HTMLURL)
+	return nil
+}
+
+// Import and export formats
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+	formatText = "text"
+)
+
+var (
+	csvHeader  = []string{"id", "content", "author_id", "author_name", "author_avatar", "added_by", "time", "added_at", "link"}
+	textPrefix = regexp.MustCompile(`^([0-9]+)\. `)
+)
+
+func formatOf(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return formatJSON
+	case ".csv":
+		return formatCSV
+	case ".txt":
+		return formatText
+	}
+	return ""
+}
+
+func extension(format string) string {
+	if format == formatText {
+		return "txt"
+	}
+	return format
+}
+
+func encodeQuotes(format string, quotes []*Quote) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(quotes); err != nil {
+			return nil, err
+		}
+	case formatCSV:
+		w := csv.NewWriter(&buf)
+		w.Write(csvHeader)
+		for _, q := range quotes {
+			w.Write([]string{
+				strconv.Itoa(q.ID),
+				q.Content,
+				q.AuthorID,
+				q.AuthorName,
+				q.AuthorAvatar,
+				q.AddedBy,
+				q.Time.Format(time.RFC3339),
+				q.AddedAt.Format(time.RFC3339),
+				q.Link,
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	case formatText:
+		for _, q := range quotes {
+			buf.WriteString(fmt.Sprintf("%d. %s\n", q.ID, strings.Replace(q.String(), "\n", " ", -1)))
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %s, use json, csv or text", format)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeQuotes reads quotes in any of the export formats. Plain text only
+// keeps the content and id of each line.
+func decodeQuotes(format string, r io.Reader) ([]*Quote, error) {
+	quotes := []*Quote{}
+	switch format {
+	case formatJSON:
+		if err := json.NewDecoder(r).Decode(&quotes); err != nil {
+			return nil, err
+		}
+	case formatCSV:
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 && records[0][0] == csvHeader[0] {
+			records = records[1:]
+		}
+		for i, rec := range records {
+			if len(rec) != len(csvHeader) {
+				return nil, fmt.Errorf("line %d has %d columns, expected %d", i+2, len(rec), len(csvHeader))
+			}
+			q := &Quote{
+				Content:      rec[1],
+				AuthorID:     rec[2],
+				AuthorName:   rec[3],
+				AuthorAvatar: rec[4],
+				AddedBy:      rec[5],
+				Link:         rec[8],
+			}
+			q.ID, _ = strconv.Atoi(rec[0])
+			q.Time, _ = time.Parse(time.RFC3339, rec[6])
+			q.AddedAt, _ = time.Parse(time.RFC3339, rec[7])
+			quotes = append(quotes, q)
+		}
+	case formatText:
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			q := &Quote{}
+			if match := textPrefix.FindStringSubmatch(line); match != nil {
+				q.ID, _ = strconv.Atoi(match[1])
+				line = line[len(match[0]):]
+			}
+			q.Content = line
+			quotes = append(quotes, q)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format, use a .json, .csv or .txt file")
+	}
+
+	for _, q := range quotes {
+		if q == nil || strings.TrimSpace(q.Content) == "" {
+			return nil, fmt.Errorf("quotes can't be empty")
+		}
+	}
+	return quotes, nil
+}
+
+func (q *Quotes) export(m *dgofw.DiscordMessage, format string) {
+	if format == "" {
+		format = formatJSON
+	}
+
+	q.RLock()
+	var quotes []*Quote
+	if s := q.getServer(m.GuildID()); s != nil {
+		quotes = append(quotes, s.Quotes...)
+	}
+	data, err := encodeQuotes(format, quotes)
+	q.RUnlock()
+
+	if err != nil {
+		m.Reply(err.Error())
+		return
+	}
+	if len(quotes) == 0 {
+		m.Reply("There are no quotes!")
+		return
+	}
+	if err = q.Exporter.Export(m, "quotes."+extension(format), data); err != nil {
+		fmt.Println(err)
+		m.Reply("Failed to export the quotes.\n" + err.Error())
+	}
+}
+
+// importQuotes merges the quotes in the attached file into the server's
+// quotes, or replaces them. Merged quotes get new ids and duplicates are
+// skipped, replacing keeps the ids in the file where they don't collide.
+func (q *Quotes) importQuotes(m *dgofw.DiscordMessage, mode string) {
+	if !m.IsMod() {
+		return
+	}
+	if mode != "merge" && mode != "replace" {
+		m.Reply("Use 'quote import merge' or 'quote import replace' with the file attached.")
+		return
+	}
+
+	msg, err := m.Session().ChannelMessage(m.ChannelID(), m.ID())
+	if err != nil || len(msg.Attachments) == 0 {
+		m.Reply("Attach a .json, .csv or .txt file to import.")
+		return
+	}
+	file := msg.Attachments[0]
+	format := formatOf(file.Filename)
+	if format == "" {
+		m.Reply("Attach a .json, .csv or .txt file to import.")
+		return
+	}
+
+	res, err := discordutil.GetAttachment(file.URL)
+	if err != nil {
+		m.Reply("Couldn't import the file: " + err.Error())
+		return
+	}
+	defer res.Body.Close()
+	imported, err := decodeQuotes(format, io.LimitReader(res.Body, 8<<20))
+	if err != nil {
+		m.Reply("Couldn't read the file: " + err.Error())
+		return
+	}
+
+	q.Lock()
+	s := q.getServer(m.GuildID())
+	if s == nil {
+		s = &Server{ID: m.GuildID(), NextID: 1}
+		q.Servers = append(q.Servers, s)
+	}
+
+	var added int
+	if mode == "replace" {
+		s.Quotes = make([]*Quote, 0, len(imported))
+		used := make(map[int]bool)
+		for _, quote := range imported {
+			if quote.ID >= s.NextID {
+				s.NextID = quote.ID + 1
+			}
+		}
+		for _, quote := range imported {
+			if quote.ID <= 0 || used[quote.ID] {
+				quote.ID = s.NextID
+				s.NextID++
+			}
+			used[quote.ID] = true
+			s.Quotes = append(s.Quotes, quote)
+		}
+		added = len(imported)
+	} else {
+		seen := make(map[string]bool)
+		for _, quote := range s.Quotes {
+			seen[quote.AuthorID+"\x00"+quote.Content] = true
+		}
+		for _, quote := range imported {
+			k := quote.AuthorID + "\x00" + quote.Content
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			quote.ID = s.NextID
+			s.NextID++
+			s.Quotes = append(s.Quotes, quote)
+			added++
+		}
+	}
+	q.Unlock()
+	q.Save()
+
+	if mode == "replace" {
+		m.Reply(fmt.Sprintf("Replaced the quotes with %d imported quotes.", added))
+	} else {
+		m.Reply(fmt.Sprintf("Imported %d quotes, skipped %d duplicates.", added, len(imported)-added))
+	}
+}
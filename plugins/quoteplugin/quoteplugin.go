@@ -1,11 +1,14 @@
 package quoteplugin
 
 import (
+	"bytes"
 	"io/ioutil"
 	"math/rand"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"fmt"
 
@@ -14,37 +17,95 @@ import (
 	"encoding/json"
 
 	"github.com/Krognol/dgofw"
-	"github.com/google/go-github/github"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/Krognol/mountainbot/plugins/scheduler"
+	"github.com/bwmarrin/discordgo"
 )
 
+// Quote is something a member said. Quotes added as plain text only have
+// Content, AddedBy and AddedAt.
+type Quote struct {
+	ID           int       `json:"id"`
+	Content      string    `json:"content"`
+	AuthorID     string    `json:"author_id,omitempty"`
+	AuthorName   string    `json:"author_name,omitempty"`
+	AuthorAvatar string    `json:"author_avatar,omitempty"`
+	AddedBy      string    `json:"added_by,omitempty"`
+	Time         time.Time `json:"time"`
+	AddedAt      time.Time `json:"added_at"`
+	Link         string    `json:"link,omitempty"`
+}
+
+// Server holds the quotes of a guild. Quote ids are never reused, NextID is
+// the id the next quote gets.
 type Server struct {
 	ID     string   `json:"id"`
-	Quotes []string `json:"quotes"`
+	NextID int      `json:"next_id"`
+	Quotes []*Quote `json:"quotes"`
+	Daily  *Daily   `json:"daily,omitempty"`
 }
 
 type Quotes struct {
 	sync.RWMutex
 	Servers []*Server `json:"servers"`
+
+	// Exporter publishes exports, by default as an attachment
+	Exporter Exporter `json:"-"`
+
+	discord *dgofw.DiscordClient
+	sched   *scheduler.Scheduler
 }
 
-func NewQuotePlugin() *Quotes {
-	plugin := &Quotes{Servers: make([]*Server, 0)}
+func NewQuotePlugin(discord *dgofw.DiscordClient, sched *scheduler.Scheduler) *Quotes {
+	plugin := &Quotes{
+		Servers:  make([]*Server, 0),
+		Exporter: attachmentExporter{},
+		discord:  discord,
+		sched:    sched,
+	}
 	err := plugin.Load()
 	if err != nil {
 		fmt.Println(err.Error())
 		plugin.Save()
 	}
+	sched.Handle(dailyKind, plugin.postDaily)
+	plugin.syncDaily()
 	return plugin
 }
 
 var QuotesHelp = []string{
 	"quote  -- returns a random quote",
-	"quote [index] -- returns a quote",
+	"quote [id] -- returns a quote",
 	"quote add [quote] -- adds a quote",
-	"quote del [id] -- deletes a quote with the given id, e.g. 163",
-	"quote list -- creates a gist with every quote",
+	"quote add [message id|message link] -- quotes a message, or reply to a message with 'quote add'",
+	"quote del [id] -- deletes a quote with the given id, e.g. 163. Only usable by mods and whoever added it",
+	"quote search [text] -- finds quotes containing the text",
+	"quote by [@user] -- lists the quotes of a user",
+	"quote random [@user] -- returns a random quote of a user",
+	"quote count -- how many quotes there are",
+	"quote daily -- shows when the quote of the day is posted",
+	"quote daily set [#channel] [09:00] [Europe/Stockholm] -- posts a quote every day. Mod only",
+	"quote daily off -- stops the quote of the day. Mod only",
+	"quote export [json|csv|text] -- exports every quote, json by default",
+	"quote list -- exports every quote as text",
+	"quote import [merge|replace] -- imports an attached .json, .csv or .txt export. Mod only",
+}
+
+var (
+	linkRegex = regexp.MustCompile(`^<?https://(?:\w+\.)?discord(?:app)?\.com/channels/([0-9]+)/([0-9]+)/([0-9]+)>?$`)
+	idRegex   = regexp.MustCompile(`^[0-9]{15,}$`)
+)
+
+// UnmarshalJSON also reads quotes saved as plain strings.
+func (qt *Quote) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &qt.Content)
+	}
+	type quote Quote
+	return json.Unmarshal(b, (*quote)(qt))
 }
 
+// getServer must be called with the lock held.
 func (q *Quotes) getServer(id string) *Server {
 	for _, s := range q.Servers {
 		if s.ID == id {
@@ -54,110 +115,395 @@ func (q *Quotes) getServer(id string) *Server {
 	return nil
 }
 
+// find must be called with the lock held.
+func (s *Server) find(id int) (int, *Quote) {
+	if s == nil {
+		return -1, nil
+	}
+	for i, quote := range s.Quotes {
+		if quote.ID == id {
+			return i, quote
+		}
+	}
+	return -1, nil
+}
+
+// filter returns the quotes for which f is true. It must be called with
+// the lock held.
+func (s *Server) filter(f func(*Quote) bool) []*Quote {
+	result := []*Quote{}
+	if s == nil {
+		return result
+	}
+	for _, quote := range s.Quotes {
+		if f(quote) {
+			result = append(result, quote)
+		}
+	}
+	return result
+}
+
+func jumpLink(guildID, channelID, messageID string) string {
+	return "https://discord.com/channels/" + guildID + "/" + channelID + "/" + messageID
+}
+
+// source finds the message to quote: the message linked or given by id in
+// arg, or the message m replies to. It returns nil if arg is plain text.
+func source(m *dgofw.DiscordMessage, arg string) (*discordgo.Message, error) {
+	s := m.Session()
+	switch {
+	case arg == "":
+		msg, err := s.ChannelMessage(m.ChannelID(), m.ID())
+		if err != nil {
+			return nil, err
+		}
+		if msg.ReferencedMessage != nil {
+			return msg.ReferencedMessage, nil
+		}
+		if msg.MessageReference == nil {
+			return nil, fmt.Errorf("reply to a message, or give me a message id or link")
+		}
+		return s.ChannelMessage(msg.MessageReference.ChannelID, msg.MessageReference.MessageID)
+	case idRegex.MatchString(arg):
+		return s.ChannelMessage(m.ChannelID(), arg)
+	}
+
+	match := linkRegex.FindStringSubmatch(arg)
+	if match == nil {
+		return nil, nil
+	}
+	if match[1] != m.GuildID() {
+		return nil, fmt.Errorf("that message is in another server")
+	}
+	return s.ChannelMessage(match[2], match[3])
+}
+
 func (q *Quotes) addQuote(m *dgofw.DiscordMessage) {
-	if quote := m.Arg("arg2"); quote != "" {
-		s := q.getServer(m.GuildID())
-		if s == nil {
-			s = &Server{
-				ID:     m.GuildID(),
-				Quotes: make([]string, 0),
-			}
+	arg := strings.TrimSpace(m.Arg("arg2"))
+	msg, err := source(m, arg)
+	if err != nil {
+		m.Reply("Couldn't find that message: " + err.Error())
+		return
+	}
+
+	quote := &Quote{
+		Content: arg,
+		AddedBy: m.Author.ID(),
+		Time:    time.Now(),
+		AddedAt: time.Now(),
+	}
+	if msg != nil {
+		if msg.Content == "" {
+			m.Reply("That message has nothing to quote.")
+			return
+		}
+		quote.Content = msg.Content
+		quote.AuthorID = msg.Author.ID
+		quote.AuthorName = msg.Author.Username
+		quote.AuthorAvatar = msg.Author.AvatarURL("")
+		quote.Time = msg.Timestamp
+		quote.Link = jumpLink(m.GuildID(), msg.ChannelID, msg.ID)
+	}
+
+	q.Lock()
+	s := q.getServer(m.GuildID())
+	if s == nil {
+		s = &Server{
+			ID:     m.GuildID(),
+			NextID: 1,
+			Quotes: make([]*Quote, 0),
 		}
-		q.Lock()
-		s.Quotes = append(s.Quotes, quote)
 		q.Servers = append(q.Servers, s)
+	}
+	quote.ID = s.NextID
+	s.NextID++
+	s.Quotes = append(s.Quotes, quote)
+	q.Unlock()
+	q.Save()
+	m.Reply(fmt.Sprintf("Added quote #%d", quote.ID))
+}
+
+func quoteEmbed(quote *Quote) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Description: quote.Content,
+		Color:       0x7289da,
+		Footer:      &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("#%d", quote.ID)},
+	}
+	if quote.AuthorName != "" {
+		embed.Author = &discordgo.MessageEmbedAuthor{
+			Name:    quote.AuthorName,
+			IconURL: quote.AuthorAvatar,
+		}
+	}
+	if quote.AddedBy != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "Added by",
+			Value: "<@" + quote.AddedBy + ">",
+		})
+	}
+	if !quote.Time.IsZero() {
+		embed.Timestamp = quote.Time.Format(time.RFC3339)
+	}
+	if quote.Link != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "Source",
+			Value: "[Jump!](" + quote.Link + ")",
+		})
+	}
+	return embed
+}
+
+func (qt *Quote) String() string {
+	if qt.AuthorName == "" {
+		return qt.Content
+	}
+	return "\"" + qt.Content + "\" -- " + qt.AuthorName
+}
+
+func (q *Quotes) delQuote(m *dgofw.DiscordMessage, id int) {
+	q.Lock()
+	s := q.getServer(m.GuildID())
+	i, quote := s.find(id)
+	if quote == nil {
 		q.Unlock()
-		q.Save()
-		m.Reply(fmt.Sprintf("Added quote #%d", len(s.Quotes)))
+		m.Reply(fmt.Sprintf("There is no quote #%d", id))
+		return
 	}
+	if !m.IsMod() && m.Author.ID() != quote.AddedBy {
+		q.Unlock()
+		m.Reply("Only mods and whoever added a quote can delete it.")
+		return
+	}
+	s.Quotes = append(s.Quotes[:i], s.Quotes[i+1:]...)
+	q.Unlock()
+	q.Save()
+	m.Reply(fmt.Sprintf("Deleted quote #%d", id))
 }
 
-func (q *Quotes) delQuote(m *dgofw.DiscordMessage, index int) {
-	if s := q.getServer(m.GuildID()); s != nil {
-		if index > 0 && index < len(s.Quotes) {
-			if len(s.Quotes) == 1 {
-				s.Quotes = s.Quotes[1:]
-				return
-			}
+func (q *Quotes) showQuote(m *dgofw.DiscordMessage, id int) {
+	q.RLock()
+	_, quote := q.getServer(m.GuildID()).find(id)
+	q.RUnlock()
 
-			q.Lock()
-			s.Quotes = append(s.Quotes[:index], s.Quotes[index+1:]...)
-			q.Unlock()
-			q.Save()
-		}
+	if quote == nil {
+		m.Reply(fmt.Sprintf("There is no quote #%d", id))
+		return
 	}
+	m.ReplyEmbed(quoteEmbed(quote))
 }
 
-func (q *Quotes) sendList(m *dgofw.DiscordMessage) {
-	if s := q.getServer(m.GuildID()); s != nil {
-		content := strings.Join(s.Quotes, "\n")
-		gc := github.NewClient(nil)
+func (q *Quotes) randomQuote(m *dgofw.DiscordMessage, user string) {
+	userID := discordutil.ParseUserID(user)
+	if user != "" && userID == "" {
+		m.Reply("Who?")
+		return
+	}
 
-		id := "quotes"
-		pub := true
-		files := make(map[github.GistFilename]github.GistFile)
-		files[github.GistFilename("quotes.txt")] = github.GistFile{
-			Content: &content,
-		}
-		gist := &github.Gist{
-			ID:     &id,
-			Public: &pub,
-			Files:  files,
+	q.RLock()
+	quotes := q.getServer(m.GuildID()).filter(func(quote *Quote) bool {
+		return userID == "" || quote.AuthorID == userID
+	})
+	q.RUnlock()
+
+	if len(quotes) == 0 {
+		m.Reply("There are no quotes!")
+		return
+	}
+	m.ReplyEmbed(quoteEmbed(quotes[rand.Intn(len(quotes))]))
+}
+
+func short(s string) string {
+	s = strings.Replace(s, "\n", " ", -1)
+	if r := []rune(s); len(r) > 80 {
+		return string(r[:77]) + "..."
+	}
+	return s
+}
+
+func replyList(m *dgofw.DiscordMessage, title string, quotes []*Quote) {
+	if len(quotes) == 0 {
+		m.Reply("No quotes found.")
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("**%s** (%d)\n", title, len(quotes)))
+	for i, quote := range quotes {
+		if i == 15 {
+			buf.WriteString(fmt.Sprintf("...and %d more", len(quotes)-i))
+			break
 		}
-		g, _, err := gc.Gists.Create(nil, gist)
-		if err != nil {
-			m.Reply("Failed to create gist.\n" + err.Error())
-			return
+		buf.WriteString(fmt.Sprintf("`#%d` %s\n", quote.ID, short(quote.String())))
+	}
+	m.Reply(buf.String())
+}
+
+func (q *Quotes) searchQuotes(m *dgofw.DiscordMessage, text string) {
+	text = strings.ToLower(text)
+	q.RLock()
+	quotes := q.getServer(m.GuildID()).filter(func(quote *Quote) bool {
+		return strings.Contains(strings.ToLower(quote.Content), text) ||
+			strings.Contains(strings.ToLower(quote.AuthorName), text)
+	})
+	q.RUnlock()
+	replyList(m, "Quotes matching '"+text+"'", quotes)
+}
+
+func (q *Quotes) quotesBy(m *dgofw.DiscordMessage, user string) {
+	userID := discordutil.ParseUserID(user)
+	if userID == "" {
+		m.Reply("Who?")
+		return
+	}
+
+	q.RLock()
+	quotes := q.getServer(m.GuildID()).filter(func(quote *Quote) bool {
+		return quote.AuthorID == userID
+	})
+	q.RUnlock()
+	replyList(m, "Quotes by "+user, quotes)
+}
+
+func (q *Quotes) count(m *dgofw.DiscordMessage) {
+	q.RLock()
+	var n int
+	authors := make(map[string]bool)
+	if s := q.getServer(m.GuildID()); s != nil {
+		n = len(s.Quotes)
+		for _, quote := range s.Quotes {
+			if quote.AuthorID != "" {
+				authors[quote.AuthorID] = true
+			}
 		}
-		m.Reply(*g.HTMLURL)
 	}
+	q.RUnlock()
+	m.Reply(fmt.Sprintf("There are %d quotes from %d members.", n, len(authors)))
 }
 
 func (q *Quotes) OnMessage(m *dgofw.DiscordMessage) {
-	arg1 := m.Arg("arg1")
+	arg1, arg2 := m.Arg("arg1"), strings.TrimSpace(m.Arg("arg2"))
 	switch arg1 {
 	case "add":
 		q.addQuote(m)
 	case "del":
-		index := m.Arg("arg2")
-		if i, err := strconv.ParseInt(index, 10, 64); err == nil {
-			q.delQuote(m, int(i))
+		if i, err := strconv.Atoi(strings.TrimPrefix(arg2, "#")); err == nil {
+			q.delQuote(m, i)
 		} else {
 			m.Reply("Invalid number")
 		}
+	case "export":
+		q.export(m, arg2)
 	case "list":
-		q.sendList(m)
-	case "":
-		if s := q.getServer(m.GuildID()); s != nil {
-			index := rand.Intn(len(s.Quotes))
-			m.Reply(fmt.Sprintf("%d. %s", index, s.Quotes[index]))
-		} else {
-			m.Reply("There are no quotes!")
+		q.export(m, formatText)
+	case "import":
+		q.importQuotes(m, arg2)
+	case "search":
+		if arg2 != "" {
+			q.searchQuotes(m, arg2)
 		}
+	case "by":
+		q.quotesBy(m, arg2)
+	case "random", "":
+		q.randomQuote(m, arg2)
+	case "count":
+		q.count(m)
+	case "daily":
+		q.daily(m, arg2)
 	default:
-		if i, err := strconv.ParseInt(m.Arg("arg2"), 10, 64); err == nil {
-			if s := q.getServer(m.GuildID()); s != nil {
-				if i > 0 && int(i) < len(s.Quotes) {
-					m.Reply(s.Quotes[i])
-				}
-			}
+		if i, err := strconv.Atoi(strings.TrimPrefix(arg1, "#")); err == nil {
+			q.showQuote(m, i)
 		}
 	}
 }
 
 func (q *Quotes) Save() (err error) {
+	q.RLock()
+	defer q.RUnlock()
 	var f *os.File
-	defer f.Close()
 	if f, err = os.Create("./quotesstate.json"); err == nil {
+		defer f.Close()
 		return json.NewEncoder(f).Encode(q)
 	}
 	return
 }
 
+// Load reads the quotes, merges servers saved more than once and gives ids
+// to quotes saved before quotes had them in the order they were added.
 func (p *Quotes) Load() (err error) {
 	var b []byte
-	if b, err = ioutil.ReadFile("./quotesstate.json"); err == nil {
-		return json.Unmarshal(b, p)
+	if b, err = ioutil.ReadFile("./quotesstate.json"); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, p); err != nil {
+		return
+	}
+	p.Servers = mergeServers(p.Servers)
+	for _, s := range p.Servers {
+		if s.NextID == 0 {
+			s.NextID = 1
+		}
+		for _, quote := range s.Quotes {
+			if quote.ID >= s.NextID {
+				s.NextID = quote.ID + 1
+			}
+		}
+		for _, quote := range s.Quotes {
+			if quote.ID == 0 {
+				quote.ID = s.NextID
+				s.NextID++
+			}
+		}
 	}
 	return
 }
+
+// mergeServers merges the entries of the same guild. Adding a quote used to
+// append the guild's server again every time, so old state files have the
+// same server many times over.
+func mergeServers(servers []*Server) []*Server {
+	merged := make([]*Server, 0, len(servers))
+	byID := make(map[string]*Server)
+	for _, s := range servers {
+		if s == nil {
+			continue
+		}
+		if into := byID[s.ID]; into != nil {
+			into.merge(s)
+			continue
+		}
+		byID[s.ID] = s
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// merge adds the quotes of other that s doesn't have yet. Quotes with an id
+// are the same if their ids are, older quotes if their author and content
+// are. A quote added twice on purpose is kept twice.
+func (s *Server) merge(other *Server) {
+	have := make(map[string]int)
+	for _, quote := range s.Quotes {
+		have[quoteKey(quote)]++
+	}
+	seen := make(map[string]int)
+	for _, quote := range other.Quotes {
+		k := quoteKey(quote)
+		if seen[k]++; seen[k] > have[k] {
+			s.Quotes = append(s.Quotes, quote)
+			have[k]++
+		}
+	}
+	if other.NextID > s.NextID {
+		s.NextID = other.NextID
+	}
+	if s.Daily == nil {
+		s.Daily = other.Daily
+	}
+}
+
+func quoteKey(quote *Quote) string {
+	if quote.ID != 0 {
+		return strconv.Itoa(quote.ID)
+	}
+	return quote.AuthorID + "\x00" + quote.Content
+}
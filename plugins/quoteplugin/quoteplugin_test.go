@@ -0,0 +1,88 @@
+package quoteplugin
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Krognol/mountainbot/plugins/scheduler"
+)
+
+func TestMergeServers(t *testing.T) {
+	// Saved by the old addQuote, which appended the server on every add
+	state := `{"servers": [
+		{"id": "a", "quotes": ["one", "two", "two"]},
+		{"id": "b", "quotes": ["other"]},
+		{"id": "a", "quotes": ["one", "two", "two", "three"]},
+		{"id": "a", "quotes": ["one"]}
+	]}`
+	var q Quotes
+	if err := json.Unmarshal([]byte(state), &q); err != nil {
+		t.Fatal(err)
+	}
+	servers := mergeServers(q.Servers)
+	if len(servers) != 2 || servers[0].ID != "a" || servers[1].ID != "b" {
+		t.Fatalf("got %d servers, want a and b", len(servers))
+	}
+
+	var got []string
+	for _, quote := range servers[0].Quotes {
+		got = append(got, quote.Content)
+	}
+	want := []string{"one", "two", "two", "three"}
+	if len(got) != len(want) {
+		t.Fatalf("merged into %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("merged into %q, want %q", got, want)
+		}
+	}
+}
+
+func TestMergeKeepsIDs(t *testing.T) {
+	a := &Server{ID: "a", NextID: 3, Quotes: []*Quote{{ID: 1, Content: "x"}, {ID: 2, Content: "x"}}}
+	dup := &Server{ID: "a", NextID: 5, Quotes: []*Quote{{ID: 2, Content: "x"}, {ID: 4, Content: "y"}}, Daily: &Daily{}}
+	servers := mergeServers([]*Server{a, dup})
+	if len(servers) != 1 {
+		t.Fatalf("got %d servers, want 1", len(servers))
+	}
+	s := servers[0]
+	if len(s.Quotes) != 3 || s.Quotes[2].ID != 4 {
+		t.Errorf("got %d quotes, want ids 1, 2 and 4", len(s.Quotes))
+	}
+	if s.NextID != 5 || s.Daily == nil {
+		t.Errorf("next id %d and daily %v weren't merged", s.NextID, s.Daily)
+	}
+}
+
+func TestSyncDaily(t *testing.T) {
+	clock := scheduler.NewTestClock(time.Date(2024, 3, 29, 8, 0, 0, 0, time.UTC))
+	sched := scheduler.NewScheduler(filepath.Join(t.TempDir(), "jobs.json"), clock)
+	// b turned the quote of the day off, c's job has an old time
+	sched.Cron(dailyKind, "0 9 * * *", "UTC", scheduler.Skip, dailyJob{"b"})
+	sched.Cron(dailyKind, "0 9 * * *", "UTC", scheduler.Skip, dailyJob{"c"})
+	q := &Quotes{sched: sched, Servers: []*Server{
+		{ID: "a", Daily: &Daily{Channel: "1", Hour: 9, Minute: 30, Zone: "Europe/Stockholm"}},
+		{ID: "b"},
+		{ID: "c", Daily: &Daily{Channel: "2", Hour: 18, Zone: "UTC"}},
+	}}
+
+	q.syncDaily()
+	jobs := q.dailyJobs()
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want a and c", len(jobs))
+	}
+	if job := jobs["a"]; job.Cron != "30 9 * * *" || job.Zone != "Europe/Stockholm" || job.Missed != scheduler.Skip {
+		t.Errorf("a runs at %q in %q", job.Cron, job.Zone)
+	}
+	if job := jobs["c"]; job.Cron != "0 18 * * *" {
+		t.Errorf("c runs at %q", job.Cron)
+	}
+
+	q.syncDaily()
+	if len(sched.Jobs(dailyKind)) != 2 {
+		t.Error("syncing again added jobs")
+	}
+}
@@ -0,0 +1,361 @@
+package reminders
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// when is the parsed time of a reminder, either a single time or a cron
+// schedule in the user's timezone.
+type when struct {
+	At   time.Time
+	Cron string
+}
+
+var (
+	errNoTime = errors.New("I don't know when that is. Try 'in 2h30m', 'at 18:00 tomorrow' or 'every monday 9am'")
+	errNoText = errors.New("what should I remind you of?")
+	errTooFar = errors.New("that's too far away, reminders can be up to 10 years ahead")
+
+	durationRegex = regexp.MustCompile(`^([0-9]+[wdhms])+$`)
+	durationPart  = regexp.MustCompile(`([0-9]+)([wdhms])`)
+	clockRegex    = regexp.MustCompile(`^([0-9]{1,2})(?::([0-9]{2}))?(am|pm)?$`)
+	dateRegex     = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+)
+
+// maxAhead is how far away a reminder can be. It also keeps the durations
+// from overflowing.
+const maxAhead = 10 * 365 * 24 * time.Hour
+
+var units = map[string]time.Duration{
+	"w": 7 * 24 * time.Hour,
+	"d": 24 * time.Hour,
+	"h": time.Hour,
+	"m": time.Minute,
+	"s": time.Second,
+}
+
+var unitNames = map[string]string{
+	"week": "w", "weeks": "w",
+	"day": "d", "days": "d",
+	"hour": "h", "hours": "h", "hr": "h", "hrs": "h",
+	"minute": "m", "minutes": "m", "min": "m", "mins": "m",
+	"second": "s", "seconds": "s", "sec": "s", "secs": "s",
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+// parse reads the time at the start of s and returns it with the rest of s,
+// the reminder text. Times are in loc, now is the current time.
+//
+//	in 2h30m to ...           in 2 hours and 30 minutes ...
+//	at 18:00 [tomorrow] ...   at 9am friday ...   at 9:30 2026-12-24 ...
+//	tomorrow [at 9am] ...     friday at 18:00 ...
+//	every day at 9am ...      every monday 9am ...   every weekday 08:30 ...
+func parse(s string, now time.Time, loc *time.Location) (when, string, error) {
+	fields := strings.Fields(s)
+	now = now.In(loc)
+	if len(fields) == 0 {
+		return when{}, "", errNoTime
+	}
+
+	var w when
+	var rest []string
+	var err error
+	switch first := strings.ToLower(fields[0]); {
+	case first == "in":
+		var d time.Duration
+		d, rest, err = parseDuration(fields[1:])
+		w.At = now.Add(d)
+	case first == "at":
+		w.At, rest, err = parseAt(fields[1:], now, loc)
+	case first == "every":
+		w.Cron, rest, err = parseEvery(fields[1:])
+	default:
+		var day time.Time
+		day, rest, err = parseDay(fields, now, loc)
+		if err != nil {
+			break
+		}
+		hour, minute := 9, 0
+		if len(rest) > 0 && strings.ToLower(rest[0]) == "at" {
+			rest = rest[1:]
+		}
+		if len(rest) > 0 {
+			if h, m, n, ok := parseClock(rest); ok {
+				hour, minute, rest = h, m, rest[n:]
+			}
+		}
+		w.At = clockOn(day, hour, minute, loc)
+		if !w.At.After(now) {
+			err = fmt.Errorf("that's in the past")
+		}
+	}
+	if err != nil {
+		return when{}, "", err
+	}
+	if w.At.Sub(now) > maxAhead {
+		return when{}, "", errTooFar
+	}
+
+	if len(rest) > 0 && strings.ToLower(rest[0]) == "to" {
+		rest = rest[1:]
+	}
+	text := strings.TrimSpace(strings.Join(rest, " "))
+	if text == "" {
+		return when{}, "", errNoText
+	}
+	return w, text, nil
+}
+
+// addDuration adds an amount of a unit to d, as long as the total isn't
+// further away than maxAhead.
+func addDuration(d time.Duration, amount, unit string) (time.Duration, error) {
+	n, err := strconv.Atoi(amount)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, errTooFar
+	} else if err != nil || n < 0 {
+		return 0, errNoTime
+	}
+	if time.Duration(n) > (maxAhead-d)/units[unit] {
+		return 0, errTooFar
+	}
+	return d + time.Duration(n)*units[unit], nil
+}
+
+func parseDuration(fields []string) (time.Duration, []string, error) {
+	var d time.Duration
+	var err error
+	i := 0
+	for i < len(fields) {
+		f := strings.ToLower(fields[i])
+		switch {
+		case durationRegex.MatchString(f):
+			for _, part := range durationPart.FindAllStringSubmatch(f, -1) {
+				if d, err = addDuration(d, part[1], part[2]); err != nil {
+					return 0, nil, err
+				}
+			}
+			i++
+		case i+1 < len(fields) && unitNames[strings.ToLower(fields[i+1])] != "":
+			if d, err = addDuration(d, f, unitNames[strings.ToLower(fields[i+1])]); err != nil {
+				return 0, nil, err
+			}
+			i += 2
+		case (f == "and" || f == ",") && d > 0:
+			i++
+		default:
+			if d <= 0 {
+				return 0, nil, errNoTime
+			}
+			return d, fields[i:], nil
+		}
+	}
+	if d <= 0 {
+		return 0, nil, errNoTime
+	}
+	return d, fields[i:], nil
+}
+
+// parseClock reads 18:00, 9am, 9:30pm or 9 am from the start of fields and
+// returns how many fields it used.
+func parseClock(fields []string) (hour, minute, n int, ok bool) {
+	f := strings.ToLower(fields[0])
+	n = 1
+	if len(fields) > 1 {
+		if next := strings.ToLower(fields[1]); next == "am" || next == "pm" {
+			f += next
+			n = 2
+		}
+	}
+
+	match := clockRegex.FindStringSubmatch(f)
+	// A bare number is only a time with am/pm, "at 5" is too ambiguous
+	if match == nil || (match[2] == "" && match[3] == "") {
+		return 0, 0, 0, false
+	}
+	hour, _ = strconv.Atoi(match[1])
+	if match[2] != "" {
+		minute, _ = strconv.Atoi(match[2])
+	}
+	if match[3] != "" && (hour < 1 || hour > 12) {
+		return 0, 0, 0, false
+	}
+	switch match[3] {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+	if hour > 23 || minute > 59 {
+		return 0, 0, 0, false
+	}
+	return hour, minute, n, true
+}
+
+// clockOn is the time of day on a day. A time skipped when the clocks go
+// forward is moved past the change, rather than the hour before it.
+func clockOn(day time.Time, hour, minute int, loc *time.Location) time.Time {
+	at := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc)
+	want := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute
+	got := time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	if got < want {
+		at = at.Add(want - got)
+	}
+	return at
+}
+
+// parseDay reads today, tomorrow, a weekday or a date from the start of
+// fields.
+func parseDay(fields []string, now time.Time, loc *time.Location) (time.Time, []string, error) {
+	f := strings.ToLower(fields[0])
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	switch {
+	case f == "today":
+		return today, fields[1:], nil
+	case f == "tomorrow":
+		return today.AddDate(0, 0, 1), fields[1:], nil
+	case dateRegex.MatchString(f):
+		day, err := time.ParseInLocation("2006-01-02", f, loc)
+		if err != nil {
+			return time.Time{}, nil, errNoTime
+		}
+		return day, fields[1:], nil
+	}
+	if len(fields) > 1 && f == "on" {
+		return parseDay(fields[1:], now, loc)
+	}
+	if wd, ok := weekdays[f]; ok {
+		days := (int(wd) - int(now.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		return today.AddDate(0, 0, days), fields[1:], nil
+	}
+	return time.Time{}, nil, errNoTime
+}
+
+func parseAt(fields []string, now time.Time, loc *time.Location) (time.Time, []string, error) {
+	if len(fields) == 0 {
+		return time.Time{}, nil, errNoTime
+	}
+	hour, minute, n, ok := parseClock(fields)
+	if !ok {
+		return time.Time{}, nil, errNoTime
+	}
+	rest := fields[n:]
+
+	if len(rest) > 0 {
+		if day, r, err := parseDay(rest, now, loc); err == nil {
+			at := clockOn(day, hour, minute, loc)
+			if !at.After(now) {
+				return time.Time{}, nil, fmt.Errorf("that's in the past")
+			}
+			return at, r, nil
+		}
+	}
+
+	at := clockOn(now, hour, minute, loc)
+	if !at.After(now) {
+		at = clockOn(now.AddDate(0, 0, 1), hour, minute, loc)
+	}
+	return at, rest, nil
+}
+
+// parseEvery turns "day", "weekday", "weekend" or weekdays, followed by an
+// optional time, into a cron expression. "every hour" runs on the hour.
+func parseEvery(fields []string) (string, []string, error) {
+	if len(fields) == 0 {
+		return "", nil, errNoTime
+	}
+
+	var dow []string
+	i := 0
+	for ; i < len(fields); i++ {
+		f := strings.TrimSuffix(strings.ToLower(fields[i]), ",")
+		if wd, ok := weekdays[strings.TrimSuffix(f, "s")]; ok {
+			dow = append(dow, strconv.Itoa(int(wd)))
+			continue
+		}
+		if f == "and" && len(dow) > 0 {
+			continue
+		}
+		break
+	}
+
+	days := strings.Join(dow, ",")
+	if days == "" {
+		switch strings.ToLower(fields[0]) {
+		case "hour":
+			return "0 * * * *", fields[1:], nil
+		case "day":
+			days = "*"
+		case "weekday":
+			days = "1-5"
+		case "weekend":
+			days = "0,6"
+		default:
+			return "", nil, errNoTime
+		}
+		i = 1
+	}
+
+	rest := fields[i:]
+	if len(rest) > 0 && strings.ToLower(rest[0]) == "at" {
+		rest = rest[1:]
+	}
+	hour, minute := 9, 0
+	if len(rest) > 0 {
+		if h, m, n, ok := parseClock(rest); ok {
+			hour, minute, rest = h, m, rest[n:]
+		}
+	}
+	return fmt.Sprintf("%d %d * * %s", minute, hour, days), rest, nil
+}
+
+// describe is a short human readable version of a cron expression made by
+// parseEvery.
+func describe(cron string) string {
+	f := strings.Fields(cron)
+	if len(f) != 5 {
+		return cron
+	}
+	if f[1] == "*" {
+		return "every hour"
+	}
+	var days string
+	switch f[4] {
+	case "*":
+		days = "every day"
+	case "1-5":
+		days = "every weekday"
+	case "0,6":
+		days = "every weekend day"
+	default:
+		var names []string
+		for _, d := range strings.Split(f[4], ",") {
+			n, _ := strconv.Atoi(d)
+			names = append(names, time.Weekday(n).String())
+		}
+		days = "every " + strings.Join(names, ", ")
+	}
+	h, _ := strconv.Atoi(f[1])
+	m, _ := strconv.Atoi(f[0])
+	return fmt.Sprintf("%s at %02d:%02d", days, h, m)
+}
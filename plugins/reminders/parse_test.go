@@ -0,0 +1,153 @@
+package reminders
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	// A Wednesday afternoon
+	now := time.Date(2026, 6, 10, 15, 4, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		at   time.Time
+		cron string
+		text string
+	}{
+		{"in 2h30m to stretch", now.Add(150 * time.Minute), "", "stretch"},
+		{"in 2 hours and 30 minutes stretch", now.Add(150 * time.Minute), "", "stretch"},
+		{"in 1w 2d and 3 hrs check", now.Add(9*24*time.Hour + 3*time.Hour), "", "check"},
+		{"IN 90S tea", now.Add(90 * time.Second), "", "tea"},
+		{"at 18:00 dinner", time.Date(2026, 6, 10, 18, 0, 0, 0, time.UTC), "", "dinner"},
+		{"at 9am standup", time.Date(2026, 6, 11, 9, 0, 0, 0, time.UTC), "", "standup"},
+		{"at 12 am midnight", time.Date(2026, 6, 11, 0, 0, 0, 0, time.UTC), "", "midnight"},
+		{"at 12pm lunch", time.Date(2026, 6, 11, 12, 0, 0, 0, time.UTC), "", "lunch"},
+		{"at 6pm friday party", time.Date(2026, 6, 12, 18, 0, 0, 0, time.UTC), "", "party"},
+		{"at 9:30 2026-12-24 gifts", time.Date(2026, 12, 24, 9, 30, 0, 0, time.UTC), "", "gifts"},
+		{"tomorrow bins", time.Date(2026, 6, 11, 9, 0, 0, 0, time.UTC), "", "bins"},
+		{"tomorrow at 7:15am to run", time.Date(2026, 6, 11, 7, 15, 0, 0, time.UTC), "", "run"},
+		{"wednesday call", time.Date(2026, 6, 17, 9, 0, 0, 0, time.UTC), "", "call"},
+		{"on sat at 10pm game", time.Date(2026, 6, 13, 22, 0, 0, 0, time.UTC), "", "game"},
+		{"today at 11pm sleep", time.Date(2026, 6, 10, 23, 0, 0, 0, time.UTC), "", "sleep"},
+		{"every day at 9am vitamins", time.Time{}, "0 9 * * *", "vitamins"},
+		{"every weekday 08:30 commute", time.Time{}, "30 8 * * 1-5", "commute"},
+		{"every weekend plants", time.Time{}, "0 9 * * 0,6", "plants"},
+		{"every monday 9am report", time.Time{}, "0 9 * * 1", "report"},
+		{"every mondays and wed, at 7pm gym", time.Time{}, "0 19 * * 1,3", "gym"},
+		{"every hour water", time.Time{}, "0 * * * *", "water"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			w, text, err := parse(tt.in, now, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !w.At.Equal(tt.at) || w.Cron != tt.cron || text != tt.text {
+				t.Errorf("got %v %q %q, want %v %q %q", w.At, w.Cron, text, tt.at, tt.cron, tt.text)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	now := time.Date(2026, 6, 10, 15, 4, 0, 0, time.UTC)
+	tests := []struct {
+		in  string
+		err error
+	}{
+		{"", errNoTime},
+		{"in", errNoTime},
+		{"in 2h", errNoText},
+		{"in 2h to", errNoText},
+		{"in soon stretch", errNoTime},
+		{"in 0m stretch", errNoTime},
+		{"in -5 minutes stretch", errNoTime},
+		{"in a week stretch", errNoTime},
+		{"at 5 stretch", errNoTime},
+		{"at 25:00 stretch", errNoTime},
+		{"at 9:75 stretch", errNoTime},
+		{"at 13pm stretch", errNoTime},
+		{"yesterday stretch", errNoTime},
+		{"2026-02-30 stretch", errNoTime},
+		{"every stretch", errNoTime},
+		{"every", errNoTime},
+		{"in 522w stretch", errTooFar},
+		{"in 3650d 1d stretch", errTooFar},
+		{"in 5000000000000h stretch", errTooFar},
+		{"in 9223372036854775807s stretch", errTooFar},
+		{"in 99999999999999999999 seconds stretch", errTooFar},
+		{"in 3000w and 3000w and 3000w and 3000w stretch", errTooFar},
+		{"at 9:30 9999-12-24 stretch", errTooFar},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			w, text, err := parse(tt.in, now, time.UTC)
+			if err != tt.err {
+				t.Errorf("got %v %q and error %v, want error %v", w, text, err, tt.err)
+			}
+		})
+	}
+
+	for _, in := range []string{"at 9:00 2026-06-01 stretch", "today at 9am stretch"} {
+		if _, _, err := parse(in, now, time.UTC); err == nil {
+			t.Errorf("%q: no error for a time in the past", in)
+		}
+	}
+}
+
+func TestParseDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+	// Clocks go forward at 2:00 on March 8 and back at 2:00 on November 1
+	beforeSpring := time.Date(2026, 3, 7, 12, 0, 0, 0, ny)
+	beforeFall := time.Date(2026, 10, 31, 12, 0, 0, 0, ny)
+	tests := []struct {
+		name string
+		now  time.Time
+		in   string
+		want time.Time
+	}{
+		// Times of day stay on the wall clock across the change
+		{"spring tomorrow", beforeSpring, "tomorrow at 9am x", time.Date(2026, 3, 8, 13, 0, 0, 0, time.UTC)},
+		{"fall tomorrow", beforeFall, "tomorrow at 9am x", time.Date(2026, 11, 1, 14, 0, 0, 0, time.UTC)},
+		{"spring weekday", beforeSpring, "sunday x", time.Date(2026, 3, 8, 13, 0, 0, 0, time.UTC)},
+		// A time skipped by the change is the same time after it
+		{"spring gap", beforeSpring, "at 2:30am tomorrow x", time.Date(2026, 3, 8, 7, 30, 0, 0, time.UTC)},
+		// Durations are real time, so a day is 24 hours and not the same
+		// wall clock time
+		{"spring duration", beforeSpring, "in 1d x", time.Date(2026, 3, 8, 17, 0, 0, 0, time.UTC)},
+		{"fall duration", beforeFall, "in 1d x", time.Date(2026, 11, 1, 16, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _, err := parse(tt.in, tt.now, ny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !w.At.Equal(tt.want) {
+				t.Errorf("got %v, want %v", w.At, tt.want.In(ny))
+			}
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		cron string
+		want string
+	}{
+		{"0 9 * * *", "every day at 09:00"},
+		{"30 8 * * 1-5", "every weekday at 08:30"},
+		{"0 9 * * 0,6", "every weekend day at 09:00"},
+		{"0 19 * * 1,3", "every Monday, Wednesday at 19:00"},
+		{"0 * * * *", "every hour"},
+		{"bad", "bad"},
+	}
+	for _, tt := range tests {
+		if got := describe(tt.cron); got != tt.want {
+			t.Errorf("describe(%q) = %q, want %q", tt.cron, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package reminders
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/Krognol/mountainbot/plugins/scheduler"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Reminder is the data of a reminder job. Reminders without a ChannelID
+// are sent by DM.
+type Reminder struct {
+	UserID    string `json:"user_id"`
+	GuildID   string `json:"guild_id"`
+	ChannelID string `json:"channel_id,omitempty"`
+	// Source is where the reminder was made, DMs fall back to it
+	Source string `json:"source"`
+	Text   string `json:"text"`
+}
+
+// Reminders only keeps the timezones of users, the reminders themselves
+// are jobs of the scheduler.
+type Reminders struct {
+	sync.RWMutex
+	Zones map[string]string `json:"zones"`
+
+	discord *dgofw.DiscordClient
+	sched   *scheduler.Scheduler
+}
+
+const (
+	jobKind         = "reminder"
+	maxPerUser      = 25
+	minimumInterval = time.Minute
+)
+
+var ReminderHelp = []string{
+	"remind me in [2h30m] [to] [text] -- DMs you the text after the time, 'in 2 hours and 30 minutes' works too",
+	"remind me at [18:00|6pm] [today|tomorrow|friday|2026-12-24] [text] -- DMs you at the time",
+	"remind me [tomorrow|friday] [at 9am] [text]",
+	"remind me every [day|weekday|weekend|monday...] [9am] [text] -- repeats the reminder",
+	"remind [#channel] [when] [text] -- posts the reminder in the channel instead. Mod only",
+	"reminders list -- shows your reminders",
+	"reminders cancel [id] -- cancels a reminder, mods can cancel any reminder in the server",
+	"reminders timezone [Europe/Stockholm] -- sets the timezone your times are in, UTC by default",
+}
+
+var channelRegex = regexp.MustCompile(`^<#([0-9]+)>$`)
+
+func NewReminders(discord *dgofw.DiscordClient, sched *scheduler.Scheduler) *Reminders {
+	plugin := &Reminders{
+		Zones:   make(map[string]string),
+		discord: discord,
+		sched:   sched,
+	}
+	err := plugin.Load()
+	if err != nil {
+		fmt.Println(err.Error())
+		plugin.Save()
+	}
+	sched.Handle(jobKind, plugin.deliver)
+	return plugin
+}
+
+func (r *Reminders) location(userID string) *time.Location {
+	r.RLock()
+	zone := r.Zones[userID]
+	r.RUnlock()
+	if loc, err := time.LoadLocation(zone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+func (r *Reminders) deliver(job scheduler.Job) {
+	var rem Reminder
+	if err := job.Decode(&rem); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	s := r.discord.Session()
+	// Reminders only ever ping the user who set them, whatever the text says
+	mentions := &discordgo.MessageAllowedMentions{
+		Parse: []discordgo.AllowedMentionType{},
+		Users: []string{rem.UserID},
+	}
+	if rem.ChannelID != "" {
+		_, err := s.ChannelMessageSendComplex(rem.ChannelID, &discordgo.MessageSend{
+			Content:         "<@" + rem.UserID + "> reminded everyone: " + rem.Text,
+			AllowedMentions: mentions,
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	text := "Reminder: " + rem.Text
+	if job.Cron != "" {
+		text += fmt.Sprintf(" (`reminders cancel %s` to stop)", job.ID)
+	}
+	ch, err := s.UserChannelCreate(rem.UserID)
+	if err == nil {
+		_, err = s.ChannelMessageSend(ch.ID, text)
+	}
+	if err != nil && rem.Source != "" {
+		// DMs are closed, remind them where they asked
+		s.ChannelMessageSendComplex(rem.Source, &discordgo.MessageSend{
+			Content:         "<@" + rem.UserID + "> " + text,
+			AllowedMentions: mentions,
+		})
+	}
+}
+
+// mine returns the reminders of a user, soonest first.
+func (r *Reminders) mine(userID string) []scheduler.Job {
+	var jobs []scheduler.Job
+	for _, job := range r.sched.Jobs(jobKind) {
+		var rem Reminder
+		if job.Decode(&rem) == nil && rem.UserID == userID {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+func (r *Reminders) OnRemind(m *dgofw.DiscordMessage) {
+	target, args := m.Arg("target"), m.Arg("when")
+	if target == "" || args == "" {
+		return
+	}
+
+	rem := Reminder{
+		UserID:  m.Author.ID(),
+		GuildID: m.GuildID(),
+		Source:  m.ChannelID(),
+	}
+	if target != "me" {
+		match := channelRegex.FindStringSubmatch(target)
+		if match == nil {
+			m.Reply("Use 'remind me ...' or 'remind #channel ...'")
+			return
+		}
+		if !m.IsMod() {
+			m.Reply("Only mods can set reminders for a channel.")
+			return
+		}
+		if !discordutil.ChannelInGuild(m.Session(), match[1], m.GuildID()) {
+			m.Reply("That channel isn't in this server.")
+			return
+		}
+		rem.ChannelID = match[1]
+	}
+
+	if len(r.mine(rem.UserID)) >= maxPerUser {
+		m.Reply(fmt.Sprintf("You can't have more than %d reminders.", maxPerUser))
+		return
+	}
+
+	loc := r.location(rem.UserID)
+	w, text, err := parse(args, time.Now(), loc)
+	if err != nil {
+		m.Reply(err.Error())
+		return
+	}
+	rem.Text = text
+
+	var id string
+	var reply string
+	if w.Cron != "" {
+		id, err = r.sched.Cron(jobKind, w.Cron, loc.String(), scheduler.Skip, rem)
+		reply = describe(w.Cron) + " " + loc.String()
+	} else {
+		if w.At.Sub(time.Now()) < minimumInterval {
+			m.Reply("Reminders have to be at least a minute away.")
+			return
+		}
+		id, err = r.sched.Once(jobKind, w.At, rem)
+		reply = w.At.Format("Mon Jan 2 15:04 MST")
+	}
+	if err != nil {
+		fmt.Println(err)
+		m.Reply("Something happened...")
+		return
+	}
+	m.Reply(fmt.Sprintf("Reminder #%s set for %s", id, reply))
+}
+
+func (r *Reminders) list(m *dgofw.DiscordMessage) {
+	jobs := r.mine(m.Author.ID())
+	if len(jobs) == 0 {
+		m.Reply("You have no reminders.")
+		return
+	}
+
+	loc := r.location(m.Author.ID())
+	var buf bytes.Buffer
+	buf.WriteString("**Your reminders**\n")
+	for _, job := range jobs {
+		var rem Reminder
+		job.Decode(&rem)
+		when := job.At.In(loc).Format("Mon Jan 2 15:04 MST")
+		if job.Cron != "" {
+			when = describe(job.Cron) + ", next " + when
+		}
+		where := "DM"
+		if rem.ChannelID != "" {
+			where = "<#" + rem.ChannelID + ">"
+		}
+		buf.WriteString(fmt.Sprintf("`#%s` %s in %s -- %s\n", job.ID, when, where, rem.Text))
+	}
+	m.Reply(buf.String())
+}
+
+func (r *Reminders) cancel(m *dgofw.DiscordMessage, id string) {
+	id = strings.TrimPrefix(id, "#")
+	job, ok := r.sched.Get(id)
+	var rem Reminder
+	if ok && job.Kind == jobKind && job.Decode(&rem) == nil {
+		ok = rem.UserID == m.Author.ID() || (m.IsMod() && rem.GuildID == m.GuildID())
+	} else {
+		ok = false
+	}
+	if !ok || !r.sched.Cancel(id) {
+		m.Reply("Couldn't find a reminder #" + id + " you can cancel.")
+		return
+	}
+	m.Reply("Cancelled reminder #" + id)
+}
+
+func (r *Reminders) timezone(m *dgofw.DiscordMessage, zone string) {
+	if zone == "" {
+		m.Reply("Your timezone is " + r.location(m.Author.ID()).String())
+		return
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil || zone == "Local" {
+		m.Reply("Unknown timezone " + zone + ", use names like Europe/Stockholm")
+		return
+	}
+
+	r.Lock()
+	r.Zones[m.Author.ID()] = loc.String()
+	r.Unlock()
+	r.Save()
+	m.Reply(fmt.Sprintf("Your timezone is now %s, it's %s there", loc, time.Now().In(loc).Format("15:04")))
+}
+
+func (r *Reminders) OnReminders(m *dgofw.DiscordMessage) {
+	switch m.Arg("arg1") {
+	case "", "list":
+		r.list(m)
+	case "cancel":
+		if id := m.Arg("arg2"); id != "" {
+			r.cancel(m, id)
+		}
+	case "timezone", "tz":
+		r.timezone(m, strings.TrimSpace(m.Arg("arg2")))
+	}
+}
+
+func (r *Reminders) Save() (err error) {
+	r.RLock()
+	defer r.RUnlock()
+	var f *os.File
+	if f, err = os.Create("./remindersstate.json"); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(r)
+	}
+	return
+}
+
+func (r *Reminders) Load() (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile("./remindersstate.json"); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, r); err != nil {
+		return
+	}
+	if r.Zones == nil {
+		r.Zones = make(map[string]string)
+	}
+	return
+}
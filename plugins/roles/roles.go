@@ -0,0 +1,586 @@
+package roles
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/bwmarrin/discordgo"
+)
+
+type (
+	// ReactionRole grants RoleID to members reacting with Emoji on a message.
+	// Emoji is the API name, either a unicode emoji or name:id for custom ones.
+	// Granted are the members the bot gave the role to through the reaction,
+	// and the only ones it takes the role from again.
+	ReactionRole struct {
+		ChannelID string   `json:"channel_id"`
+		MessageID string   `json:"message_id"`
+		Emoji     string   `json:"emoji"`
+		RoleID    string   `json:"role_id"`
+		Granted   []string `json:"granted"`
+	}
+
+	Server struct {
+		ID            string          `json:"id"`
+		SelfAssign    []string        `json:"self_assign"`
+		ReactionRoles []*ReactionRole `json:"reaction_roles"`
+	}
+
+	Roles struct {
+		sync.RWMutex
+		Servers []*Server `json:"servers"`
+
+		synced sync.Once
+	}
+)
+
+var RolesHelp = []string{
+	"iam [role]     -- Gives you a self-assignable role.",
+	"iamnot [role]  -- Removes a self-assignable role.",
+	"roles          -- Lists the self-assignable roles.",
+	"roles add [@role] / roles remove [@role] -- Manages self-assignable roles, mod only.",
+	"roles react [#channel] [message id] [emoji] [@role] -- Reacting with the emoji gives the role, mod only.",
+	"roles unreact [message id] [emoji] -- Removes a reaction role, mod only.",
+	"roles reactions -- Lists the reaction roles.",
+}
+
+var emojiRegex = regexp.MustCompile(`^<a?:(\w+):([0-9]+)>$`)
+
+func NewRoles() *Roles {
+	plugin := &Roles{Servers: make([]*Server, 0)}
+	err := plugin.Load()
+	if err != nil {
+		fmt.Println(err.Error())
+		plugin.Save()
+	}
+	return plugin
+}
+
+// emojiName turns a typed emoji into the name the reaction events use.
+func emojiName(s string) string {
+	if match := emojiRegex.FindStringSubmatch(s); match != nil {
+		return match[1] + ":" + match[2]
+	}
+	return s
+}
+
+// getServer must be called with the lock held.
+func (r *Roles) getServer(id string, create bool) *Server {
+	for _, s := range r.Servers {
+		if s.ID == id {
+			return s
+		}
+	}
+	if !create {
+		return nil
+	}
+	s := &Server{
+		ID:            id,
+		SelfAssign:    make([]string, 0),
+		ReactionRoles: make([]*ReactionRole, 0),
+	}
+	r.Servers = append(r.Servers, s)
+	return s
+}
+
+// findRole looks a role up by mention, id or case-insensitive name.
+func findRole(s *discordgo.Session, guildID, arg string) *discordgo.Role {
+	roles, err := s.GuildRoles(guildID)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	id := discordutil.ParseID(arg)
+	for _, role := range roles {
+		if role.ID == id || strings.EqualFold(role.Name, arg) {
+			return role
+		}
+	}
+	return nil
+}
+
+func (r *Roles) selfAssignable(guildID, roleID string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	if s := r.getServer(guildID, false); s != nil {
+		for _, id := range s.SelfAssign {
+			if id == roleID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findReaction must be called with the lock held.
+func (r *Roles) findReaction(guildID, messageID, emoji string) *ReactionRole {
+	if s := r.getServer(guildID, false); s != nil {
+		for _, rr := range s.ReactionRoles {
+			if rr.MessageID == messageID && rr.Emoji == emoji {
+				return rr
+			}
+		}
+	}
+	return nil
+}
+
+// reactionRole returns a copy of the reaction role, without its grants.
+func (r *Roles) reactionRole(guildID, messageID, emoji string) *ReactionRole {
+	r.RLock()
+	defer r.RUnlock()
+	if rr := r.findReaction(guildID, messageID, emoji); rr != nil {
+		cp := *rr
+		cp.Granted = nil
+		return &cp
+	}
+	return nil
+}
+
+// granted reports whether the bot gave the role of rr to a user.
+func (r *Roles) granted(guildID string, rr *ReactionRole, userID string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	if live := r.findReaction(guildID, rr.MessageID, rr.Emoji); live != nil {
+		for _, id := range live.Granted {
+			if id == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setGranted records whether the bot gave the role of rr to a user, and
+// reports whether that changed anything.
+func (r *Roles) setGranted(guildID string, rr *ReactionRole, userID string, granted bool) bool {
+	r.Lock()
+	defer r.Unlock()
+	live := r.findReaction(guildID, rr.MessageID, rr.Emoji)
+	if live == nil {
+		return false
+	}
+	ids := make([]string, 0, len(live.Granted)+1)
+	for _, id := range live.Granted {
+		if id != userID {
+			ids = append(ids, id)
+		}
+	}
+	if granted {
+		ids = append(ids, userID)
+	}
+	changed := len(ids) != len(live.Granted)
+	live.Granted = ids
+	return changed
+}
+
+// memberHasRole checks the state first and asks the API for members that
+// aren't cached.
+func memberHasRole(s *discordgo.Session, guildID, userID, roleID string) (bool, error) {
+	mem, err := s.State.Member(guildID, userID)
+	if err != nil {
+		if mem, err = s.GuildMember(guildID, userID); err != nil {
+			return false, err
+		}
+	}
+	return hasRole(mem, roleID), nil
+}
+
+func (r *Roles) iam(m *dgofw.DiscordMessage, add bool) {
+	arg := m.Arg("role")
+	if arg == "" {
+		return
+	}
+	role := findRole(m.Session(), m.GuildID(), arg)
+	if role == nil || !r.selfAssignable(m.GuildID(), role.ID) {
+		m.Reply("'" + arg + "' isn't a self-assignable role.")
+		return
+	}
+
+	var err error
+	if add {
+		err = m.Session().GuildMemberRoleAdd(m.GuildID(), m.Author.ID(), role.ID)
+	} else {
+		err = m.Session().GuildMemberRoleRemove(m.GuildID(), m.Author.ID(), role.ID)
+	}
+	if err != nil {
+		fmt.Println(err)
+		m.Reply("Something happened...")
+		return
+	}
+
+	if add {
+		m.Reply("You now have **" + role.Name + "**")
+	} else {
+		m.Reply("You no longer have **" + role.Name + "**")
+	}
+}
+
+func (r *Roles) OnIAm(m *dgofw.DiscordMessage) {
+	r.iam(m, true)
+}
+
+func (r *Roles) OnIAmNot(m *dgofw.DiscordMessage) {
+	r.iam(m, false)
+}
+
+func (r *Roles) OnReactionAdd(s *discordgo.Session, e *discordgo.MessageReactionAdd) {
+	if s.State.User != nil && e.UserID == s.State.User.ID {
+		return
+	}
+	rr := r.reactionRole(e.GuildID, e.MessageID, e.Emoji.APIName())
+	if rr == nil {
+		return
+	}
+	// Members that already have the role got it some other way, and keep it
+	// when they take the reaction back
+	if e.Member != nil && hasRole(e.Member, rr.RoleID) {
+		return
+	}
+	if err := s.GuildMemberRoleAdd(e.GuildID, e.UserID, rr.RoleID); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if r.setGranted(e.GuildID, rr, e.UserID, true) {
+		r.Save()
+	}
+}
+
+func (r *Roles) OnReactionRemove(s *discordgo.Session, e *discordgo.MessageReactionRemove) {
+	rr := r.reactionRole(e.GuildID, e.MessageID, e.Emoji.APIName())
+	if rr == nil || !r.granted(e.GuildID, rr, e.UserID) {
+		return
+	}
+	if err := s.GuildMemberRoleRemove(e.GuildID, e.UserID, rr.RoleID); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if r.setGranted(e.GuildID, rr, e.UserID, false) {
+		r.Save()
+	}
+}
+
+// OnReady gives the role to everyone that reacted while the bot was offline,
+// and takes it from everyone it gave the role to whose reaction was removed.
+// Only the first Ready syncs, reconnects don't go through every message again.
+func (r *Roles) OnReady(s *discordgo.Session, _ *discordgo.Ready) {
+	r.synced.Do(func() {
+		r.RLock()
+		type entry struct {
+			guildID string
+			rr      ReactionRole
+		}
+		entries := []entry{}
+		for _, srv := range r.Servers {
+			for _, rr := range srv.ReactionRoles {
+				entries = append(entries, entry{srv.ID, *rr})
+			}
+		}
+		r.RUnlock()
+
+		go func() {
+			for _, e := range entries {
+				r.sync(s, e.guildID, &e.rr)
+			}
+			r.Save()
+		}()
+	})
+}
+
+// sync brings the role of rr in line with the reactions on its message.
+// rr is a copy, its grants are read when the sync starts.
+func (r *Roles) sync(s *discordgo.Session, guildID string, rr *ReactionRole) {
+	// Reaction roles saved before grants were kept have none at all. Whoever
+	// reacted and has the role is taken to have gotten it from the reaction
+	legacy := rr.Granted == nil
+	reacted := make(map[string]bool)
+	var after string
+	for {
+		users, err := s.MessageReactions(rr.ChannelID, rr.MessageID, rr.Emoji, 100, "", after)
+		if err != nil {
+			// Without every reaction there's no telling whose role to remove
+			fmt.Println(err)
+			return
+		}
+		for _, user := range users {
+			if user.Bot {
+				continue
+			}
+			reacted[user.ID] = true
+			if r.granted(guildID, rr, user.ID) {
+				continue
+			}
+			has, err := memberHasRole(s, guildID, user.ID, rr.RoleID)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if has {
+				if legacy {
+					r.setGranted(guildID, rr, user.ID, true)
+				}
+				continue
+			}
+			if err := s.GuildMemberRoleAdd(guildID, user.ID, rr.RoleID); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			r.setGranted(guildID, rr, user.ID, true)
+		}
+		if len(users) < 100 {
+			break
+		}
+		after = users[len(users)-1].ID
+	}
+
+	// Another reaction role on a different message may give the same role
+	if r.givenElsewhere(guildID, rr) {
+		return
+	}
+	for _, userID := range rr.Granted {
+		if reacted[userID] {
+			continue
+		}
+		if err := s.GuildMemberRoleRemove(guildID, userID, rr.RoleID); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		r.setGranted(guildID, rr, userID, false)
+	}
+}
+
+// givenElsewhere reports whether another reaction role gives the same role.
+func (r *Roles) givenElsewhere(guildID string, rr *ReactionRole) bool {
+	r.RLock()
+	defer r.RUnlock()
+	if srv := r.getServer(guildID, false); srv != nil {
+		for _, other := range srv.ReactionRoles {
+			if other.RoleID == rr.RoleID && (other.MessageID != rr.MessageID || other.Emoji != rr.Emoji) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasRole(mem *discordgo.Member, roleID string) bool {
+	for _, id := range mem.Roles {
+		if id == roleID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Roles) list(m *dgofw.DiscordMessage) {
+	r.RLock()
+	var ids []string
+	if s := r.getServer(m.GuildID(), false); s != nil {
+		ids = append(ids, s.SelfAssign...)
+	}
+	r.RUnlock()
+
+	if len(ids) == 0 {
+		m.Reply("There are no self-assignable roles.")
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("**Self-assignable roles**\n")
+	for _, id := range ids {
+		if role, err := m.Session().State.Role(m.GuildID(), id); err == nil {
+			buf.WriteString(role.Name + "\n")
+		} else {
+			buf.WriteString("<@&" + id + ">\n")
+		}
+	}
+	m.Reply(buf.String())
+}
+
+func (r *Roles) listReactions(m *dgofw.DiscordMessage) {
+	r.RLock()
+	var rrs []ReactionRole
+	if s := r.getServer(m.GuildID(), false); s != nil {
+		for _, rr := range s.ReactionRoles {
+			rrs = append(rrs, *rr)
+		}
+	}
+	r.RUnlock()
+
+	if len(rrs) == 0 {
+		m.Reply("There are no reaction roles.")
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, rr := range rrs {
+		emoji := rr.Emoji
+		if strings.Contains(emoji, ":") {
+			emoji = "<:" + emoji + ">"
+		}
+		buf.WriteString(fmt.Sprintf("%s on `%s` in <#%s> -- <@&%s>\n", emoji, rr.MessageID, rr.ChannelID, rr.RoleID))
+	}
+	m.Reply(buf.String())
+}
+
+func (r *Roles) addReaction(m *dgofw.DiscordMessage, fields []string) {
+	if len(fields) != 4 {
+		m.Reply("Use `roles react #channel messageid emoji @role`")
+		return
+	}
+	channelID, messageID, emoji := discordutil.ParseID(fields[0]), fields[1], emojiName(fields[2])
+	role := findRole(m.Session(), m.GuildID(), fields[3])
+	if channelID == "" || role == nil {
+		m.Reply("Use `roles react #channel messageid emoji @role`")
+		return
+	}
+	if ch, err := m.Session().State.Channel(channelID); err != nil || ch.GuildID != m.GuildID() {
+		m.Reply("That channel isn't in this server.")
+		return
+	}
+	if r.reactionRole(m.GuildID(), messageID, emoji) != nil {
+		m.Reply("That emoji already gives a role on that message.")
+		return
+	}
+	if reason := discordutil.CheckAssignable(m.Session(), m.GuildID(), role); reason != "" {
+		m.Reply(reason)
+		return
+	}
+	if _, err := m.Session().ChannelMessage(channelID, messageID); err != nil {
+		m.Reply("Couldn't find that message.")
+		return
+	}
+	if err := m.Session().MessageReactionAdd(channelID, messageID, emoji); err != nil {
+		m.Reply("Couldn't react with that emoji.")
+		return
+	}
+
+	r.Lock()
+	s := r.getServer(m.GuildID(), true)
+	for _, rr := range s.ReactionRoles {
+		if rr.MessageID == messageID && (rr.Emoji == emoji || rr.RoleID == role.ID) {
+			r.Unlock()
+			m.Reply("That message already gives that role or uses that emoji.")
+			return
+		}
+	}
+	s.ReactionRoles = append(s.ReactionRoles, &ReactionRole{
+		ChannelID: channelID,
+		MessageID: messageID,
+		Emoji:     emoji,
+		RoleID:    role.ID,
+		Granted:   make([]string, 0),
+	})
+	r.Unlock()
+	r.Save()
+
+	m.Reply("Reacting with " + fields[2] + " now gives **" + role.Name + "**")
+}
+
+func (r *Roles) removeReaction(m *dgofw.DiscordMessage, fields []string) {
+	if len(fields) != 2 {
+		m.Reply("Use `roles unreact messageid emoji`")
+		return
+	}
+	messageID, emoji := fields[0], emojiName(fields[1])
+
+	r.Lock()
+	var removed bool
+	if s := r.getServer(m.GuildID(), false); s != nil {
+		rrs := make([]*ReactionRole, 0, len(s.ReactionRoles))
+		for _, rr := range s.ReactionRoles {
+			if rr.MessageID == messageID && rr.Emoji == emoji {
+				removed = true
+				continue
+			}
+			rrs = append(rrs, rr)
+		}
+		s.ReactionRoles = rrs
+	}
+	r.Unlock()
+
+	if !removed {
+		m.Reply("No such reaction role.")
+		return
+	}
+	r.Save()
+	m.Reply("Removed the reaction role.")
+}
+
+func (r *Roles) OnMessage(m *dgofw.DiscordMessage) {
+	arg1, arg2 := m.Arg("arg1"), m.Arg("arg2")
+	switch arg1 {
+	case "":
+		r.list(m)
+	case "reactions":
+		r.listReactions(m)
+	case "add", "remove":
+		if !m.IsMod() {
+			return
+		}
+		role := findRole(m.Session(), m.GuildID(), arg2)
+		if role == nil {
+			m.Reply("Couldn't find that role.")
+			return
+		}
+		if arg1 == "add" {
+			if reason := discordutil.CheckAssignable(m.Session(), m.GuildID(), role); reason != "" {
+				m.Reply(reason)
+				return
+			}
+		}
+		r.Lock()
+		s := r.getServer(m.GuildID(), true)
+		ids := make([]string, 0, len(s.SelfAssign)+1)
+		for _, id := range s.SelfAssign {
+			if id != role.ID {
+				ids = append(ids, id)
+			}
+		}
+		if arg1 == "add" {
+			ids = append(ids, role.ID)
+		}
+		s.SelfAssign = ids
+		r.Unlock()
+		r.Save()
+		if arg1 == "add" {
+			m.Reply("**" + role.Name + "** is now self-assignable")
+		} else {
+			m.Reply("**" + role.Name + "** is no longer self-assignable")
+		}
+	case "react":
+		if m.IsMod() {
+			r.addReaction(m, strings.Fields(arg2))
+		}
+	case "unreact":
+		if m.IsMod() {
+			r.removeReaction(m, strings.Fields(arg2))
+		}
+	}
+}
+
+func (r *Roles) Save() (err error) {
+	r.RLock()
+	defer r.RUnlock()
+	var f *os.File
+	if f, err = os.Create("./rolesstate.json"); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(r)
+	}
+	return
+}
+
+func (r *Roles) Load() (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile("./rolesstate.json"); err == nil {
+		return json.Unmarshal(b, r)
+	}
+	return
+}
@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a scheduler.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer fires once on C after its duration, unless it's stopped first.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (realClock) Now() time.Time                 { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+func (t realTimer) C() <-chan time.Time          { return t.Timer.C }
+
+// TestClock is a Clock that only moves when told to, so jobs run exactly
+// when a test expects them to.
+type TestClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+type testTimer struct {
+	clock *TestClock
+	ch    chan time.Time
+}
+
+func NewTestClock(now time.Time) *TestClock {
+	return &TestClock{now: now}
+}
+
+func (c *TestClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *TestClock) NewTimer(d time.Duration) Timer {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, waiter{c.now.Add(d), ch})
+	}
+	return &testTimer{c, ch}
+}
+
+func (t *testTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop removes the timer from the clock, it returns false if the timer
+// already fired.
+func (t *testTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	for i, w := range t.clock.waiters {
+		if w.ch == t.ch {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward and fires every timer that expired.
+func (c *TestClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	var waiting []waiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+// Waiters is the number of pending timers. Tests can poll it to know the
+// scheduler went back to sleep.
+func (c *TestClock) Waiters() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.waiters)
+}
@@ -0,0 +1,177 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression with the usual five fields
+//
+//	minute hour day-of-month month day-of-week
+//
+// Fields can be *, a number, a range a-b, a step */n or a-b/n, or a comma
+// separated list of those. Days of the week go from 0 (Sunday) to 6, 7 is
+// also Sunday. Like cron, if both day fields are restricted a day matching
+// either of them is used.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+type bounds struct{ min, max int }
+
+var fieldBounds = []bounds{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+var shorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// ParseCron parses a cron expression, or one of @hourly, @daily, @weekly,
+// @monthly and @yearly.
+func ParseCron(spec string) (*Schedule, error) {
+	if s, ok := shorthands[strings.TrimSpace(spec)]; ok {
+		spec = s
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expressions have 5 fields, got %d", len(fields))
+	}
+
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseField(f, fieldBounds[i])
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %v", i+1, err)
+		}
+		bits[i] = b
+	}
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+
+		lo, hi := b.min, b.max
+		switch {
+		case part == "*":
+		case strings.IndexByte(part, '-') > 0:
+			i := strings.IndexByte(part, '-')
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(part[:i])
+			hi, err2 = strconv.Atoi(part[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = b.max
+			}
+		}
+		if lo < b.min || hi > b.max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, b.min, b.max)
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func has(bits uint64, n int) bool {
+	return bits&(1<<uint(n)) != 0
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom, dow := has(s.dom, t.Day()), has(s.dow, int(t.Weekday()))
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t matching the schedule, in t's
+// location. It returns the zero time if nothing matches within five years,
+// like February 30th.
+//
+// Matching is done on the wall clock. A time skipped when the clocks go
+// forward runs right after the gap, and a time repeated when they go back
+// only runs the first time.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// The wall clock of t, as UTC so adding to it never hits a DST change
+	w := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := w.AddDate(5, 0, 0)
+
+	for w.Before(limit) {
+		if !has(s.month, int(w.Month())) {
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(w) {
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !has(s.hour, w.Hour()) {
+			w = time.Date(w.Year(), w.Month(), w.Day(), w.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !has(s.minute, w.Minute()) {
+			w = w.Add(time.Minute)
+			continue
+		}
+		if at := wallTime(w, loc); at.After(t) {
+			return at
+		} else if at = at.Add(time.Hour); sameWall(at, w) && at.After(t) {
+			// t is in the repeated hour, past the first of the two
+			return at
+		}
+		w = w.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// wallTime returns the time in loc showing the wall clock w. When the wall
+// clock shows it twice it's the first of them.
+func wallTime(w time.Time, loc *time.Location) time.Time {
+	at := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, 0, loc)
+	if earlier := at.Add(-time.Hour); sameWall(earlier, w) {
+		return earlier
+	}
+	return at
+}
+
+func sameWall(t, w time.Time) bool {
+	return t.Year() == w.Year() && t.YearDay() == w.YearDay() && t.Hour() == w.Hour() && t.Minute() == w.Minute()
+}
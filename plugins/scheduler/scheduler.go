@@ -0,0 +1,373 @@
+// Package scheduler runs timed jobs for the other plugins. Jobs are saved to
+// disk and picked up again when the bot restarts.
+//
+// Plugins register a handler for a kind of job, and schedule jobs of that
+// kind with whatever data the handler needs:
+//
+//	sched.Handle("reminder", func(job scheduler.Job) { ... })
+//	sched.Once("reminder", at, reminder)
+//	sched.Cron("daily", "0 9 * * *", "Europe/Stockholm", scheduler.Skip, data)
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Missed says what to do with runs that should have happened while the bot
+// was offline.
+type Missed string
+
+const (
+	// RunOnce runs the job once for all its missed runs
+	RunOnce Missed = "run_once"
+	// Skip drops missed runs, one-shot jobs are removed
+	Skip Missed = "skip"
+)
+
+// Job is a scheduled job. Jobs without Cron run once at At, the others run
+// at every time matching Cron in Zone.
+type Job struct {
+	ID     string          `json:"id"`
+	Kind   string          `json:"kind"`
+	At     time.Time       `json:"at"`
+	Cron   string          `json:"cron,omitempty"`
+	Zone   string          `json:"zone,omitempty"`
+	Missed Missed          `json:"missed"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// Decode reads the data of the job into v.
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Data, v)
+}
+
+// next returns the run after t, or the zero time if there is none.
+func (j *Job) next(t time.Time) time.Time {
+	if j.Cron == "" {
+		return time.Time{}
+	}
+	sched, err := ParseCron(j.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	loc, err := time.LoadLocation(j.Zone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return sched.Next(t.In(loc))
+}
+
+// Handler runs a job. It gets a copy, changing it has no effect.
+type Handler func(job Job)
+
+type Scheduler struct {
+	sync.Mutex
+	jobs     map[string]*Job
+	handlers map[string]Handler
+	nextID   int
+
+	clock  Clock
+	path   string
+	saveMu sync.Mutex
+	wake   chan struct{}
+	stop   chan struct{}
+}
+
+// NewScheduler creates a scheduler saving its jobs to path. A nil clock
+// uses the real time.
+func NewScheduler(path string, clock Clock) *Scheduler {
+	if clock == nil {
+		clock = realClock{}
+	}
+	s := &Scheduler{
+		jobs:     make(map[string]*Job),
+		handlers: make(map[string]Handler),
+		clock:    clock,
+		path:     path,
+		wake:     make(chan struct{}, 1),
+	}
+	if err := s.Load(); err != nil && !os.IsNotExist(err) {
+		fmt.Println(err)
+	}
+	return s
+}
+
+// Handle registers the handler for a kind of job. Handlers should be
+// registered before Start, jobs without a handler are kept until one is.
+func (s *Scheduler) Handle(kind string, h Handler) {
+	s.Lock()
+	s.handlers[kind] = h
+	s.Unlock()
+	s.notify()
+}
+
+// Once schedules a job to run a single time.
+func (s *Scheduler) Once(kind string, at time.Time, data interface{}) (string, error) {
+	return s.add(&Job{Kind: kind, At: at, Missed: RunOnce}, data)
+}
+
+// Cron schedules a job to run at every time matching spec in the timezone
+// zone, an empty zone is UTC.
+func (s *Scheduler) Cron(kind, spec, zone string, missed Missed, data interface{}) (string, error) {
+	if _, err := ParseCron(spec); err != nil {
+		return "", err
+	}
+	if _, err := time.LoadLocation(zone); err != nil {
+		return "", err
+	}
+	job := &Job{Kind: kind, Cron: spec, Zone: zone, Missed: missed}
+	job.At = job.next(s.clock.Now())
+	if job.At.IsZero() {
+		return "", fmt.Errorf("%q never runs", spec)
+	}
+	return s.add(job, data)
+}
+
+func (s *Scheduler) add(job *Job, data interface{}) (string, error) {
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return "", err
+		}
+		job.Data = b
+	}
+
+	s.Lock()
+	s.nextID++
+	job.ID = strconv.Itoa(s.nextID)
+	s.jobs[job.ID] = job
+	s.Unlock()
+
+	s.notify()
+	return job.ID, s.Save()
+}
+
+// Cancel removes a job, it returns false if there was no such job.
+func (s *Scheduler) Cancel(id string) bool {
+	s.Lock()
+	_, ok := s.jobs[id]
+	delete(s.jobs, id)
+	s.Unlock()
+
+	if ok {
+		s.notify()
+		if err := s.Save(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return ok
+}
+
+// Get returns a copy of a job.
+func (s *Scheduler) Get(id string) (Job, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		return *job, true
+	}
+	return Job{}, false
+}
+
+// Jobs returns copies of the jobs of a kind, soonest first.
+func (s *Scheduler) Jobs(kind string) []Job {
+	s.Lock()
+	result := []Job{}
+	for _, job := range s.jobs {
+		if job.Kind == kind {
+			result = append(result, *job)
+		}
+	}
+	s.Unlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].At.Before(result[j].At) })
+	return result
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the jobs in the background until Stop.
+func (s *Scheduler) Start() {
+	s.Lock()
+	if s.stop != nil {
+		s.Unlock()
+		return
+	}
+	s.stop = make(chan struct{})
+	stop := s.stop
+	s.Unlock()
+
+	go s.loop(stop)
+}
+
+func (s *Scheduler) Stop() {
+	s.Lock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.Unlock()
+}
+
+func (s *Scheduler) loop(stop chan struct{}) {
+	// Runs missed while the bot was offline are handled here, before
+	// anything new gets scheduled
+	s.catchUp(s.clock.Now())
+
+	for {
+		var timer Timer
+		var fired <-chan time.Time
+		if at, ok := s.earliest(); ok {
+			timer = s.clock.NewTimer(at.Sub(s.clock.Now()))
+			fired = timer.C()
+		}
+
+		var stopped bool
+		select {
+		case <-stop:
+			stopped = true
+		case <-s.wake:
+		case now := <-fired:
+			s.runDue(now)
+		}
+		// The next pass arms a new timer, the old one mustn't linger
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// earliest returns when the next job with a handler is due.
+func (s *Scheduler) earliest() (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	var at time.Time
+	for _, job := range s.jobs {
+		if s.handlers[job.Kind] == nil {
+			continue
+		}
+		if at.IsZero() || job.At.Before(at) {
+			at = job.At
+		}
+	}
+	return at, !at.IsZero()
+}
+
+// catchUp applies the missed-run policy to every job that is overdue.
+func (s *Scheduler) catchUp(now time.Time) {
+	s.Lock()
+	var changed bool
+	for id, job := range s.jobs {
+		if job.Missed != Skip || job.At.After(now) {
+			continue
+		}
+		changed = true
+		if next := job.next(now); !next.IsZero() {
+			job.At = next
+		} else {
+			delete(s.jobs, id)
+		}
+	}
+	s.Unlock()
+
+	if changed {
+		if err := s.Save(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	s.runDue(now)
+}
+
+// runDue runs every job that is due. One-shot jobs are removed and cron
+// jobs are moved to their next run before the handlers are called.
+func (s *Scheduler) runDue(now time.Time) {
+	type run struct {
+		job Job
+		h   Handler
+	}
+	var runs []run
+
+	s.Lock()
+	for id, job := range s.jobs {
+		h := s.handlers[job.Kind]
+		if h == nil || job.At.After(now) {
+			continue
+		}
+		runs = append(runs, run{*job, h})
+		if next := job.next(now); !next.IsZero() {
+			job.At = next
+		} else {
+			delete(s.jobs, id)
+		}
+	}
+	s.Unlock()
+
+	if len(runs) == 0 {
+		return
+	}
+	if err := s.Save(); err != nil {
+		fmt.Println(err)
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].job.At.Before(runs[j].job.At) })
+	for _, r := range runs {
+		r.h(r.job)
+	}
+}
+
+func (s *Scheduler) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.Lock()
+	b, err := json.Marshal(struct {
+		NextID int             `json:"next_id"`
+		Jobs   map[string]*Job `json:"jobs"`
+	}{s.nextID, s.jobs})
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *Scheduler) Load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var state struct {
+		NextID int             `json:"next_id"`
+		Jobs   map[string]*Job `json:"jobs"`
+	}
+	if err = json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.nextID = state.NextID
+	if state.Jobs != nil {
+		s.jobs = state.Jobs
+	}
+	return nil
+}
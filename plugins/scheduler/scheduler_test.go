@@ -0,0 +1,231 @@
+package scheduler
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 3, 29, 8, 0, 0, 0, time.UTC)
+
+func newTestScheduler(t *testing.T, path string) (*Scheduler, *TestClock, chan Job) {
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "jobs.json")
+	}
+	clock := NewTestClock(start)
+	s := NewScheduler(path, clock)
+	ran := make(chan Job, 10)
+	s.Handle("test", func(job Job) { ran <- job })
+	return s, clock, ran
+}
+
+// waitWaiters waits until the scheduler is asleep with n timers pending.
+func waitWaiters(t *testing.T, clock *TestClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clock.Waiters() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers pending, want %d", clock.Waiters(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Give the loop a moment to arm anything it shouldn't
+	time.Sleep(10 * time.Millisecond)
+	if got := clock.Waiters(); got != n {
+		t.Fatalf("%d timers pending, want %d", got, n)
+	}
+}
+
+func expectRun(t *testing.T, ran chan Job, id string) Job {
+	t.Helper()
+	select {
+	case job := <-ran:
+		if job.ID != id {
+			t.Fatalf("job %s ran, want %s", job.ID, id)
+		}
+		return job
+	case <-time.After(time.Second):
+		t.Fatalf("job %s didn't run", id)
+	}
+	return Job{}
+}
+
+func expectNoRun(t *testing.T, ran chan Job) {
+	t.Helper()
+	select {
+	case job := <-ran:
+		t.Fatalf("job %s ran early", job.ID)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestOnce(t *testing.T) {
+	s, clock, ran := newTestScheduler(t, "")
+	id, err := s.Once("test", start.Add(time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Stop()
+	waitWaiters(t, clock, 1)
+
+	clock.Advance(59 * time.Minute)
+	expectNoRun(t, ran)
+	clock.Advance(time.Minute)
+	expectRun(t, ran, id)
+
+	waitWaiters(t, clock, 0)
+	if _, ok := s.Get(id); ok {
+		t.Error("one-shot job is still scheduled")
+	}
+}
+
+func TestRearmingStopsTheOldTimer(t *testing.T) {
+	s, clock, ran := newTestScheduler(t, "")
+	later, _ := s.Once("test", start.Add(2*time.Hour), nil)
+	s.Start()
+	defer s.Stop()
+	waitWaiters(t, clock, 1)
+
+	sooner, _ := s.Once("test", start.Add(time.Hour), nil)
+	waitWaiters(t, clock, 1)
+	s.Cancel("nothing")
+	waitWaiters(t, clock, 1)
+
+	clock.Advance(time.Hour)
+	expectRun(t, ran, sooner)
+	waitWaiters(t, clock, 1)
+	clock.Advance(time.Hour)
+	expectRun(t, ran, later)
+	waitWaiters(t, clock, 0)
+
+	s.Once("test", start.Add(3*time.Hour), nil)
+	waitWaiters(t, clock, 1)
+	s.Stop()
+	waitWaiters(t, clock, 0)
+}
+
+func TestCron(t *testing.T) {
+	s, clock, ran := newTestScheduler(t, "")
+	id, err := s.Cron("test", "0 9 * * *", "UTC", RunOnce, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Stop()
+	waitWaiters(t, clock, 1)
+
+	for day := 0; day < 3; day++ {
+		clock.Advance(time.Hour)
+		job := expectRun(t, ran, id)
+		if want := start.AddDate(0, 0, day).Add(time.Hour); !job.At.Equal(want) {
+			t.Errorf("ran the %s run, want %s", job.At, want)
+		}
+		waitWaiters(t, clock, 1)
+		clock.Advance(23 * time.Hour)
+	}
+
+	job, _ := s.Get(id)
+	if want := start.AddDate(0, 0, 3).Add(time.Hour); !job.At.Equal(want) {
+		t.Errorf("next run is %s, want %s", job.At, want)
+	}
+}
+
+func TestCronDST(t *testing.T) {
+	// Clocks in Stockholm go from 02:00 to 03:00 on March 31st 2024
+	s, clock, ran := newTestScheduler(t, "")
+	id, err := s.Cron("test", "0 9 * * *", "Europe/Stockholm", RunOnce, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Stop()
+	waitWaiters(t, clock, 1)
+
+	// 09:00 in winter time is 08:00 UTC, 07:00 UTC in summer time. The
+	// clock starts at 09:00, so the first run is the next day
+	want := []time.Time{
+		time.Date(2024, 3, 30, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 31, 7, 0, 0, 0, time.UTC),
+		time.Date(2024, 4, 1, 7, 0, 0, 0, time.UTC),
+	}
+	for i, at := range want {
+		clock.Advance(at.Sub(clock.Now()))
+		job := expectRun(t, ran, id)
+		if !job.At.Equal(at) {
+			t.Errorf("run %d was at %s, want %s", i, job.At.UTC(), at)
+		}
+		waitWaiters(t, clock, 1)
+	}
+
+}
+
+func TestCronSkippedAndRepeatedTimes(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skip(err)
+	}
+	sched, _ := ParseCron("30 2 * * *")
+	for _, c := range []struct {
+		name       string
+		from, want time.Time
+	}{
+		// 02:30 doesn't exist on March 31st, it runs right after the gap
+		{"forward", time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 1, 30, 0, 0, time.UTC)},
+		{"after forward", time.Date(2024, 3, 31, 1, 30, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 30, 0, 0, time.UTC)},
+		// 02:30 happens twice on October 27th, it only runs the first time
+		{"back", time.Date(2024, 10, 26, 12, 0, 0, 0, time.UTC), time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC)},
+		{"after back", time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC), time.Date(2024, 10, 28, 1, 30, 0, 0, time.UTC)},
+	} {
+		if next := sched.Next(c.from.In(loc)); !next.Equal(c.want) {
+			t.Errorf("%s: next run is %s, want %s", c.name, next.UTC(), c.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	s, _, _ := newTestScheduler(t, path)
+	once, _ := s.Once("test", start.Add(time.Hour), map[string]string{"text": "hello"})
+	cron, _ := s.Cron("test", "0 9 * * *", "UTC", Skip, nil)
+	missed, _ := s.Once("test", start.Add(-time.Hour), nil)
+	skipped, _ := s.Once("test", start.Add(-time.Hour), nil)
+	s.Lock()
+	s.jobs[skipped].Missed = Skip
+	s.Unlock()
+	s.Save()
+
+	// The bot comes back a day later
+	clock := NewTestClock(start.Add(24 * time.Hour))
+	loaded := NewScheduler(path, clock)
+	ran := make(chan Job, 10)
+	loaded.Handle("test", func(job Job) { ran <- job })
+
+	job, ok := loaded.Get(once)
+	var data map[string]string
+	if !ok || job.Decode(&data) != nil || data["text"] != "hello" {
+		t.Fatalf("job %s wasn't reloaded with its data: %+v", once, job)
+	}
+	if id, _ := loaded.Once("test", start.Add(48*time.Hour), nil); id == once || id == cron || id == missed || id == skipped {
+		t.Errorf("new job reused ID %s", id)
+	}
+
+	loaded.Start()
+	defer loaded.Stop()
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		got[(<-ran).ID] = true
+	}
+	expectNoRun(t, ran)
+	if !got[once] || !got[missed] {
+		t.Errorf("missed one-shot jobs didn't run once: %v", got)
+	}
+	if _, ok := loaded.Get(skipped); ok {
+		t.Error("skipped one-shot job is still scheduled")
+	}
+	job, _ = loaded.Get(cron)
+	if want := start.Add(25 * time.Hour); !job.At.Equal(want) {
+		t.Errorf("skipped cron job runs at %s, want %s", job.At, want)
+	}
+	waitWaiters(t, clock, 1)
+}
@@ -0,0 +1,398 @@
+package starboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/bwmarrin/discordgo"
+)
+
+type (
+	// Entry is a message that made it to the starboard.
+	Entry struct {
+		ChannelID   string `json:"channel_id"`
+		MessageID   string `json:"message_id"`
+		AuthorID    string `json:"author_id"`
+		StarboardID string `json:"starboard_id"`
+		Stars       int    `json:"stars"`
+	}
+
+	Server struct {
+		ID        string            `json:"id"`
+		Channel   string            `json:"channel"`
+		Emoji     string            `json:"emoji"`
+		Threshold int               `json:"threshold"`
+		NSFW      bool              `json:"nsfw"`
+		Entries   map[string]*Entry `json:"entries"`
+	}
+
+	Starboard struct {
+		sync.RWMutex
+		Servers []*Server `json:"servers"`
+
+		// Serializes reaction updates so a message is never posted twice
+		update sync.Mutex
+	}
+)
+
+var StarboardHelp = []string{
+	"stars -- Shows the starboard settings.",
+	"stars top -- The most starred messages.",
+	"stars channel [#channel] -- Sets the starboard channel, leave empty to turn off. Mod only.",
+	"stars threshold [N] -- Reactions needed to make the starboard. Mod only.",
+	"stars emoji [emoji] -- The reaction that counts as a star. Mod only.",
+	"stars nsfw [on|off] -- Allow messages from NSFW channels. Mod only.",
+}
+
+var (
+	idRegex    = regexp.MustCompile(`^<#([0-9]+)>$|^([0-9]+)$`)
+	emojiRegex = regexp.MustCompile(`^<a?:(\w+):([0-9]+)>$`)
+)
+
+func NewStarboard() *Starboard {
+	plugin := &Starboard{Servers: make([]*Server, 0)}
+	err := plugin.Load()
+	if err != nil {
+		fmt.Println(err.Error())
+		plugin.Save()
+	}
+	return plugin
+}
+
+func parseChannel(s string) string {
+	match := idRegex.FindStringSubmatch(s)
+	if match == nil {
+		return ""
+	}
+	if match[1] != "" {
+		return match[1]
+	}
+	return match[2]
+}
+
+func emojiName(s string) string {
+	if match := emojiRegex.FindStringSubmatch(s); match != nil {
+		return match[1] + ":" + match[2]
+	}
+	return s
+}
+
+func emojiString(name string) string {
+	if strings.Contains(name, ":") {
+		return "<:" + name + ">"
+	}
+	return name
+}
+
+// getServer must be called with the lock held.
+func (sb *Starboard) getServer(id string, create bool) *Server {
+	for _, s := range sb.Servers {
+		if s.ID == id {
+			return s
+		}
+	}
+	if !create {
+		return nil
+	}
+	s := &Server{
+		ID:        id,
+		Emoji:     "⭐",
+		Threshold: 3,
+		Entries:   make(map[string]*Entry),
+	}
+	sb.Servers = append(sb.Servers, s)
+	return s
+}
+
+func jumpLink(guildID, channelID, messageID string) string {
+	return "https://discord.com/channels/" + guildID + "/" + channelID + "/" + messageID
+}
+
+func starContent(emoji string, stars int, channelID string) string {
+	return fmt.Sprintf("%s **%d** <#%s>", emojiString(emoji), stars, channelID)
+}
+
+func starEmbed(guildID string, msg *discordgo.Message) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Author: &discordgo.MessageEmbedAuthor{
+			Name:    msg.Author.Username,
+			IconURL: msg.Author.AvatarURL(""),
+		},
+		Description: msg.Content,
+		Color:       0xffac33,
+		Timestamp:   msg.Timestamp.Format("2006-01-02T15:04:05Z07:00"),
+		Fields: []*discordgo.MessageEmbedField{{
+			Name:  "Source",
+			Value: "[Jump!](" + jumpLink(guildID, msg.ChannelID, msg.ID) + ")",
+		}},
+	}
+
+	var files []string
+	for _, a := range msg.Attachments {
+		if embed.Image == nil && a.Width > 0 {
+			embed.Image = &discordgo.MessageEmbedImage{URL: a.URL}
+			continue
+		}
+		files = append(files, "["+a.Filename+"]("+a.URL+")")
+	}
+	if len(files) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "Attachments",
+			Value: strings.Join(files, "\n"),
+		})
+	}
+	return embed
+}
+
+func countStars(msg *discordgo.Message, emoji string) int {
+	for _, r := range msg.Reactions {
+		if r.Emoji != nil && r.Emoji.APIName() == emoji {
+			return r.Count
+		}
+	}
+	return 0
+}
+
+// refresh recounts the stars of a message and posts, edits or removes its
+// starboard entry accordingly.
+func (sb *Starboard) refresh(s *discordgo.Session, guildID, channelID, messageID string) {
+	sb.update.Lock()
+	defer sb.update.Unlock()
+
+	sb.RLock()
+	srv := sb.getServer(guildID, false)
+	if srv == nil || srv.Channel == "" || channelID == srv.Channel {
+		sb.RUnlock()
+		return
+	}
+	settings := *srv
+	var entry Entry
+	existing := srv.Entries[messageID]
+	if existing != nil {
+		entry = *existing
+	}
+	sb.RUnlock()
+
+	if existing == nil && !settings.NSFW {
+		if ch, err := s.State.Channel(channelID); err == nil && ch.NSFW {
+			return
+		}
+	}
+
+	msg, err := s.ChannelMessage(channelID, messageID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	stars := countStars(msg, settings.Emoji)
+
+	switch {
+	case existing == nil && stars >= settings.Threshold:
+		post, err := s.ChannelMessageSendComplex(settings.Channel, &discordgo.MessageSend{
+			Content: starContent(settings.Emoji, stars, channelID),
+			Embeds:  []*discordgo.MessageEmbed{starEmbed(guildID, msg)},
+		})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		entry = Entry{
+			ChannelID:   channelID,
+			MessageID:   messageID,
+			AuthorID:    msg.Author.ID,
+			StarboardID: post.ID,
+		}
+	case existing != nil && stars < settings.Threshold:
+		s.ChannelMessageDelete(settings.Channel, entry.StarboardID)
+		sb.Lock()
+		delete(srv.Entries, messageID)
+		sb.Unlock()
+		sb.Save()
+		return
+	case existing != nil && stars != entry.Stars:
+		if _, err := s.ChannelMessageEdit(settings.Channel, entry.StarboardID, starContent(settings.Emoji, stars, channelID)); err != nil {
+			fmt.Println(err)
+		}
+	default:
+		return
+	}
+
+	entry.Stars = stars
+	sb.Lock()
+	srv.Entries[messageID] = &entry
+	sb.Unlock()
+	sb.Save()
+}
+
+func (sb *Starboard) isStar(guildID string, emoji *discordgo.Emoji) bool {
+	sb.RLock()
+	defer sb.RUnlock()
+	srv := sb.getServer(guildID, false)
+	return srv != nil && srv.Emoji == emoji.APIName()
+}
+
+func (sb *Starboard) OnReactionAdd(s *discordgo.Session, e *discordgo.MessageReactionAdd) {
+	if sb.isStar(e.GuildID, &e.Emoji) {
+		sb.refresh(s, e.GuildID, e.ChannelID, e.MessageID)
+	}
+}
+
+func (sb *Starboard) OnReactionRemove(s *discordgo.Session, e *discordgo.MessageReactionRemove) {
+	if sb.isStar(e.GuildID, &e.Emoji) {
+		sb.refresh(s, e.GuildID, e.ChannelID, e.MessageID)
+	}
+}
+
+func (sb *Starboard) OnReactionRemoveAll(s *discordgo.Session, e *discordgo.MessageReactionRemoveAll) {
+	sb.refresh(s, e.GuildID, e.ChannelID, e.MessageID)
+}
+
+func (sb *Starboard) top(m *dgofw.DiscordMessage) {
+	sb.RLock()
+	var entries []Entry
+	if srv := sb.getServer(m.GuildID(), false); srv != nil {
+		for _, e := range srv.Entries {
+			entries = append(entries, *e)
+		}
+	}
+	emoji := "⭐"
+	if srv := sb.getServer(m.GuildID(), false); srv != nil {
+		emoji = emojiString(srv.Emoji)
+	}
+	sb.RUnlock()
+
+	if len(entries) == 0 {
+		m.Reply("Nothing has been starred yet!")
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Stars > entries[j].Stars })
+	authors := make(map[string]int)
+	for _, e := range entries {
+		authors[e.AuthorID] += e.Stars
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("**Top messages**\n")
+	for i, e := range entries {
+		if i == 10 {
+			break
+		}
+		buf.WriteString(fmt.Sprintf("`%d` %s %d by <@%s> -- %s\n", i+1, emoji, e.Stars, e.AuthorID, jumpLink(m.GuildID(), e.ChannelID, e.MessageID)))
+	}
+
+	ids := make([]string, 0, len(authors))
+	for id := range authors {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return authors[ids[i]] > authors[ids[j]] })
+	buf.WriteString("\n**Top members**\n")
+	for i, id := range ids {
+		if i == 10 {
+			break
+		}
+		buf.WriteString(fmt.Sprintf("`%d` <@%s> -- %s %d\n", i+1, id, emoji, authors[id]))
+	}
+	m.Reply(buf.String())
+}
+
+func (sb *Starboard) OnMessage(m *dgofw.DiscordMessage) {
+	arg1, arg2 := m.Arg("arg1"), m.Arg("arg2")
+	if arg1 == "top" {
+		sb.top(m)
+		return
+	}
+	if arg1 != "" && !m.IsMod() {
+		return
+	}
+
+	if ch := parseChannel(arg2); arg1 == "channel" && ch != "" && !discordutil.ChannelInGuild(m.Session(), ch, m.GuildID()) {
+		m.Reply("That channel isn't in this server.")
+		return
+	}
+
+	sb.Lock()
+	var reply string
+	switch arg1 {
+	case "channel":
+		srv := sb.getServer(m.GuildID(), true)
+		srv.Channel = parseChannel(arg2)
+		if srv.Channel == "" {
+			reply = "Turned off the starboard"
+		} else {
+			reply = "Starboard set to <#" + srv.Channel + ">"
+		}
+	case "threshold":
+		if i, err := strconv.Atoi(arg2); err == nil && i > 0 {
+			sb.getServer(m.GuildID(), true).Threshold = i
+			reply = fmt.Sprintf("Messages now need %d stars", i)
+		} else {
+			reply = "Invalid number"
+		}
+	case "emoji":
+		if arg2 != "" {
+			sb.getServer(m.GuildID(), true).Emoji = emojiName(arg2)
+			reply = "Now counting " + arg2
+		}
+	case "nsfw":
+		srv := sb.getServer(m.GuildID(), true)
+		srv.NSFW = arg2 == "on"
+		if srv.NSFW {
+			reply = "Messages from NSFW channels can be starred"
+		} else {
+			reply = "Messages from NSFW channels can't be starred"
+		}
+	default:
+		if srv := sb.getServer(m.GuildID(), false); srv != nil && srv.Channel != "" {
+			reply = fmt.Sprintf("Posting messages with %d %s to <#%s>, NSFW: %t", srv.Threshold, emojiString(srv.Emoji), srv.Channel, srv.NSFW)
+		} else {
+			reply = "The starboard isn't set up."
+		}
+		sb.Unlock()
+		m.Reply(reply)
+		return
+	}
+	sb.Unlock()
+	sb.Save()
+
+	if reply != "" {
+		m.Reply(reply)
+	}
+}
+
+func (sb *Starboard) Save() (err error) {
+	sb.RLock()
+	defer sb.RUnlock()
+	var f *os.File
+	if f, err = os.Create("./starboardstate.json"); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(sb)
+	}
+	return
+}
+
+func (sb *Starboard) Load() (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile("./starboardstate.json"); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, sb); err != nil {
+		return
+	}
+	for _, s := range sb.Servers {
+		if s.Entries == nil {
+			s.Entries = make(map[string]*Entry)
+		}
+	}
+	return
+}
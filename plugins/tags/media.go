@@ -0,0 +1,234 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Attachments are stored in dataDir/<guild id>/<hex of tag name>/<file name>,
+// global tags use "global" as the guild id.
+const (
+	dataDir       = "./data/tags"
+	maxAttachment = 8 << 20
+	maxFiles      = 5
+)
+
+type (
+	EmbedField struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+
+	Embed struct {
+		Title       string        `json:"title,omitempty"`
+		Description string        `json:"description,omitempty"`
+		Image       string        `json:"image,omitempty"`
+		Color       int           `json:"color,omitempty"`
+		Fields      []*EmbedField `json:"fields,omitempty"`
+	}
+)
+
+var fileNameRegex = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// tagDir returns the directory of a tag's files. The name is hex encoded so
+// every tag gets its own directory and no name can point outside of it.
+func tagDir(guildID, name string) string {
+	if guildID == "" {
+		guildID = "global"
+	}
+	return filepath.Join(dataDir, fileNameRegex.ReplaceAllString(guildID, "_"), hex.EncodeToString([]byte(strings.ToLower(name))))
+}
+
+// removeTagDir deletes the files of a tag. It refuses anything that isn't a
+// tag directory, two levels below dataDir.
+func removeTagDir(dir string) {
+	rel, err := filepath.Rel(dataDir, dir)
+	parts := strings.Split(rel, string(filepath.Separator))
+	if err != nil || len(parts) != 2 {
+		fmt.Println("refusing to remove", dir)
+		return
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			fmt.Println("refusing to remove", dir)
+			return
+		}
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// setEmbed applies "title|description|image|color [value]", "field name|value[|inline]"
+// or "clear" to the embed of a tag.
+func setEmbed(tag *Tag, args string) error {
+	key, value := args, ""
+	if i := strings.IndexByte(args, ' '); i >= 0 {
+		key, value = args[:i], strings.TrimSpace(args[i+1:])
+	}
+
+	if key == "clear" {
+		tag.Embed = nil
+		return nil
+	}
+	if tag.Embed == nil {
+		tag.Embed = &Embed{}
+	}
+
+	switch key {
+	case "title":
+		tag.Embed.Title = value
+	case "description":
+		tag.Embed.Description = value
+	case "image":
+		tag.Embed.Image = strings.Trim(value, "<>")
+	case "color":
+		c, err := strconv.ParseInt(strings.TrimPrefix(value, "#"), 16, 32)
+		if err != nil {
+			return fmt.Errorf("colors are hex, like #f72e64")
+		}
+		tag.Embed.Color = int(c)
+	case "field":
+		parts := strings.SplitN(value, "|", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("fields are name|value or name|value|inline")
+		}
+		if len(tag.Embed.Fields) >= 25 {
+			return fmt.Errorf("embeds can't have more than 25 fields")
+		}
+		tag.Embed.Fields = append(tag.Embed.Fields, &EmbedField{
+			Name:   parts[0],
+			Value:  parts[1],
+			Inline: len(parts) == 3 && parts[2] == "inline",
+		})
+	default:
+		return fmt.Errorf("use title, description, image, color, field or clear")
+	}
+	return nil
+}
+
+// download saves the attachment at link as name in dir.
+func download(dir, name, link string) error {
+	if !discordutil.IsAttachment(link) {
+		return fmt.Errorf("%s isn't a Discord attachment", name)
+	}
+	res, err := discordutil.GetAttachment(link)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.ContentLength > maxAttachment {
+		return fmt.Errorf("%s is too big", name)
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(res.Body, maxAttachment+1))
+	if err == nil && n > maxAttachment {
+		err = fmt.Errorf("%s is too big", name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// attachFiles stores up to room attachments of the message and returns the
+// stored file names.
+func attachFiles(m message, dir string, room int) ([]string, error) {
+	attachments := m.Attachments()
+	if len(attachments) == 0 {
+		return nil, fmt.Errorf("upload the files with the command")
+	}
+	if len(attachments) > room {
+		return nil, fmt.Errorf("tags can't have more than %d files", maxFiles)
+	}
+
+	names := []string{}
+	for _, a := range attachments {
+		name := fileNameRegex.ReplaceAllString(a.Filename, "_")
+		if name == "." || name == ".." {
+			name = "file"
+		}
+		if err := download(dir, name, a.URL); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// build creates the reply for a tag, expanding the content and embed. It
+// must be called with the lock held.
+func build(tag *Tag, dir string, ctx *scriptContext) (*discordgo.MessageSend, error) {
+	content, err := expand(tag.Content, ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &discordgo.MessageSend{Content: content}
+	if tag.Embed != nil {
+		embed := &discordgo.MessageEmbed{Color: tag.Embed.Color}
+		if embed.Title, err = expand(tag.Embed.Title, ctx, 0); err != nil {
+			return nil, err
+		}
+		if embed.Description, err = expand(tag.Embed.Description, ctx, 0); err != nil {
+			return nil, err
+		}
+		if tag.Embed.Image != "" {
+			embed.Image = &discordgo.MessageEmbedImage{URL: tag.Embed.Image}
+		}
+		for _, field := range tag.Embed.Fields {
+			value, err := expand(field.Value, ctx, 0)
+			if err != nil {
+				return nil, err
+			}
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:   field.Name,
+				Value:  value,
+				Inline: field.Inline,
+			})
+		}
+		msg.Embeds = []*discordgo.MessageEmbed{embed}
+	}
+
+	for _, name := range tag.Files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		msg.Files = append(msg.Files, &discordgo.File{Name: name, Reader: bytes.NewReader(b)})
+	}
+	return msg, nil
+}
+
+func send(m message, msg *discordgo.MessageSend) {
+	if len(msg.Embeds) == 0 && len(msg.Files) == 0 {
+		m.Reply(msg.Content)
+		return
+	}
+	if err := m.Send(msg); err != nil {
+		fmt.Println(err)
+		m.Reply("Something happened...")
+	}
+}
@@ -0,0 +1,362 @@
+package tags
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Tag content can contain {blocks} which are expanded when the tag is used.
+// Blocks are expanded innermost first, so they can be nested.
+//
+//   {user} {mention} {channel} {server}  -- information about the invocation
+//   {args} {args:N}                      -- everything after the tag name, or the Nth word
+//   {choose:a|b|c}                       -- a random option
+//   {range:1|6}                          -- a random integer in the range, bounds within ±1e9
+//   {math:(1+2)*3}                       -- arithmetic with + - * / % ^
+//   {if:a==b|then|else}                  -- comparisons with == != < > <= >=
+//   {tag:name}                           -- the content of another tag
+//
+// Unknown blocks are left as they are.
+
+const (
+	maxOutput   = 2000
+	maxDepth    = 3
+	maxDuration = 100 * time.Millisecond
+	// maxRange is the largest bound {range} takes
+	maxRange = 1000000000
+)
+
+var (
+	errOutput  = errors.New("tag output is too long")
+	errTimeout = errors.New("tag took too long to run")
+	errDepth   = errors.New("tags are included too deep")
+)
+
+type scriptContext struct {
+	User     string
+	Mention  string
+	Channel  string
+	Server   string
+	Args     string
+	Deadline time.Time
+
+	// include returns the content of another tag
+	include func(name string) (string, bool)
+}
+
+func newScriptContext() *scriptContext {
+	return &scriptContext{Deadline: time.Now().Add(maxDuration)}
+}
+
+// expand runs the template language over content.
+func expand(content string, ctx *scriptContext, depth int) (string, error) {
+	if depth > maxDepth {
+		return "", errDepth
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(content); i++ {
+		if time.Now().After(ctx.Deadline) {
+			return "", errTimeout
+		}
+		if out.Len() > maxOutput {
+			return "", errOutput
+		}
+
+		if content[i] != '{' {
+			out.WriteByte(content[i])
+			continue
+		}
+
+		end := matchingBrace(content, i)
+		if end < 0 {
+			out.WriteString(content[i:])
+			break
+		}
+
+		inner, err := expand(content[i+1:end], ctx, depth)
+		if err != nil {
+			return "", err
+		}
+		result, err := block(inner, ctx, depth)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(result)
+		i = end
+	}
+
+	if out.Len() > maxOutput {
+		return "", errOutput
+	}
+	return out.String(), nil
+}
+
+func matchingBrace(s string, start int) int {
+	var level int
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			level++
+		case '}':
+			level--
+			if level == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func block(inner string, ctx *scriptContext, depth int) (string, error) {
+	name, arg := inner, ""
+	if i := strings.IndexByte(inner, ':'); i >= 0 {
+		name, arg = inner[:i], inner[i+1:]
+	}
+
+	switch name {
+	case "user":
+		return ctx.User, nil
+	case "mention":
+		return ctx.Mention, nil
+	case "channel":
+		return ctx.Channel, nil
+	case "server":
+		return ctx.Server, nil
+	case "args":
+		if arg == "" {
+			return ctx.Args, nil
+		}
+		fields := strings.Fields(ctx.Args)
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 && n <= len(fields) {
+			return fields[n-1], nil
+		}
+		return "", nil
+	case "choose":
+		options := strings.Split(arg, "|")
+		return options[rand.Intn(len(options))], nil
+	case "range":
+		bounds := strings.SplitN(arg, "|", 2)
+		if len(bounds) != 2 {
+			break
+		}
+		lo, err1 := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		hi, err2 := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		// Bounded so hi-lo+1 can't overflow
+		if err1 != nil || err2 != nil || hi < lo || lo < -maxRange || hi > maxRange {
+			break
+		}
+		return strconv.Itoa(lo + rand.Intn(hi-lo+1)), nil
+	case "math":
+		v, err := evalMath(arg)
+		if err != nil {
+			return "{math error: " + err.Error() + "}", nil
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case "if":
+		parts := strings.SplitN(arg, "|", 3)
+		for len(parts) < 3 {
+			parts = append(parts, "")
+		}
+		if compare(parts[0]) {
+			return parts[1], nil
+		}
+		return parts[2], nil
+	case "tag":
+		if ctx.include == nil {
+			break
+		}
+		content, ok := ctx.include(strings.TrimSpace(arg))
+		if !ok {
+			return "", nil
+		}
+		return expand(content, ctx, depth+1)
+	}
+	return "{" + inner + "}", nil
+}
+
+func compare(cond string) bool {
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		i := strings.Index(cond, op)
+		if i < 0 {
+			continue
+		}
+		lhs, rhs := strings.TrimSpace(cond[:i]), strings.TrimSpace(cond[i+len(op):])
+		a, err1 := strconv.ParseFloat(lhs, 64)
+		b, err2 := strconv.ParseFloat(rhs, 64)
+		numeric := err1 == nil && err2 == nil
+		switch op {
+		case "==":
+			if numeric {
+				return a == b
+			}
+			return strings.EqualFold(lhs, rhs)
+		case "!=":
+			if numeric {
+				return a != b
+			}
+			return !strings.EqualFold(lhs, rhs)
+		case "<=":
+			return numeric && a <= b
+		case ">=":
+			return numeric && a >= b
+		case "<":
+			return numeric && a < b
+		case ">":
+			return numeric && a > b
+		}
+	}
+	// No operator, anything but an empty string is true
+	return strings.TrimSpace(cond) != ""
+}
+
+// mathParser is a recursive descent parser for
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/" | "%") factor }
+//	factor = unary [ "^" factor ]
+//	unary  = [ "-" ] ( number | "(" expr ")" )
+type mathParser struct {
+	s   string
+	pos int
+}
+
+func evalMath(s string) (float64, error) {
+	p := &mathParser{s: s}
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	p.skip()
+	if p.pos != len(p.s) {
+		return 0, fmt.Errorf("unexpected %q", p.s[p.pos:])
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, errors.New("not a number")
+	}
+	return v, nil
+}
+
+func (p *mathParser) skip() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *mathParser) peek() byte {
+	p.skip()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *mathParser) expr() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			rhs, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v += rhs
+		case '-':
+			p.pos++
+			rhs, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v -= rhs
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *mathParser) term() (float64, error) {
+	v, err := p.factor()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return v, nil
+		}
+		p.pos++
+		rhs, err := p.factor()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			v *= rhs
+		case '/':
+			if rhs == 0 {
+				return 0, errors.New("division by zero")
+			}
+			v /= rhs
+		case '%':
+			if rhs == 0 {
+				return 0, errors.New("division by zero")
+			}
+			v = math.Mod(v, rhs)
+		}
+	}
+}
+
+func (p *mathParser) factor() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		exp, err := p.factor()
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(v, exp), nil
+	}
+	return v, nil
+}
+
+func (p *mathParser) unary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	case '(':
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, errors.New("missing )")
+		}
+		p.pos++
+		return v, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && (unicode.IsDigit(rune(p.s[p.pos])) || p.s[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		return 0, errors.New("expected a number")
+	}
+	return strconv.ParseFloat(p.s[start:p.pos], 64)
+}
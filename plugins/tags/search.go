@@ -0,0 +1,85 @@
+package tags
+
+import (
+	"sort"
+	"strings"
+)
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// score ranks how well name matches query, lower is better and -1 is no match.
+func score(name, query string) int {
+	name, query = strings.ToLower(name), strings.ToLower(query)
+	switch {
+	case name == query:
+		return 0
+	case strings.HasPrefix(name, query):
+		return 1
+	case strings.Contains(name, query):
+		return 2
+	}
+	d := levenshtein(name, query)
+	if d > len([]rune(query))/2+1 {
+		return -1
+	}
+	return 2 + d
+}
+
+// search returns up to limit tag names of the server ranked by how well
+// they match query. It must be called with the lock held.
+func (s *Server) search(query string, limit int) []string {
+	type match struct {
+		name  string
+		score int
+	}
+	matches := []match{}
+	for _, tag := range s.Tags {
+		if sc := score(tag.Name, query); sc >= 0 {
+			matches = append(matches, match{tag.Name, sc})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score == matches[j].score {
+			return matches[i].name < matches[j].name
+		}
+		return matches[i].score < matches[j].score
+	})
+
+	result := []string{}
+	for i, match := range matches {
+		if i == limit {
+			break
+		}
+		result = append(result, match.name)
+	}
+	return result
+}
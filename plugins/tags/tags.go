@@ -3,144 +3,930 @@ package tags
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/bwmarrin/discordgo"
 )
 
+// Tag is a named snippet of text. Aliases have an empty Content and point
+// to the tag they alias with AliasOf.
 type Tag struct {
-	Name    string
-	OwnerID string `json:"owner_id"`
-	Content string `json:"content"`
+	Name      string
+	OwnerID   string    `json:"owner_id"`
+	Content   string    `json:"content"`
+	AliasOf   string    `json:"alias_of,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	EditedAt  time.Time `json:"edited_at"`
+	Uses      int       `json:"uses"`
+	Embed     *Embed    `json:"embed,omitempty"`
+	Files     []string  `json:"files,omitempty"`
 }
 
+// Server is the tags of a single guild, indexed by lower case name.
 type Server struct {
-	ID   string `json:"id"`
-	Tags []*Tag `json:"tags"`
+	ID   string          `json:"id"`
+	Tags map[string]*Tag `json:"tags"`
 }
 
+// Tags holds the tags of every server, and the global tags managed by the
+// bot owner. Server tags shadow global tags with the same name.
+//
+// Everything is guarded by the embedded lock, handlers take it only while
+// touching the index and never while talking to Discord. Every change is
+// saved right away, use counts are saved every flushInterval.
 type Tags struct {
 	sync.RWMutex
-	Guilds []*Server `json:"servers"`
+	Guilds map[string]*Server `json:"servers"`
+	Global *Server            `json:"global"`
+
+	ownerID string
+	path    string
+	// saveMu guards dirty, which is set when there are unsaved use counts
+	saveMu sync.Mutex
+	dirty  bool
+	// stop ends the periodic flush, it's closed by Close
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// message is the part of a Discord message the tags plugin needs.
+type message interface {
+	Arg(name string) string
+	GuildID() string
+	ChannelID() string
+	IsMod() bool
+	AuthorID() string
+	AuthorName() string
+	GuildName() string
+	IsMember(userID string) bool
+	Attachments() []*discordgo.MessageAttachment
+	Reply(text string)
+	Send(msg *discordgo.MessageSend) error
+}
+
+type discordMessage struct {
+	*dgofw.DiscordMessage
+}
+
+func (m discordMessage) AuthorID() string   { return m.Author.ID() }
+func (m discordMessage) AuthorName() string { return m.Author.Username() }
+func (m discordMessage) GuildName() string  { return m.Guild().Name() }
+
+// tagMentions is what replies may ping. Tag content, {args} and names typed
+// by members end up in replies, so only users are ever pinged, never roles or
+// everyone, whatever permissions the bot has.
+var tagMentions = &discordgo.MessageAllowedMentions{
+	Parse: []discordgo.AllowedMentionType{discordgo.AllowedMentionTypeUsers},
+}
+
+func (m discordMessage) Reply(text string) {
+	if err := m.Send(&discordgo.MessageSend{Content: text}); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// IsMember reports whether a user is in the guild. The state cache doesn't
+// have every member, so a miss is checked with the API, and only an unknown
+// member counts as gone. Any other error assumes they're still here.
+func (m discordMessage) IsMember(userID string) bool {
+	if m.Guild().Member(userID) != nil {
+		return true
+	}
+	_, err := m.Session().GuildMember(m.GuildID(), userID)
+	if err == nil {
+		return true
+	}
+	if rerr, ok := err.(*discordgo.RESTError); ok && rerr.Message != nil {
+		return rerr.Message.Code != discordgo.ErrCodeUnknownMember
+	}
+	fmt.Println(err)
+	return true
+}
+
+func (m discordMessage) Attachments() []*discordgo.MessageAttachment {
+	msg, err := m.Session().ChannelMessage(m.ChannelID(), m.ID())
+	if err != nil {
+		return nil
+	}
+	return msg.Attachments
+}
+
+func (m discordMessage) Send(msg *discordgo.MessageSend) error {
+	msg.AllowedMentions = tagMentions
+	_, err := m.Session().ChannelMessageSendComplex(m.ChannelID(), msg)
+	return err
 }
 
 var TagsHelp = []string{
-	"tag [name]                -- Sends the contents of the tag.",
+	"tag [name]                -- Sends the contents of the tag. Names are case insensitive.",
+	"tag get [name]            -- Sends a tag whose name is also a tag command.",
 	"tag add [name] [content]  -- Adds a new tag.",
 	"tag remove [name]         -- Removes the tag, only usable by mods and the tag owner of the tag.",
 	"tag edit [name] [content] -- Edits a tag, only usable by mods and the tag owner.",
+	"tag list [@user] [page]   -- Lists the tags of the server or a user.",
+	"tag search [query]        -- Searches for tags by name.",
+	"tag info [name]           -- Shows who owns a tag, when it was made and how often it's used.",
+	"tag alias [new] [name]    -- Makes a new name for an existing tag.",
+	"tag transfer [name] [@user] -- Gives a tag to someone else, only usable by mods and the tag owner.",
+	"tag claim [name]          -- Takes over a tag whose owner left the server.",
+	"Tag content can use {user}, {mention}, {channel}, {server}, {args}, {args:N}, {choose:a|b},",
+	"{range:1|6}, {math:1+2*3}, {if:a==b|then|else} and {tag:name}.",
+	"tag embed [name] [title|description|image|color] [value] -- Sets part of the tag's embed.",
+	"tag embed [name] field [name|value|inline] -- Adds a field to the tag's embed, 'tag embed [name] clear' removes it.",
+	"tag attach [name]         -- Attaches the files uploaded with the command to the tag.",
+	"tag detach [name]         -- Removes all files from the tag.",
+	"tag global [add|edit|remove] [name] [content] -- Manages global tags, only usable by the bot owner.",
+	"tag global list           -- Lists the global tags.",
 }
 
-func (t *Tags) load() {
-	if b, err := ioutil.ReadFile("./tagsstate.json"); err == nil {
-		json.Unmarshal(b, t)
+const (
+	tagsPerPage   = 20
+	flushInterval = time.Minute
+)
+
+// NewTags creates the tags plugin, ownerID is the user allowed to manage
+// global tags.
+func NewTags(ownerID string) *Tags {
+	result := newTags(ownerID, "./tagsstate.json")
+	if err := result.load(); err != nil && !os.IsNotExist(err) {
+		fmt.Println(err)
 	}
+	go result.flushLoop()
+	return result
 }
 
-func NewTags() *Tags {
-	result := &Tags{
-		Guilds: []*Server{},
+func newTags(ownerID, path string) *Tags {
+	return &Tags{
+		Guilds:  make(map[string]*Server),
+		Global:  newServer(""),
+		ownerID: ownerID,
+		path:    path,
+		stop:    make(chan struct{}),
 	}
+}
 
-	result.load()
-	return result
+// subcommands are the names handled before tags are looked up. Tags can't
+// be named like them, older tags that are can only be sent with tag get.
+var subcommands = map[string]bool{
+	"add": true, "remove": true, "edit": true, "get": true, "list": true,
+	"search": true, "info": true, "alias": true, "transfer": true,
+	"claim": true, "embed": true, "attach": true, "detach": true,
+	"global": true,
+}
+
+func reserved(name string) bool {
+	return subcommands[key(name)]
+}
+
+func newServer(id string) *Server {
+	return &Server{ID: id, Tags: make(map[string]*Tag)}
+}
+
+func key(name string) string {
+	return strings.ToLower(name)
 }
 
-func (t *Tags) save() {
-	if f, err := os.Create("./tagsstate.json"); err == nil {
-		b, _ := json.Marshal(t)
-		f.Write(b)
+// UnmarshalJSON also reads the old format where tags were a list.
+func (s *Server) UnmarshalJSON(b []byte) error {
+	var state struct {
+		ID   string          `json:"id"`
+		Tags json.RawMessage `json:"tags"`
 	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+
+	s.ID = state.ID
+	s.Tags = make(map[string]*Tag)
+	if len(state.Tags) == 0 || string(state.Tags) == "null" {
+		return nil
+	}
+	if state.Tags[0] != '[' {
+		return json.Unmarshal(state.Tags, &s.Tags)
+	}
+
+	var list []*Tag
+	if err := json.Unmarshal(state.Tags, &list); err != nil {
+		return err
+	}
+	for _, tag := range list {
+		if tag != nil && s.Tags[key(tag.Name)] == nil {
+			s.Tags[key(tag.Name)] = tag
+		}
+	}
+	return nil
 }
 
-func (t *Tags) addTag(m *dgofw.DiscordMessage, name, content string) {
+func (t *Tags) load() error {
+	b, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+
+	var state struct {
+		Servers json.RawMessage `json:"servers"`
+		Global  *Server         `json:"global"`
+	}
+	if err = json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+
 	t.Lock()
 	defer t.Unlock()
-	tg := m.GuildID()
-	for _, guild := range t.Guilds {
-		if guild.ID == tg {
-			guild.Tags = append(guild.Tags, &Tag{
-				OwnerID: m.Author.ID(),
-				Content: content,
-				Name:    name,
-			})
-			m.Reply("'Added tag '" + name + "'")
-			return
+	defer t.warnReserved()
+	if state.Global != nil {
+		t.Global = state.Global
+	}
+	if len(state.Servers) == 0 || string(state.Servers) == "null" {
+		return nil
+	}
+	if state.Servers[0] != '[' {
+		return json.Unmarshal(state.Servers, &t.Guilds)
+	}
+
+	// Servers used to be a list
+	var list []*Server
+	if err = json.Unmarshal(state.Servers, &list); err != nil {
+		return err
+	}
+	for _, s := range list {
+		if s != nil && s.ID != "" {
+			t.Guilds[s.ID] = s
 		}
 	}
+	return nil
 }
 
-func (t *Tags) delTag(m *dgofw.DiscordMessage, name string) {
-	tg := m.GuildID()
-	for _, guild := range t.Guilds {
-		if guild.ID == tg {
-			for i, tag := range guild.Tags {
-				if tag.Name == name {
-					if m.IsMod() || m.Author.ID() == tag.OwnerID {
-						t.Lock()
-						guild.Tags = append(guild.Tags[:i-1], guild.Tags[i:]...)
-						t.Unlock()
-						m.Reply("Removed tag '" + name + "'")
-						return
-					}
-				}
-			}
+// warnReserved prints the tags saved before their names became commands.
+// It must be called with the lock held.
+func (t *Tags) warnReserved() {
+	for _, srv := range t.Guilds {
+		srv.warnReserved()
+	}
+	t.Global.warnReserved()
+}
+
+func (s *Server) warnReserved() {
+	where := "server " + s.ID
+	if s.ID == "" {
+		where = "the global tags"
+	}
+	for _, tag := range s.Tags {
+		if reserved(tag.Name) {
+			fmt.Printf("tag '%s' in %s is named like a command, it can only be sent with tag get\n", tag.Name, where)
 		}
 	}
 }
 
-func (t *Tags) editTag(m *dgofw.DiscordMessage, name, content string) {
-	tg := m.GuildID()
-	for _, guild := range t.Guilds {
-		if guild.ID == tg {
-			for _, tag := range guild.Tags {
-				if tag.Name == name {
-					if m.IsMod() || m.Author.ID() == tag.OwnerID {
-						t.Lock()
-						tag.Content = content
-						t.Unlock()
-						m.Reply("Edited tag '" + name + "'")
-						return
-					}
-				}
+// save writes the tags to a temporary file and moves it in place, so a
+// crash mid-write never leaves a truncated state file behind.
+func (t *Tags) save() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+	return t.write()
+}
+
+// write saves the tags, it must be called with saveMu held.
+func (t *Tags) write() error {
+	t.RLock()
+	b, err := json.Marshal(struct {
+		Servers map[string]*Server `json:"servers"`
+		Global  *Server            `json:"global"`
+	}{t.Guilds, t.Global})
+	t.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := t.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+// markDirty records that there are changes to save on the next flush.
+func (t *Tags) markDirty() {
+	t.saveMu.Lock()
+	t.dirty = true
+	t.saveMu.Unlock()
+}
+
+// Flush saves the tags if anything changed since they were last saved.
+func (t *Tags) Flush() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+	if !t.dirty {
+		return nil
+	}
+	return t.write()
+}
+
+// flushLoop flushes the tags every flushInterval until Close.
+func (t *Tags) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Flush(); err != nil {
+				fmt.Println(err)
 			}
+		case <-t.stop:
+			return
 		}
 	}
 }
 
-func (t *Tags) getTag(m *dgofw.DiscordMessage, name string) {
-	tg := m.GuildID()
-	for _, guild := range t.Guilds {
-		if guild.ID == tg {
-			for _, tag := range guild.Tags {
-				if tag.Name == name {
-					m.Reply(tag.Content)
-					return
-				}
-			}
-			var buf bytes.Buffer
-			buf.WriteString("Couldn't find tag '" + name + "'.\n")
-			for _, tag := range guild.Tags {
-				if strings.Contains(tag.Name, name) {
-					buf.WriteString("**" + tag.Name + "**\n")
-				}
+// Close stops the periodic flush and saves the use counts one last time.
+func (t *Tags) Close() error {
+	t.closeOnce.Do(func() { close(t.stop) })
+	return t.Flush()
+}
+
+func (t *Tags) persist(m message) {
+	if err := t.save(); err != nil {
+		fmt.Println(err)
+		m.Reply("Couldn't save the tags: " + err.Error())
+	}
+}
+
+// server returns the tags of a guild. It must be called with the lock held,
+// and the write lock if create is true.
+func (t *Tags) server(guildID string, create bool) *Server {
+	s := t.Guilds[guildID]
+	if s == nil && create {
+		s = newServer(guildID)
+		t.Guilds[guildID] = s
+	}
+	return s
+}
+
+func (s *Server) find(name string) *Tag {
+	if s == nil {
+		return nil
+	}
+	return s.Tags[key(name)]
+}
+
+// resolve follows an alias to the tag it points to.
+func (s *Server) resolve(tag *Tag) *Tag {
+	if tag.AliasOf == "" {
+		return tag
+	}
+	if target := s.find(tag.AliasOf); target != nil {
+		return target
+	}
+	return tag
+}
+
+// remove deletes a tag and every alias pointing to it.
+func (s *Server) remove(tag *Tag) {
+	delete(s.Tags, key(tag.Name))
+	if tag.AliasOf != "" {
+		return
+	}
+	for k, other := range s.Tags {
+		if key(other.AliasOf) == key(tag.Name) {
+			delete(s.Tags, k)
+		}
+	}
+}
+
+// lookup finds a tag and the server it belongs to, following aliases.
+// Server tags are looked up first, then global tags. It must be called
+// with the lock held.
+func (t *Tags) lookup(guildID, name string) (*Tag, *Server) {
+	for _, srv := range []*Server{t.server(guildID, false), t.Global} {
+		if tag := srv.find(name); tag != nil {
+			return srv.resolve(tag), srv
+		}
+	}
+	return nil, nil
+}
+
+// editable finds a tag the author may change: a server tag owned by them or
+// any server tag for mods, or a global tag for the bot owner. It must be
+// called with the lock held.
+func (t *Tags) editable(m message, name string) (*Tag, *Server) {
+	if guild := t.server(m.GuildID(), false); guild != nil {
+		if tag := guild.find(name); tag != nil {
+			if tag.AliasOf != "" || !(m.IsMod() || m.AuthorID() == tag.OwnerID) {
+				return nil, nil
 			}
-			if len(guild.Tags) > 0 {
-				m.Reply("Did you mean:\n" + buf.String())
-			} else {
-				m.Reply("Couldn't find tag '" + name + "'.")
+			return tag, guild
+		}
+	}
+	if tag := t.Global.find(name); tag != nil && tag.AliasOf == "" && t.ownerID != "" && m.AuthorID() == t.ownerID {
+		return tag, t.Global
+	}
+	return nil, nil
+}
+
+func (t *Tags) addTag(m message, name, content string) {
+	if reserved(name) {
+		m.Reply("'" + name + "' is a tag command and can't be a tag name.")
+		return
+	}
+	t.Lock()
+	guild := t.server(m.GuildID(), true)
+	if guild.find(name) != nil {
+		t.Unlock()
+		m.Reply("Tag '" + name + "' already exists.")
+		return
+	}
+	now := time.Now()
+	guild.Tags[key(name)] = &Tag{
+		Name:      name,
+		OwnerID:   m.AuthorID(),
+		Content:   content,
+		CreatedAt: now,
+		EditedAt:  now,
+	}
+	t.Unlock()
+
+	t.persist(m)
+	m.Reply("Added tag '" + name + "'")
+}
+
+func (t *Tags) delTag(m message, name string) {
+	t.Lock()
+	guild := t.server(m.GuildID(), false)
+	tag := guild.find(name)
+	if tag == nil || !(m.IsMod() || m.AuthorID() == tag.OwnerID) {
+		t.Unlock()
+		m.Reply("Couldn't find a tag '" + name + "' you own.")
+		return
+	}
+	guild.remove(tag)
+	dir := tagDir(guild.ID, tag.Name)
+	t.Unlock()
+
+	if tag.AliasOf == "" {
+		removeTagDir(dir)
+	}
+	t.persist(m)
+	m.Reply("Removed tag '" + name + "'")
+}
+
+func (t *Tags) editTag(m message, name, content string) {
+	t.Lock()
+	tag := t.server(m.GuildID(), false).find(name)
+	if tag == nil || tag.AliasOf != "" || !(m.IsMod() || m.AuthorID() == tag.OwnerID) {
+		t.Unlock()
+		m.Reply("Couldn't find a tag '" + name + "' you own.")
+		return
+	}
+	tag.Content = content
+	tag.EditedAt = time.Now()
+	t.Unlock()
+
+	t.persist(m)
+	m.Reply("Edited tag '" + name + "'")
+}
+
+func (t *Tags) getTag(m message, name, args string) {
+	t.Lock()
+	tag, srv := t.lookup(m.GuildID(), name)
+	if tag != nil {
+		tag.Uses++
+	}
+	t.Unlock()
+
+	if tag == nil {
+		t.RLock()
+		suggestions := append(t.server(m.GuildID(), false).searchOrNil(name, 5), t.Global.search(name, 5)...)
+		t.RUnlock()
+		if len(suggestions) > 5 {
+			suggestions = suggestions[:5]
+		}
+
+		if len(suggestions) > 0 {
+			m.Reply("Couldn't find tag '" + name + "'. Did you mean:\n**" + strings.Join(suggestions, "**\n**") + "**")
+		} else {
+			m.Reply("Couldn't find tag '" + name + "'.")
+		}
+		return
+	}
+	// Counting a use doesn't need the whole file written right away
+	t.markDirty()
+
+	t.RLock()
+	msg, err := build(tag, tagDir(srv.ID, tag.Name), t.scriptContext(m, args))
+	t.RUnlock()
+	if err != nil {
+		m.Reply("Couldn't run tag '" + name + "': " + err.Error())
+		return
+	}
+	send(m, msg)
+}
+
+func (s *Server) searchOrNil(query string, limit int) []string {
+	if s == nil {
+		return nil
+	}
+	return s.search(query, limit)
+}
+
+// scriptContext must be called with the lock held, and the context must
+// only be used while it is.
+func (t *Tags) scriptContext(m message, args string) *scriptContext {
+	ctx := newScriptContext()
+	ctx.User = m.AuthorName()
+	ctx.Mention = "<@" + m.AuthorID() + ">"
+	ctx.Channel = "<#" + m.ChannelID() + ">"
+	ctx.Server = m.GuildName()
+	ctx.Args = args
+	ctx.include = func(name string) (string, bool) {
+		if tag, _ := t.lookup(m.GuildID(), name); tag != nil {
+			return tag.Content, true
+		}
+		return "", false
+	}
+	return ctx
+}
+
+func (t *Tags) listTags(m message, args []string) {
+	var owner string
+	page := 1
+	for _, arg := range args {
+		// Snowflakes are far longer than any page number
+		if id := discordutil.ParseUserID(arg); id != "" && len(id) > 6 {
+			owner = id
+		} else if i, err := strconv.Atoi(arg); err == nil && i > 0 {
+			page = i
+		}
+	}
+
+	t.RLock()
+	names := []string{}
+	if guild := t.server(m.GuildID(), false); guild != nil {
+		for _, tag := range guild.Tags {
+			if tag.AliasOf == "" && (owner == "" || tag.OwnerID == owner) {
+				names = append(names, tag.Name)
 			}
+		}
+	}
+	t.RUnlock()
+
+	if len(names) == 0 {
+		m.Reply("No tags found.")
+		return
+	}
+
+	sort.Strings(names)
+	pages := (len(names) + tagsPerPage - 1) / tagsPerPage
+	if page > pages {
+		page = pages
+	}
+	end := page * tagsPerPage
+	if end > len(names) {
+		end = len(names)
+	}
+
+	var buf bytes.Buffer
+	if owner != "" {
+		buf.WriteString("Tags by <@" + owner + ">")
+	} else {
+		buf.WriteString("Tags")
+	}
+	buf.WriteString(fmt.Sprintf(" (page %d/%d, %d total)\n", page, pages, len(names)))
+	buf.WriteString(strings.Join(names[(page-1)*tagsPerPage:end], ", "))
+	m.Reply(buf.String())
+}
+
+func (t *Tags) searchTags(m message, query string) {
+	t.RLock()
+	results := t.server(m.GuildID(), false).searchOrNil(query, 15)
+	t.RUnlock()
+
+	if len(results) == 0 {
+		m.Reply("No tags found.")
+		return
+	}
+	m.Reply("**" + strings.Join(results, "**\n**") + "**")
+}
+
+func (t *Tags) tagInfo(m message, name string) {
+	t.RLock()
+	var info string
+	for _, srv := range []*Server{t.server(m.GuildID(), false), t.Global} {
+		tag := srv.find(name)
+		if tag == nil {
+			continue
+		}
+
+		target := srv.resolve(tag)
+		var buf bytes.Buffer
+		buf.WriteString("**" + tag.Name + "**\n")
+		if srv == t.Global {
+			buf.WriteString("Scope: global\n")
+		} else if t.Global.find(name) != nil {
+			buf.WriteString("Scope: server, shadows a global tag\n")
+		} else {
+			buf.WriteString("Scope: server\n")
+		}
+		if tag.AliasOf != "" {
+			buf.WriteString("Alias of: **" + tag.AliasOf + "**\n")
+		}
+		buf.WriteString("Owner: <@" + tag.OwnerID + ">\n")
+		buf.WriteString("Created: " + tag.CreatedAt.Format("2006-01-02 15:04") + "\n")
+		buf.WriteString("Edited: " + target.EditedAt.Format("2006-01-02 15:04") + "\n")
+		buf.WriteString(fmt.Sprintf("Uses: %d\n", target.Uses))
+		if target.Embed != nil {
+			buf.WriteString("Has an embed\n")
+		}
+		if len(target.Files) > 0 {
+			buf.WriteString("Files: " + strings.Join(target.Files, ", ") + "\n")
+		}
+		buf.WriteString("Lookup order: server tags and aliases, then global tags.")
+		info = buf.String()
+		break
+	}
+	t.RUnlock()
+
+	if info == "" {
+		m.Reply("Couldn't find tag '" + name + "'.")
+		return
+	}
+	m.Reply(info)
+}
+
+func (t *Tags) aliasTag(m message, alias, name string) {
+	if reserved(alias) {
+		m.Reply("'" + alias + "' is a tag command and can't be a tag name.")
+		return
+	}
+	t.Lock()
+	guild := t.server(m.GuildID(), false)
+	tag := guild.find(name)
+	if tag == nil {
+		t.Unlock()
+		m.Reply("Couldn't find tag '" + name + "'.")
+		return
+	}
+	if guild.find(alias) != nil {
+		t.Unlock()
+		m.Reply("Tag '" + alias + "' already exists.")
+		return
+	}
+	now := time.Now()
+	guild.Tags[key(alias)] = &Tag{
+		Name:      alias,
+		OwnerID:   m.AuthorID(),
+		AliasOf:   guild.resolve(tag).Name,
+		CreatedAt: now,
+		EditedAt:  now,
+	}
+	t.Unlock()
+
+	t.persist(m)
+	m.Reply("Added alias '" + alias + "' for '" + name + "'")
+}
+
+func (t *Tags) transferTag(m message, name, user string) {
+	id := discordutil.ParseUserID(user)
+	if id == "" {
+		m.Reply("Who should get the tag?")
+		return
+	}
+
+	t.Lock()
+	tag := t.server(m.GuildID(), false).find(name)
+	if tag == nil || !(m.IsMod() || m.AuthorID() == tag.OwnerID) {
+		t.Unlock()
+		m.Reply("Couldn't find a tag '" + name + "' you own.")
+		return
+	}
+	tag.OwnerID = id
+	t.Unlock()
+
+	t.persist(m)
+	m.Reply("Gave '" + name + "' to <@" + id + ">")
+}
+
+func (t *Tags) claimTag(m message, name string) {
+	t.RLock()
+	var owner string
+	if tag := t.server(m.GuildID(), false).find(name); tag != nil {
+		owner = tag.OwnerID
+	}
+	t.RUnlock()
+
+	if owner == "" {
+		m.Reply("Couldn't find tag '" + name + "'.")
+		return
+	}
+	if m.IsMember(owner) {
+		m.Reply("The owner of '" + name + "' is still here.")
+		return
+	}
+
+	t.Lock()
+	if tag := t.server(m.GuildID(), false).find(name); tag != nil && tag.OwnerID == owner {
+		tag.OwnerID = m.AuthorID()
+	}
+	t.Unlock()
+
+	t.persist(m)
+	m.Reply("You now own '" + name + "'")
+}
+
+func (t *Tags) embedTag(m message, name, args string) {
+	t.Lock()
+	tag, _ := t.editable(m, name)
+	if tag == nil {
+		t.Unlock()
+		m.Reply("Couldn't find a tag '" + name + "' you can edit.")
+		return
+	}
+	err := setEmbed(tag, args)
+	if err == nil {
+		tag.EditedAt = time.Now()
+	}
+	t.Unlock()
+
+	if err != nil {
+		m.Reply(err.Error())
+		return
+	}
+	t.persist(m)
+	m.Reply("Updated the embed of '" + name + "'")
+}
+
+func (t *Tags) attachTag(m message, name string) {
+	t.RLock()
+	tag, srv := t.editable(m, name)
+	var dir string
+	var room int
+	if tag != nil {
+		dir = tagDir(srv.ID, tag.Name)
+		room = maxFiles - len(tag.Files)
+	}
+	t.RUnlock()
+
+	if tag == nil {
+		m.Reply("Couldn't find a tag '" + name + "' you can edit.")
+		return
+	}
+
+	names, err := attachFiles(m, dir, room)
+
+	// The tag may have been removed or replaced during the download
+	t.Lock()
+	if current, _ := t.editable(m, name); current != tag {
+		t.Unlock()
+		for _, file := range names {
+			os.Remove(filepath.Join(dir, file))
+		}
+		m.Reply("'" + name + "' was removed while the files were downloading.")
+		return
+	}
+	var added []string
+	for _, file := range names {
+		exists := false
+		for _, f := range tag.Files {
+			exists = exists || f == file
+		}
+		switch {
+		case exists:
+		case len(tag.Files) < maxFiles:
+			tag.Files = append(tag.Files, file)
+		default:
+			os.Remove(filepath.Join(dir, file))
+			continue
+		}
+		added = append(added, file)
+	}
+	tag.EditedAt = time.Now()
+	t.Unlock()
+	t.persist(m)
+
+	if err != nil {
+		m.Reply(err.Error())
+		return
+	}
+	m.Reply(fmt.Sprintf("Attached %s to '%s'", strings.Join(added, ", "), name))
+}
+
+func (t *Tags) detachTag(m message, name string) {
+	t.Lock()
+	tag, srv := t.editable(m, name)
+	if tag == nil {
+		t.Unlock()
+		m.Reply("Couldn't find a tag '" + name + "' you can edit.")
+		return
+	}
+	tag.Files = nil
+	dir := tagDir(srv.ID, tag.Name)
+	t.Unlock()
+
+	removeTagDir(dir)
+	t.persist(m)
+	m.Reply("Removed the files of '" + name + "'")
+}
+
+func (t *Tags) globalTag(m message, cmd, args string) {
+	if cmd == "list" {
+		t.RLock()
+		names := []string{}
+		for _, tag := range t.Global.Tags {
+			names = append(names, tag.Name)
+		}
+		t.RUnlock()
+		sort.Strings(names)
+		if len(names) == 0 {
+			m.Reply("There are no global tags.")
 			return
 		}
+		m.Reply("**Global tags**\n" + strings.Join(names, ", "))
+		return
+	}
+
+	if t.ownerID == "" || m.AuthorID() != t.ownerID {
+		return
+	}
+	name, content := args, ""
+	if i := strings.IndexByte(args, ' '); i >= 0 {
+		name, content = args[:i], strings.TrimSpace(args[i+1:])
+	}
+	if name == "" {
+		return
+	}
+
+	t.Lock()
+	tag := t.Global.find(name)
+	var reply string
+	switch cmd {
+	case "add":
+		if tag != nil {
+			reply = "Global tag '" + name + "' already exists."
+			break
+		}
+		if reserved(name) {
+			reply = "'" + name + "' is a tag command and can't be a tag name."
+			break
+		}
+		if content == "" {
+			break
+		}
+		now := time.Now()
+		t.Global.Tags[key(name)] = &Tag{
+			Name:      name,
+			OwnerID:   m.AuthorID(),
+			Content:   content,
+			CreatedAt: now,
+			EditedAt:  now,
+		}
+		reply = "Added global tag '" + name + "'"
+	case "edit":
+		if tag == nil || content == "" {
+			reply = "Couldn't find global tag '" + name + "'."
+			break
+		}
+		tag.Content = content
+		tag.EditedAt = time.Now()
+		reply = "Edited global tag '" + name + "'"
+	case "remove":
+		if tag == nil {
+			reply = "Couldn't find global tag '" + name + "'."
+			break
+		}
+		t.Global.remove(tag)
+		removeTagDir(tagDir("", tag.Name))
+		reply = "Removed global tag '" + name + "'"
+	}
+	t.Unlock()
+
+	if reply != "" {
+		t.persist(m)
+		m.Reply(reply)
 	}
 }
 
 func (t *Tags) OnMessage(m *dgofw.DiscordMessage) {
+	t.handle(discordMessage{m})
+}
+
+func (t *Tags) handle(m message) {
 	arg1 := m.Arg("arg1")
 	switch arg1 {
+	case "":
+		return
 	case "add":
 		name, content := m.Arg("arg2"), m.Arg("arg3")
 		if name == "" || content == "" {
@@ -161,8 +947,55 @@ func (t *Tags) OnMessage(m *dgofw.DiscordMessage) {
 		}
 
 		t.editTag(m, name, content)
+	case "get":
+		if name := m.Arg("arg2"); name != "" {
+			t.getTag(m, name, m.Arg("arg3"))
+		}
+	case "list":
+		t.listTags(m, strings.Fields(m.Arg("arg2")+" "+m.Arg("arg3")))
+	case "search":
+		query := strings.TrimSpace(m.Arg("arg2") + " " + m.Arg("arg3"))
+		if query == "" {
+			return
+		}
+		t.searchTags(m, query)
+	case "info":
+		if name := m.Arg("arg2"); name != "" {
+			t.tagInfo(m, name)
+		}
+	case "alias":
+		alias, name := m.Arg("arg2"), m.Arg("arg3")
+		if alias == "" || name == "" {
+			return
+		}
+		t.aliasTag(m, alias, name)
+	case "transfer":
+		name, user := m.Arg("arg2"), m.Arg("arg3")
+		if name == "" || user == "" {
+			return
+		}
+		t.transferTag(m, name, user)
+	case "claim":
+		if name := m.Arg("arg2"); name != "" {
+			t.claimTag(m, name)
+		}
+	case "embed":
+		name, args := m.Arg("arg2"), m.Arg("arg3")
+		if name == "" || args == "" {
+			return
+		}
+		t.embedTag(m, name, args)
+	case "attach":
+		if name := m.Arg("arg2"); name != "" {
+			t.attachTag(m, name)
+		}
+	case "detach":
+		if name := m.Arg("arg2"); name != "" {
+			t.detachTag(m, name)
+		}
+	case "global":
+		t.globalTag(m, m.Arg("arg2"), m.Arg("arg3"))
 	default:
-		name := m.Arg("arg1")
-		t.getTag(m, name)
+		t.getTag(m, arg1, strings.TrimSpace(m.Arg("arg2")+" "+m.Arg("arg3")))
 	}
 }
@@ -0,0 +1,252 @@
+package tags
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeMessage is a message sent by author in guild, with the replies it got.
+type fakeMessage struct {
+	args    map[string]string
+	guild   string
+	author  string
+	mod     bool
+	members map[string]bool
+	replies []string
+}
+
+func (m *fakeMessage) Arg(name string) string      { return m.args[name] }
+func (m *fakeMessage) GuildID() string             { return m.guild }
+func (m *fakeMessage) ChannelID() string           { return "channel" }
+func (m *fakeMessage) IsMod() bool                 { return m.mod }
+func (m *fakeMessage) AuthorID() string            { return m.author }
+func (m *fakeMessage) AuthorName() string          { return "user" + m.author }
+func (m *fakeMessage) GuildName() string           { return "guild" }
+func (m *fakeMessage) IsMember(userID string) bool { return m.members[userID] }
+func (m *fakeMessage) Reply(text string)           { m.replies = append(m.replies, text) }
+
+func (m *fakeMessage) Attachments() []*discordgo.MessageAttachment {
+	return nil
+}
+
+func (m *fakeMessage) Send(msg *discordgo.MessageSend) error {
+	m.replies = append(m.replies, msg.Content)
+	return nil
+}
+
+func (m *fakeMessage) lastReply() string {
+	if len(m.replies) == 0 {
+		return ""
+	}
+	return m.replies[len(m.replies)-1]
+}
+
+// command builds a message from a command line like "add name content".
+func command(author string, mod bool, line string) *fakeMessage {
+	fields := strings.SplitN(line, " ", 3)
+	args := map[string]string{}
+	for i, f := range fields {
+		args["arg"+string(rune('1'+i))] = f
+	}
+	return &fakeMessage{
+		args:    args,
+		guild:   "guild",
+		author:  author,
+		mod:     mod,
+		members: map[string]bool{"1": true, "2": true, "mod": true},
+	}
+}
+
+func newTestTags(t *testing.T) *Tags {
+	tags := newTags("owner", filepath.Join(t.TempDir(), "tags.json"))
+	tags.Guilds["guild"] = newServer("guild")
+	tags.Guilds["guild"].Tags["hello"] = &Tag{Name: "Hello", OwnerID: "1", Content: "hi there"}
+	tags.Guilds["guild"].Tags["hey"] = &Tag{Name: "hey", OwnerID: "1", AliasOf: "Hello"}
+	tags.Guilds["guild"].Tags["gone"] = &Tag{Name: "gone", OwnerID: "left", Content: "bye"}
+	// Saved before list was a command
+	tags.Guilds["guild"].Tags["list"] = &Tag{Name: "list", OwnerID: "1", Content: "a list"}
+	return tags
+}
+
+func TestCommands(t *testing.T) {
+	cases := []struct {
+		name   string
+		author string
+		mod    bool
+		line   string
+		reply  string
+		check  func(t *testing.T, tags *Tags)
+	}{
+		{"add", "2", false, "add new some content", "Added tag 'new'", func(t *testing.T, tags *Tags) {
+			if tag := tags.Guilds["guild"].find("NEW"); tag == nil || tag.Content != "some content" || tag.OwnerID != "2" {
+				t.Errorf("tag wasn't added: %+v", tag)
+			}
+		}},
+		{"add existing", "2", false, "add HELLO other", "already exists", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello").Content != "hi there" {
+				t.Error("existing tag was replaced")
+			}
+		}},
+		{"edit own", "1", false, "edit hello changed", "Edited tag", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello").Content != "changed" {
+				t.Error("tag wasn't edited")
+			}
+		}},
+		{"edit other's", "2", false, "edit hello changed", "you own", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello").Content != "hi there" {
+				t.Error("tag was edited by someone else")
+			}
+		}},
+		{"edit as mod", "mod", true, "edit hello changed", "Edited tag", nil},
+		{"edit alias", "1", false, "edit hey changed", "you own", nil},
+		{"remove own", "1", false, "remove hello", "Removed tag", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello") != nil || tags.Guilds["guild"].find("hey") != nil {
+				t.Error("tag or its alias is still there")
+			}
+		}},
+		{"remove other's", "2", false, "remove hello", "you own", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello") == nil {
+				t.Error("tag was removed by someone else")
+			}
+		}},
+		{"remove as mod", "mod", true, "remove hello", "Removed tag", nil},
+		{"remove alias only", "1", false, "remove hey", "Removed tag", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello") == nil {
+				t.Error("removing an alias removed the tag")
+			}
+		}},
+		{"alias", "2", false, "alias greet hey", "Added alias", func(t *testing.T, tags *Tags) {
+			// Aliases of aliases point at the tag itself
+			if tag := tags.Guilds["guild"].find("greet"); tag == nil || tag.AliasOf != "Hello" {
+				t.Errorf("alias wasn't added: %+v", tag)
+			}
+		}},
+		{"add reserved", "2", false, "add Info some content", "can't be a tag name", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("info") != nil {
+				t.Error("tag named like a command was added")
+			}
+		}},
+		{"alias existing", "2", false, "alias hey hello", "already exists", nil},
+		{"alias reserved", "2", false, "alias search hello", "can't be a tag name", nil},
+		{"get reserved", "2", false, "get list", "a list", nil},
+		{"get alias", "2", false, "get hey", "hi there", nil},
+		{"alias missing", "2", false, "alias greet nothing", "Couldn't find", nil},
+		{"transfer own", "1", false, "transfer hello <@!2>", "Gave 'hello' to <@2>", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello").OwnerID != "2" {
+				t.Error("tag wasn't transferred")
+			}
+		}},
+		{"transfer other's", "2", false, "transfer hello <@2>", "you own", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello").OwnerID != "1" {
+				t.Error("tag was taken by someone else")
+			}
+		}},
+		{"transfer to nobody", "1", false, "transfer hello someone", "Who should", nil},
+		{"claim owner left", "2", false, "claim gone", "You now own", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("gone").OwnerID != "2" {
+				t.Error("tag wasn't claimed")
+			}
+		}},
+		{"claim owner here", "2", false, "claim hello", "still here", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello").OwnerID != "1" {
+				t.Error("tag was claimed from a member")
+			}
+		}},
+		{"use", "2", false, "hey", "hi there", func(t *testing.T, tags *Tags) {
+			if tags.Guilds["guild"].find("hello").Uses != 1 {
+				t.Error("use wasn't counted")
+			}
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tags := newTestTags(t)
+			m := command(c.author, c.mod, c.line)
+			tags.handle(m)
+			if !strings.Contains(m.lastReply(), c.reply) {
+				t.Errorf("got reply %q, want %q", m.lastReply(), c.reply)
+			}
+			if c.check != nil {
+				c.check(t, tags)
+			}
+		})
+	}
+}
+
+func TestGlobalTagsNeedOwner(t *testing.T) {
+	tags := newTestTags(t)
+	tags.handle(command("1", true, "global add rules be nice"))
+	if tags.Global.find("rules") != nil {
+		t.Error("a mod added a global tag")
+	}
+	tags.handle(command("owner", false, "global add rules be nice"))
+	if tags.Global.find("rules") == nil {
+		t.Fatal("the owner couldn't add a global tag")
+	}
+
+	m := command("2", false, "rules")
+	tags.handle(m)
+	if m.lastReply() != "be nice" {
+		t.Errorf("got %q for a global tag", m.lastReply())
+	}
+}
+
+func TestUsesAreSavedOnFlush(t *testing.T) {
+	tags := newTestTags(t)
+	tags.handle(command("2", false, "hello"))
+	if _, err := os.Stat(tags.path); !os.IsNotExist(err) {
+		t.Fatal("using a tag saved the state right away")
+	}
+	if err := tags.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTags("owner", tags.path)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if uses := loaded.Guilds["guild"].find("hello").Uses; uses != 1 {
+		t.Errorf("saved %d uses, want 1", uses)
+	}
+}
+
+func TestTagDir(t *testing.T) {
+	for _, name := range []string{".", "..", "../..", "a/b"} {
+		dir := tagDir("guild", name)
+		if filepath.Dir(dir) != filepath.Join(dataDir, "guild") {
+			t.Errorf("tag %q is stored in %s", name, dir)
+		}
+	}
+	if tagDir("guild", "a b") == tagDir("guild", "a_b") {
+		t.Error("different tags share a directory")
+	}
+	if tagDir("guild", "Name") != tagDir("guild", "name") {
+		t.Error("the same tag has different directories")
+	}
+}
+
+func TestRange(t *testing.T) {
+	for _, c := range []struct {
+		content string
+		ok      bool
+	}{
+		{"{range:1|6}", true},
+		{"{range:-5|-5}", true},
+		{"{range:6|1}", false},
+		{"{range:0|9223372036854775807}", false},
+		{"{range:-9223372036854775808|0}", false},
+	} {
+		out, err := expand(c.content, newScriptContext(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := out != c.content; ok != c.ok {
+			t.Errorf("%s expanded to %q", c.content, out)
+		}
+	}
+}
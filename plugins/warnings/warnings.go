@@ -0,0 +1,393 @@
+package warnings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	ActionTimeout = "timeout"
+	ActionKick    = "kick"
+	ActionBan     = "ban"
+)
+
+type Warning struct {
+	Case     int       `json:"case"`
+	UserID   string    `json:"user_id"`
+	ModID    string    `json:"mod_id"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+	Pardoned bool      `json:"pardoned"`
+}
+
+// Threshold is applied once a member reaches Count active warnings.
+// Minutes is only used by the timeout action.
+type Threshold struct {
+	Count   int    `json:"count"`
+	Action  string `json:"action"`
+	Minutes int    `json:"minutes"`
+}
+
+type Server struct {
+	ID         string       `json:"id"`
+	NextCase   int          `json:"next_case"`
+	ExpiryDays int          `json:"expiry_days"`
+	Thresholds []*Threshold `json:"thresholds"`
+	Warnings   []*Warning   `json:"warnings"`
+}
+
+type Warnings struct {
+	sync.RWMutex
+	Servers []*Server `json:"servers"`
+}
+
+var WarningsHelp = []string{
+	"warn [@user] [reason]  -- Warns a member, only usable by mods.",
+	"warnings [@user]       -- Lists the active warnings of a member.",
+	"pardon [case]          -- Pardons a warning, only usable by mods.",
+	"warnconfig             -- Shows the warning settings for the server.",
+	"warnconfig expiry [days] -- Warnings expire after N days, 0 never expires.",
+	"warnconfig threshold [N] [timeout|kick|ban|off] [minutes] -- Action taken at N active warnings.",
+}
+
+func NewWarnings() *Warnings {
+	plugin := &Warnings{Servers: make([]*Server, 0)}
+	err := plugin.Load()
+	if err != nil {
+		fmt.Println(err.Error())
+		plugin.Save()
+	}
+	return plugin
+}
+
+// getServer must be called with the lock held.
+func (w *Warnings) getServer(id string, create bool) *Server {
+	for _, s := range w.Servers {
+		if s.ID == id {
+			return s
+		}
+	}
+	if !create {
+		return nil
+	}
+	s := &Server{
+		ID:         id,
+		NextCase:   1,
+		Thresholds: make([]*Threshold, 0),
+		Warnings:   make([]*Warning, 0),
+	}
+	w.Servers = append(w.Servers, s)
+	return s
+}
+
+func (s *Server) active(userID string, now time.Time) []*Warning {
+	result := []*Warning{}
+	for _, warning := range s.Warnings {
+		if warning.UserID != userID || warning.Pardoned {
+			continue
+		}
+		if s.ExpiryDays > 0 && now.Sub(warning.Time) > time.Duration(s.ExpiryDays)*24*time.Hour {
+			continue
+		}
+		result = append(result, warning)
+	}
+	return result
+}
+
+// threshold returns the highest threshold reached by count active warnings.
+func (s *Server) threshold(count int) *Threshold {
+	var result *Threshold
+	for _, t := range s.Thresholds {
+		if t.Count <= count && (result == nil || t.Count > result.Count) {
+			result = t
+		}
+	}
+	return result
+}
+
+// Warn records a warning, notifies the member and applies the threshold
+// action it reached, if any.
+func (w *Warnings) Warn(s *discordgo.Session, guildID, userID, modID, reason string) (*Warning, int, *Threshold, error) {
+	if reason == "" {
+		reason = "No reason given"
+	}
+
+	w.Lock()
+	srv := w.getServer(guildID, true)
+	warning := &Warning{
+		Case:   srv.NextCase,
+		UserID: userID,
+		ModID:  modID,
+		Reason: reason,
+		Time:   time.Now(),
+	}
+	srv.NextCase++
+	srv.Warnings = append(srv.Warnings, warning)
+	count := len(srv.active(userID, warning.Time))
+	var threshold *Threshold
+	if t := srv.threshold(count); t != nil {
+		copied := *t
+		threshold = &copied
+	}
+	w.Unlock()
+	w.Save()
+
+	guild := guildID
+	if g, err := s.State.Guild(guildID); err == nil {
+		guild = g.Name
+	}
+	notify(s, userID, fmt.Sprintf("You were warned in **%s** (case #%d): %s\nYou now have %d active warning(s).", guild, warning.Case, reason, count))
+
+	if threshold == nil {
+		return warning, count, nil, nil
+	}
+	return warning, count, threshold, punish(s, guildID, userID, guild, threshold)
+}
+
+func (w *Warnings) warn(m *dgofw.DiscordMessage, userID, reason string) {
+	warning, count, threshold, err := w.Warn(m.Session(), m.GuildID(), userID, m.Author.ID(), reason)
+	m.Reply(fmt.Sprintf("Warned <@%s> (case #%d). They now have %d active warning(s).", userID, warning.Case, count))
+
+	if threshold == nil {
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		m.Reply("Couldn't " + threshold.Action + " <@" + userID + ">: " + err.Error())
+		return
+	}
+	m.Reply(fmt.Sprintf("<@%s> reached %d warnings, applied **%s**.", userID, threshold.Count, threshold.Action))
+}
+
+func notify(s *discordgo.Session, userID, text string) {
+	ch, err := s.UserChannelCreate(userID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	s.ChannelMessageSend(ch.ID, text)
+}
+
+func punish(s *discordgo.Session, guildID, userID, guild string, t *Threshold) error {
+	reason := fmt.Sprintf("Reached %d active warnings", t.Count)
+	switch t.Action {
+	case ActionTimeout:
+		until := time.Now().Add(time.Duration(t.Minutes) * time.Minute)
+		notify(s, userID, fmt.Sprintf("You were timed out in **%s** for %d minutes. %s.", guild, t.Minutes, reason))
+		return s.GuildMemberTimeout(guildID, userID, &until)
+	case ActionKick:
+		// DM first, we can't reach members that share no guild with us
+		notify(s, userID, fmt.Sprintf("You were kicked from **%s**. %s.", guild, reason))
+		return s.GuildMemberDeleteWithReason(guildID, userID, reason)
+	case ActionBan:
+		notify(s, userID, fmt.Sprintf("You were banned from **%s**. %s.", guild, reason))
+		return s.GuildBanCreateWithReason(guildID, userID, reason, 0)
+	}
+	return fmt.Errorf("unknown action %q", t.Action)
+}
+
+func (w *Warnings) listWarnings(m *dgofw.DiscordMessage, userID string) {
+	w.RLock()
+	var active []*Warning
+	if s := w.getServer(m.GuildID(), false); s != nil {
+		active = s.active(userID, time.Now())
+	}
+	w.RUnlock()
+
+	if len(active) == 0 {
+		m.Reply("<@" + userID + "> has no active warnings.")
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("<@%s> has %d active warning(s):\n", userID, len(active)))
+	for _, warning := range active {
+		buf.WriteString(fmt.Sprintf("`#%d` %s -- %s by <@%s>\n", warning.Case, warning.Time.Format("2006-01-02"), warning.Reason, warning.ModID))
+	}
+	m.Reply(buf.String())
+}
+
+func (w *Warnings) pardon(m *dgofw.DiscordMessage, id int) {
+	w.Lock()
+	var found *Warning
+	if s := w.getServer(m.GuildID(), false); s != nil {
+		for _, warning := range s.Warnings {
+			if warning.Case == id {
+				found = warning
+				break
+			}
+		}
+	}
+	if found == nil || found.Pardoned {
+		w.Unlock()
+		m.Reply(fmt.Sprintf("No active case #%d", id))
+		return
+	}
+	found.Pardoned = true
+	w.Unlock()
+	w.Save()
+
+	m.Reply(fmt.Sprintf("Pardoned case #%d for <@%s>", id, found.UserID))
+}
+
+func (w *Warnings) showConfig(m *dgofw.DiscordMessage) {
+	w.RLock()
+	defer w.RUnlock()
+	s := w.getServer(m.GuildID(), false)
+	if s == nil || (len(s.Thresholds) == 0 && s.ExpiryDays == 0) {
+		m.Reply("No warning settings for this server.")
+		return
+	}
+
+	var buf bytes.Buffer
+	if s.ExpiryDays > 0 {
+		buf.WriteString(fmt.Sprintf("Warnings expire after **%d** days.\n", s.ExpiryDays))
+	} else {
+		buf.WriteString("Warnings never expire.\n")
+	}
+	for _, t := range s.Thresholds {
+		if t.Action == ActionTimeout {
+			buf.WriteString(fmt.Sprintf("`%d` warnings -- timeout for %d minutes\n", t.Count, t.Minutes))
+		} else {
+			buf.WriteString(fmt.Sprintf("`%d` warnings -- %s\n", t.Count, t.Action))
+		}
+	}
+	m.Reply(buf.String())
+}
+
+func (w *Warnings) setExpiry(m *dgofw.DiscordMessage, days int) {
+	w.Lock()
+	w.getServer(m.GuildID(), true).ExpiryDays = days
+	w.Unlock()
+	w.Save()
+
+	if days == 0 {
+		m.Reply("Warnings no longer expire.")
+		return
+	}
+	m.Reply(fmt.Sprintf("Warnings now expire after %d days.", days))
+}
+
+func (w *Warnings) setThreshold(m *dgofw.DiscordMessage, count int, action string, minutes int) {
+	switch action {
+	case ActionTimeout:
+		if minutes <= 0 {
+			m.Reply("Timeouts need a duration in minutes.")
+			return
+		}
+	case ActionKick, ActionBan, "off":
+	default:
+		m.Reply("Unknown action, use timeout, kick, ban or off.")
+		return
+	}
+
+	w.Lock()
+	s := w.getServer(m.GuildID(), true)
+	thresholds := make([]*Threshold, 0, len(s.Thresholds)+1)
+	for _, t := range s.Thresholds {
+		if t.Count != count {
+			thresholds = append(thresholds, t)
+		}
+	}
+	if action != "off" {
+		thresholds = append(thresholds, &Threshold{Count: count, Action: action, Minutes: minutes})
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i].Count < thresholds[j].Count })
+	s.Thresholds = thresholds
+	w.Unlock()
+	w.Save()
+
+	if action == "off" {
+		m.Reply(fmt.Sprintf("Removed the action at %d warnings.", count))
+		return
+	}
+	m.Reply(fmt.Sprintf("Members reaching %d warnings will get a %s.", count, action))
+}
+
+func (w *Warnings) OnWarn(m *dgofw.DiscordMessage) {
+	if !m.IsMod() {
+		return
+	}
+	userID := discordutil.ParseUserID(m.Arg("user"))
+	if userID == "" {
+		m.Reply("Who should I warn?")
+		return
+	}
+	w.warn(m, userID, m.Arg("reason"))
+}
+
+func (w *Warnings) OnWarnings(m *dgofw.DiscordMessage) {
+	userID := m.Author.ID()
+	if arg := m.Arg("user"); arg != "" {
+		if userID = discordutil.ParseUserID(arg); userID == "" {
+			m.Reply("Invalid user")
+			return
+		}
+	}
+	w.listWarnings(m, userID)
+}
+
+func (w *Warnings) OnPardon(m *dgofw.DiscordMessage) {
+	if !m.IsMod() {
+		return
+	}
+	if i, err := strconv.ParseInt(m.Arg("case"), 10, 64); err == nil {
+		w.pardon(m, int(i))
+	} else {
+		m.Reply("Invalid case number")
+	}
+}
+
+func (w *Warnings) OnConfig(m *dgofw.DiscordMessage) {
+	if !m.IsMod() {
+		return
+	}
+	switch m.Arg("arg1") {
+	case "expiry":
+		if i, err := strconv.ParseInt(m.Arg("arg2"), 10, 64); err == nil && i >= 0 {
+			w.setExpiry(m, int(i))
+		} else {
+			m.Reply("Invalid number of days")
+		}
+	case "threshold":
+		count, err := strconv.ParseInt(m.Arg("arg2"), 10, 64)
+		if err != nil || count <= 0 {
+			m.Reply("Invalid number of warnings")
+			return
+		}
+		minutes, _ := strconv.ParseInt(m.Arg("arg4"), 10, 64)
+		w.setThreshold(m, int(count), m.Arg("arg3"), int(minutes))
+	default:
+		w.showConfig(m)
+	}
+}
+
+func (w *Warnings) Save() (err error) {
+	w.RLock()
+	defer w.RUnlock()
+	var f *os.File
+	if f, err = os.Create("./warningsstate.json"); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(w)
+	}
+	return
+}
+
+func (w *Warnings) Load() (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile("./warningsstate.json"); err == nil {
+		return json.Unmarshal(b, w)
+	}
+	return
+}
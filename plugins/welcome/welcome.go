@@ -0,0 +1,392 @@
+package welcome
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Krognol/dgofw"
+	"github.com/Krognol/mountainbot/plugins/discordutil"
+	"github.com/bwmarrin/discordgo"
+)
+
+type (
+	// Message is a welcome or farewell message. Content may use the
+	// {user}, {mention}, {server} and {membercount} template variables.
+	Message struct {
+		Channel string `json:"channel"`
+		Content string `json:"content"`
+		Embed   bool   `json:"embed"`
+	}
+
+	Server struct {
+		ID        string   `json:"id"`
+		Welcome   Message  `json:"welcome"`
+		Farewell  Message  `json:"farewell"`
+		DM        string   `json:"dm"`
+		JoinRoles []string `json:"join_roles"`
+	}
+
+	Welcome struct {
+		sync.RWMutex
+		Servers []*Server `json:"servers"`
+	}
+)
+
+var WelcomeHelp = []string{
+	"welcome -- Shows the welcome settings. All welcome commands are mod only.",
+	"welcome channel [#channel] / farewell channel [#channel] -- Where the messages are posted, leave empty to turn off",
+	"welcome message [text] / farewell message [text] -- Message template",
+	"welcome embed [on|off] / farewell embed [on|off] -- Post the message as an embed",
+	"welcome dm [text|off] -- Also DM new members",
+	"welcome role add [@role] / welcome role remove [@role] -- Roles given to new members",
+	"welcome test / farewell test -- Previews the message",
+	"Templates can use {user}, {mention}, {server} and {membercount}",
+}
+
+func NewWelcome() *Welcome {
+	plugin := &Welcome{Servers: make([]*Server, 0)}
+	err := plugin.Load()
+	if err != nil {
+		fmt.Println(err.Error())
+		plugin.Save()
+	}
+	return plugin
+}
+
+// getServer must be called with the lock held.
+func (w *Welcome) getServer(id string, create bool) *Server {
+	for _, s := range w.Servers {
+		if s.ID == id {
+			return s
+		}
+	}
+	if !create {
+		return nil
+	}
+	s := &Server{
+		ID: id,
+		Welcome: Message{
+			Content: "Welcome to **{server}**, {mention}!",
+		},
+		Farewell: Message{
+			Content: "**{user}** left the server.",
+		},
+		JoinRoles: make([]string, 0),
+	}
+	w.Servers = append(w.Servers, s)
+	return s
+}
+
+func render(content string, s *discordgo.Session, guildID string, user *discordgo.User) string {
+	server, count := guildID, 0
+	if g, err := s.State.Guild(guildID); err == nil {
+		server, count = g.Name, g.MemberCount
+	}
+	return strings.NewReplacer(
+		"{user}", user.Username,
+		"{mention}", user.Mention(),
+		"{server}", server,
+		"{membercount}", strconv.Itoa(count),
+	).Replace(content)
+}
+
+func send(s *discordgo.Session, channelID, content string, embed bool, user *discordgo.User) error {
+	var err error
+	if embed {
+		_, err = s.ChannelMessageSendEmbed(channelID, &discordgo.MessageEmbed{
+			Description: content,
+			Thumbnail:   &discordgo.MessageEmbedThumbnail{URL: user.AvatarURL("")},
+			Color:       0xf72e64,
+		})
+	} else {
+		_, err = s.ChannelMessageSend(channelID, content)
+	}
+	return err
+}
+
+func (w *Welcome) settings(guildID string) (Server, bool) {
+	w.RLock()
+	defer w.RUnlock()
+	if s := w.getServer(guildID, false); s != nil {
+		return *s, true
+	}
+	return Server{}, false
+}
+
+// Posts reports whether a server has a welcome or farewell channel set, in
+// which case the joins or leaves don't need to go to the bot log channel too.
+func (w *Welcome) Posts(guildID string, farewell bool) bool {
+	srv, ok := w.settings(guildID)
+	if !ok {
+		return false
+	}
+	if farewell {
+		return srv.Farewell.Channel != ""
+	}
+	return srv.Welcome.Channel != ""
+}
+
+// guildRole returns the role of a guild with the id, or nil.
+func guildRole(s *discordgo.Session, guildID, roleID string) *discordgo.Role {
+	roles, err := s.GuildRoles(guildID)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	for _, role := range roles {
+		if role.ID == roleID {
+			return role
+		}
+	}
+	return nil
+}
+
+func (w *Welcome) OnMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	srv, ok := w.settings(m.GuildID)
+	if !ok || m.User == nil {
+		return
+	}
+
+	for _, id := range srv.JoinRoles {
+		// A join role may have been given moderation permissions after it was set
+		if role, err := s.State.Role(m.GuildID, id); err == nil && role.Permissions&discordutil.ElevatedPermissions != 0 {
+			continue
+		}
+		if err := s.GuildMemberRoleAdd(m.GuildID, m.User.ID, id); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if srv.Welcome.Channel != "" {
+		content := render(srv.Welcome.Content, s, m.GuildID, m.User)
+		if err := send(s, srv.Welcome.Channel, content, srv.Welcome.Embed, m.User); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if srv.DM != "" {
+		if ch, err := s.UserChannelCreate(m.User.ID); err == nil {
+			s.ChannelMessageSend(ch.ID, render(srv.DM, s, m.GuildID, m.User))
+		}
+	}
+}
+
+func (w *Welcome) OnMemberRemove(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+	srv, ok := w.settings(m.GuildID)
+	if !ok || m.User == nil || srv.Farewell.Channel == "" {
+		return
+	}
+
+	content := render(srv.Farewell.Content, s, m.GuildID, m.User)
+	if err := send(s, srv.Farewell.Channel, content, srv.Farewell.Embed, m.User); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (w *Welcome) showConfig(m *dgofw.DiscordMessage) {
+	srv, ok := w.settings(m.GuildID())
+	if !ok {
+		m.Reply("No welcome settings for this server.")
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range []struct {
+		name string
+		msg  Message
+	}{{"Welcome", srv.Welcome}, {"Farewell", srv.Farewell}} {
+		if msg.msg.Channel == "" {
+			buf.WriteString(fmt.Sprintf("**%s**: off\n", msg.name))
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("**%s** in <#%s> (embed: %t): %s\n", msg.name, msg.msg.Channel, msg.msg.Embed, msg.msg.Content))
+	}
+	if srv.DM != "" {
+		buf.WriteString("**DM**: " + srv.DM + "\n")
+	}
+	for _, role := range srv.JoinRoles {
+		buf.WriteString("Join role: <@&" + role + ">\n")
+	}
+	m.Reply(buf.String())
+}
+
+func (w *Welcome) test(m *dgofw.DiscordMessage, farewell bool) {
+	srv, ok := w.settings(m.GuildID())
+	if !ok {
+		m.Reply("No welcome settings for this server.")
+		return
+	}
+
+	msg := srv.Welcome
+	if farewell {
+		msg = srv.Farewell
+	}
+
+	user, err := m.Session().User(m.Author.ID())
+	if err != nil {
+		m.Reply("Something happened...")
+		return
+	}
+	if err := send(m.Session(), m.ChannelID(), render(msg.Content, m.Session(), m.GuildID(), user), msg.Embed, user); err != nil {
+		fmt.Println(err)
+	}
+	if !farewell && srv.DM != "" {
+		m.Reply("DM: " + render(srv.DM, m.Session(), m.GuildID(), user))
+	}
+}
+
+func usage(farewell bool) string {
+	if farewell {
+		return "Use `farewell channel|message|embed|test`"
+	}
+	return "Use `welcome channel|message|embed|dm|role|test`"
+}
+
+func (w *Welcome) configure(m *dgofw.DiscordMessage, farewell bool) {
+	if !m.IsMod() {
+		return
+	}
+
+	arg1, arg2 := m.Arg("arg1"), m.Arg("arg2")
+	switch arg1 {
+	case "test":
+		w.test(m, farewell)
+		return
+	case "":
+		w.showConfig(m)
+		return
+	case "channel", "message", "embed":
+	case "dm", "role":
+		if farewell {
+			m.Reply(usage(farewell))
+			return
+		}
+	default:
+		m.Reply(usage(farewell))
+		return
+	}
+
+	var roleID string
+	var roleAdd bool
+	switch arg1 {
+	case "channel":
+		if ch := discordutil.ParseID(arg2); ch != "" && !discordutil.ChannelInGuild(m.Session(), ch, m.GuildID()) {
+			m.Reply("That channel isn't in this server.")
+			return
+		}
+	case "message":
+		if arg2 == "" {
+			m.Reply("The message can't be empty")
+			return
+		}
+	case "dm":
+		if arg2 == "" {
+			m.Reply("Use `welcome dm [text|off]`")
+			return
+		}
+	case "role":
+		fields := strings.Fields(arg2)
+		if len(fields) != 2 || discordutil.ParseID(fields[1]) == "" || (fields[0] != "add" && fields[0] != "remove") {
+			m.Reply("Use `welcome role add|remove @role`")
+			return
+		}
+		roleID, roleAdd = discordutil.ParseID(fields[1]), fields[0] == "add"
+		if roleAdd {
+			role := guildRole(m.Session(), m.GuildID(), roleID)
+			if role == nil {
+				m.Reply("Couldn't find that role in this server.")
+				return
+			}
+			if reason := discordutil.CheckAssignable(m.Session(), m.GuildID(), role); reason != "" {
+				m.Reply(reason)
+				return
+			}
+		}
+	}
+
+	w.Lock()
+	srv := w.getServer(m.GuildID(), true)
+	msg := &srv.Welcome
+	if farewell {
+		msg = &srv.Farewell
+	}
+
+	var reply string
+	switch arg1 {
+	case "channel":
+		msg.Channel = discordutil.ParseID(arg2)
+		if msg.Channel == "" {
+			reply = "Turned off"
+		} else {
+			reply = "Posting in <#" + msg.Channel + ">"
+		}
+	case "message":
+		msg.Content = arg2
+		reply = "Updated the message"
+	case "embed":
+		msg.Embed = arg2 == "on"
+		if msg.Embed {
+			reply = "Posting as an embed"
+		} else {
+			reply = "Posting as plain text"
+		}
+	case "dm":
+		if arg2 == "off" {
+			srv.DM = ""
+			reply = "No longer sending DMs"
+		} else {
+			srv.DM = arg2
+			reply = "Updated the DM"
+		}
+	case "role":
+		roles := make([]string, 0, len(srv.JoinRoles)+1)
+		for _, role := range srv.JoinRoles {
+			if role != roleID {
+				roles = append(roles, role)
+			}
+		}
+		if roleAdd {
+			srv.JoinRoles = append(roles, roleID)
+			reply = "New members will get <@&" + roleID + ">"
+		} else {
+			srv.JoinRoles = roles
+			reply = "New members won't get <@&" + roleID + ">"
+		}
+	}
+	w.Unlock()
+	w.Save()
+	m.Reply(reply)
+}
+
+func (w *Welcome) OnWelcome(m *dgofw.DiscordMessage) {
+	w.configure(m, false)
+}
+
+func (w *Welcome) OnFarewell(m *dgofw.DiscordMessage) {
+	w.configure(m, true)
+}
+
+func (w *Welcome) Save() (err error) {
+	w.RLock()
+	defer w.RUnlock()
+	var f *os.File
+	if f, err = os.Create("./welcomestate.json"); err == nil {
+		defer f.Close()
+		return json.NewEncoder(f).Encode(w)
+	}
+	return
+}
+
+func (w *Welcome) Load() (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile("./welcomestate.json"); err == nil {
+		return json.Unmarshal(b, w)
+	}
+	return
+}